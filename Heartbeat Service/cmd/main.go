@@ -1,82 +1,260 @@
-package main
-
-import (
-	"fmt"
-	"os"
-
-	"github.com/benmeehan/iot-heartbeat-service/internal/constants"
-	"github.com/benmeehan/iot-heartbeat-service/internal/database"
-	"github.com/benmeehan/iot-heartbeat-service/internal/services"
-	"github.com/benmeehan/iot-heartbeat-service/internal/utils"
-	"github.com/benmeehan/iot-heartbeat-service/pkg/kafka"
-	"github.com/benmeehan/iot-heartbeat-service/pkg/mqtt"
-	"github.com/google/uuid"
-
-	"github.com/sirupsen/logrus"
-)
-
-func main() {
-	// Set up structured logging with JSON output
-	var log = &logrus.Logger{
-		Out:       os.Stdout,
-		Formatter: new(logrus.JSONFormatter),
-		Hooks:     make(logrus.LevelHooks),
-		Level:     logrus.InfoLevel,
-	}
-
-	// Load configuration from file
-	config, err := utils.LoadConfig("config/config.yaml", log)
-	if err != nil {
-		logrus.WithError(err).Fatal("Failed to load configuration")
-	}
-
-	// Generate a unique MQTT Client ID by appending a UUID
-	config.MQTT.ClientID = config.MQTT.ClientID + "-" + uuid.New().String()
-	logrus.Infof("Using MQTT Client ID: %s", config.MQTT.ClientID)
-
-	// Initialize the shared MQTT connection
-	mqttClient := mqtt.NewMqttService(log)
-	err = mqttClient.Initialize(config.MQTT.Broker, config.MQTT.ClientID, config.MQTT.TLS.CACert)
-	if err != nil {
-		logrus.WithError(err).Fatal("Failed to initialize MQTT connection")
-	}
-
-	// Initialize the database connection
-	dBClient := database.NewDatabase(log)
-	connStr := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
-		config.DB.Host, config.DB.Port, config.DB.User, config.DB.Password, config.DB.Name, config.DB.SSLMode)
-
-	if err := dBClient.Connect(connStr); err != nil {
-		logrus.WithError(err).Fatal("Failed to initialize database connection")
-	}
-	defer dBClient.Close()
-
-	var kafkaClient *kafka.KafkaClient
-
-	// Initialize Kafka client only if the mode is queue
-	if config.Service.Mode == constants.QUEUE_MODE {
-		kafkaClient, err = kafka.NewKafkaClient(
-			config.Kafka.SecurityProtocol,
-			config.Kafka.SSL.CACert,
-			config.Kafka.SSL.Cert,
-			config.Kafka.SSL.Key,
-			config.Kafka.SASL.Mechanism,
-			config.Kafka.SASL.Username,
-			config.Kafka.SASL.Password,
-			config.Kafka.Brokers,
-			config.Kafka.GroupID,
-			log,
-		)
-		if err != nil {
-			log.WithError(err).Fatal("Failed to initialize Kafka Client")
-		}
-	}
-
-	// Start heartbeat service and listen for device heartbeats
-	heartbeatService := services.NewHeartbeatService(config.Service.Mode, mqttClient, kafkaClient, dBClient, config.MQTT.Topic, config.MQTT.QOS, log)
-	heartbeatService.ListenForDeviceHeartbeats()
-
-	// Block the main thread to keep services running
-	logrus.Info("Heartbeat service is running...")
-	select {}
-}
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/benmeehan/iot-heartbeat-service/internal/api"
+	"github.com/benmeehan/iot-heartbeat-service/internal/constants"
+	"github.com/benmeehan/iot-heartbeat-service/internal/database"
+	"github.com/benmeehan/iot-heartbeat-service/internal/services"
+	"github.com/benmeehan/iot-heartbeat-service/internal/utils"
+	"github.com/benmeehan/iot-heartbeat-service/pkg/kafka"
+	"github.com/benmeehan/iot-heartbeat-service/pkg/mqtt"
+	"github.com/benmeehan/iot-heartbeat-service/pkg/token"
+	"github.com/google/uuid"
+
+	"github.com/sirupsen/logrus"
+)
+
+func main() {
+	// Set up structured logging with JSON output
+	var log = &logrus.Logger{
+		Out:       os.Stdout,
+		Formatter: new(logrus.JSONFormatter),
+		Hooks:     make(logrus.LevelHooks),
+		Level:     logrus.InfoLevel,
+	}
+
+	// Load configuration from file
+	config, err := utils.LoadConfig("config/config.yaml", log)
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to load configuration")
+	}
+
+	connStr := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		config.DB.Host, config.DB.Port, config.DB.User, config.DB.Password, config.DB.Name, config.DB.SSLMode)
+
+	// "migrate up|down [steps]|status" manages the database schema and exits
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrate(connStr, os.Args[2:], log)
+		return
+	}
+
+	// Generate a unique MQTT Client ID by appending a UUID
+	config.MQTT.ClientID = config.MQTT.ClientID + "-" + uuid.New().String()
+	logrus.Infof("Using MQTT Client ID: %s", config.MQTT.ClientID)
+
+	// Initialize the shared MQTT connection
+	mqttClient := mqtt.NewMqttService(log)
+	err = mqttClient.Initialize(config.MQTT.Broker, config.MQTT.ClientID, config.MQTT.TLS.CACert)
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to initialize MQTT connection")
+	}
+
+	// Initialize the database connection
+	dBClient := database.NewDatabase(log)
+	if err := dBClient.Connect(connStr); err != nil {
+		logrus.WithError(err).Fatal("Failed to initialize database connection")
+	}
+	defer dBClient.Close()
+
+	// Apply chunking, compression and retention to the hypertables
+	for table, policy := range config.Storage {
+		if err := dBClient.ApplyStoragePolicy(table, policy); err != nil {
+			log.WithError(err).Fatal("Failed to apply storage policy")
+		}
+	}
+
+	var kafkaClient *kafka.KafkaClient
+
+	// Initialize Kafka client only if the mode is queue
+	if config.Service.Mode == constants.QUEUE_MODE {
+		kafkaClient, err = kafka.NewKafkaClient(
+			config.Kafka.SecurityProtocol,
+			config.Kafka.SSL.CACert,
+			config.Kafka.SSL.Cert,
+			config.Kafka.SSL.Key,
+			config.Kafka.SASL.Mechanism,
+			config.Kafka.SASL.Username,
+			config.Kafka.SASL.Password,
+			config.Kafka.Brokers,
+			config.Kafka.GroupID,
+			log,
+		)
+		if err != nil {
+			log.WithError(err).Fatal("Failed to initialize Kafka Client")
+		}
+	}
+
+	// Access tokens are only checked when they are required
+	var tokenVerifier *token.Verifier
+	if config.Auth.RequireToken {
+		tokenVerifier, err = token.LoadVerifier(config.Auth.PublicKeyFiles, config.Auth.Issuer, config.Auth.Leeway)
+		if err != nil {
+			log.WithError(err).Fatal("Failed to load token public keys")
+		}
+	}
+
+	// Track registered devices and their states
+	deviceEventsTopic := config.MQTT.DeviceEventsTopic
+	if config.Service.Mode == constants.QUEUE_MODE {
+		deviceEventsTopic = config.Kafka.DeviceEventsTopic
+	}
+	deviceRegistry, err := services.NewDeviceRegistry(config.Service.Mode, mqttClient, kafkaClient, dBClient, deviceEventsTopic, config.MQTT.QOS, config.Devices.BlockedAction, config.Devices.UnknownAction, config.Devices.LookupRate, log)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to create device registry")
+	}
+	if err := deviceRegistry.Start(config.Devices.RefreshInterval); err != nil {
+		log.WithError(err).Fatal("Failed to start device registry")
+	}
+
+	// Presence events go to Kafka in every mode when a Kafka topic is set. Outside queue mode
+	// they get a client of their own that only produces.
+	presenceKafka := kafkaClient
+	if presenceKafka == nil && config.Presence.KafkaTopic != "" {
+		presenceKafka, err = kafka.NewKafkaClient(
+			config.Kafka.SecurityProtocol,
+			config.Kafka.SSL.CACert,
+			config.Kafka.SSL.Cert,
+			config.Kafka.SSL.Key,
+			config.Kafka.SASL.Mechanism,
+			config.Kafka.SASL.Username,
+			config.Kafka.SASL.Password,
+			config.Kafka.Brokers,
+			"",
+			log,
+		)
+		if err != nil {
+			log.WithError(err).Error("Failed to initialize Kafka producer, presence events only go to MQTT")
+		}
+	}
+
+	// Derive online/offline state from heartbeats
+	presenceService := services.NewPresenceService(mqttClient, presenceKafka, dBClient, config.Presence.MqttTopic, config.Presence.KafkaTopic, config.MQTT.QOS,
+		config.Presence.Interval, config.Presence.MissedIntervals, config.Presence.Devices, config.Presence.Groups, config.Presence.GroupLabel, log)
+	if err := presenceService.Start(config.Presence.SweepInterval, config.Devices.RefreshInterval); err != nil {
+		log.WithError(err).Fatal("Failed to start presence tracking")
+	}
+
+	// Track boot IDs and heartbeat sequences to count lost heartbeats and detect reboots
+	bootTracker := services.NewBootTracker(mqttClient, kafkaClient, dBClient, config.Reboots.MqttTopic, config.Reboots.KafkaTopic, config.MQTT.QOS, log)
+
+	// Write heartbeats in batches off the message callbacks
+	batcher := services.NewHeartbeatBatcher(dBClient, presenceService, bootTracker, config.Ingest.QueueSize, config.Ingest.Workers, config.Ingest.BatchSize,
+		config.Ingest.FlushInterval, config.Ingest.EnqueueTimeout, log)
+	batcher.Start()
+
+	// Write quarantined heartbeats in batches as well, dropping them when the queue is full
+	quarantine := services.NewQuarantineWriter(dBClient, config.Ingest.QueueSize, config.Ingest.BatchSize, config.Ingest.FlushInterval, log)
+	quarantine.Start()
+
+	// Start heartbeat service and listen for device heartbeats
+	heartbeatService := services.NewHeartbeatService(config.Service.Mode, mqttClient, kafkaClient, dBClient, deviceRegistry, presenceService, batcher, quarantine, services.NewClockCheck(config.Clock.MaxSkew, config.Clock.CorrectSkewed), tokenVerifier, config.MQTT.Topic, config.MQTT.StatusTopic, config.MQTT.QOS, log)
+	heartbeatService.ListenForDeviceHeartbeats()
+	heartbeatService.ListenForDeviceStatus()
+
+	// The heartbeat aggregates are created empty, materialize the heartbeats stored before them
+	availabilityService := services.NewAvailabilityService(dBClient, log)
+	go availabilityService.Backfill(config.Storage[constants.HEARTBEATS_TABLE].DropAfter)
+
+	// Serve availability reports computed from the heartbeat aggregates. The API is left off
+	// without a token.
+	apiToken, err := readToken(config.API.TokenFile)
+	if err != nil {
+		log.WithError(err).Warn("Reports API is disabled, it needs a token")
+	} else {
+		reportsAPI := api.NewReportsAPI(availabilityService, presenceService, apiToken, log)
+		reportsAPI.Start(config.API.Address)
+	}
+
+	// Run until the service is stopped, then stop receiving and write the queued heartbeats
+	logrus.Info("Heartbeat service is running...")
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+
+	log.Info("Shutting down heartbeat service")
+	mqttClient.Disconnect(250)
+	batcher.Close()
+	quarantine.Close()
+	if presenceKafka != nil {
+		presenceKafka.Close()
+	}
+}
+
+// readToken reads the API token from the file. A missing file or an empty token is an error.
+func readToken(file string) (string, error) {
+	if file == "" {
+		return "", fmt.Errorf("no token file configured")
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", file)
+	}
+	return token, nil
+}
+
+// runMigrate runs the migrate subcommand: "up" applies the pending migrations, "down [steps]"
+// reverts the last one or the given number and "status" lists them all. The service applies
+// its pending migrations at startup as well.
+func runMigrate(connStr string, args []string, log *logrus.Logger) {
+	dBClient := database.NewDatabase(log)
+	if err := dBClient.Open(connStr); err != nil {
+		log.WithError(err).Fatal("Failed to initialize database connection")
+	}
+	defer dBClient.Close()
+
+	migrator, err := dBClient.NewMigrator()
+	if err != nil {
+		log.WithError(err).Fatal("Failed to load migrations")
+	}
+
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	switch command {
+	case "up":
+		applied, err := migrator.Up()
+		if err != nil {
+			log.WithError(err).Fatal("Failed to apply migrations")
+		}
+		log.Infof("Applied %d migrations", applied)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				log.Fatalf("Invalid number of migrations to revert: %s", args[1])
+			}
+		}
+		if err := migrator.Down(steps); err != nil {
+			log.WithError(err).Fatal("Failed to revert migrations")
+		}
+	case "status":
+		statuses, err := migrator.Status()
+		if err != nil {
+			log.WithError(err).Fatal("Failed to read migration status")
+		}
+		for _, status := range statuses {
+			applied := "pending"
+			if status.AppliedAt != nil {
+				applied = "applied " + status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%s\t%s\n", status.Version, status.Name, applied)
+		}
+	default:
+		log.Fatalf("Unknown migrate command %q, use up, down [steps] or status", command)
+	}
+}
@@ -0,0 +1,247 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/benmeehan/iot-heartbeat-service/internal/constants"
+	"github.com/benmeehan/iot-heartbeat-service/internal/models"
+	"github.com/benmeehan/iot-heartbeat-service/internal/services"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// Range reported when the request doesn't give one
+const defaultReportRange = 7 * 24 * time.Hour
+
+// Page size of the presence snapshot and the fleet availability report
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// ReportsAPI serves availability reports and presence snapshots over HTTP
+type ReportsAPI struct {
+	Availability *services.AvailabilityService
+	Presence     *services.PresenceService
+	Token        string
+	Logger       *logrus.Logger
+}
+
+// NewReportsAPI creates a new instance of ReportsAPI
+func NewReportsAPI(availability *services.AvailabilityService, presence *services.PresenceService, token string, logger *logrus.Logger) *ReportsAPI {
+	return &ReportsAPI{
+		Availability: availability,
+		Presence:     presence,
+		Token:        token,
+		Logger:       logger,
+	}
+}
+
+// Start serves the reports API on the given address in the background
+func (a *ReportsAPI) Start(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("GET /availability", a.authorize(a.fleetAvailability))
+	mux.Handle("GET /availability/devices/{id}", a.authorize(a.deviceAvailability))
+	mux.Handle("GET /presence", a.authorize(a.presenceSnapshot))
+
+	go func() {
+		a.Logger.Infof("Reports API listening on %s", address)
+		if err := http.ListenAndServe(address, mux); err != nil {
+			a.Logger.WithError(err).Fatal("Reports API server stopped")
+		}
+	}()
+}
+
+// authorize rejects requests that don't carry the API bearer token
+func (a *ReportsAPI) authorize(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || a.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) != 1 {
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next(w, r)
+	})
+}
+
+func (a *ReportsAPI) deviceAvailability(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if _, err := uuid.Parse(id); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid device id")
+		return
+	}
+	from, to, ok := reportRange(w, r)
+	if !ok {
+		return
+	}
+
+	report, err := a.Availability.DeviceAvailability(id, from, to)
+	if err != nil {
+		a.reportError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// fleetAvailability reports the uptime of the fleet and lists a page of its devices. Query
+// parameters: from and to (RFC 3339), limit and offset.
+func (a *ReportsAPI) fleetAvailability(w http.ResponseWriter, r *http.Request) {
+	from, to, ok := reportRange(w, r)
+	if !ok {
+		return
+	}
+	limit, offset, ok := page(w, r)
+	if !ok {
+		return
+	}
+
+	report, err := a.Availability.FleetAvailability(from, to, limit, offset)
+	if err != nil {
+		a.reportError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// presenceSnapshot counts the devices by presence and lists a page of them. Query parameters:
+// tag, state (online, offline or never_seen), seen_after and seen_before (RFC 3339), limit,
+// offset and order (desc, the default, or asc by last seen).
+func (a *ReportsAPI) presenceSnapshot(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := models.PresenceFilter{
+		Tag:   query.Get("tag"),
+		State: query.Get("state"),
+	}
+
+	switch filter.State {
+	case "", constants.PRESENCE_ONLINE, constants.PRESENCE_OFFLINE, constants.PRESENCE_NEVER_SEEN:
+	default:
+		writeError(w, http.StatusBadRequest, "invalid state, expected online, offline or never_seen")
+		return
+	}
+
+	var ok bool
+	if filter.SeenAfter, ok = optionalTime(w, r, "seen_after"); !ok {
+		return
+	}
+	if filter.SeenBefore, ok = optionalTime(w, r, "seen_before"); !ok {
+		return
+	}
+
+	if filter.Limit, filter.Offset, ok = page(w, r); !ok {
+		return
+	}
+
+	switch query.Get("order") {
+	case "", "desc":
+	case "asc":
+		filter.Ascending = true
+	default:
+		writeError(w, http.StatusBadRequest, "invalid order, expected asc or desc")
+		return
+	}
+
+	snapshot, err := a.Presence.Snapshot(filter)
+	if err != nil {
+		a.internalError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, snapshot)
+}
+
+// reportError answers a range that is empty once aligned with a bad request and anything else
+// with an internal error
+func (a *ReportsAPI) reportError(w http.ResponseWriter, err error) {
+	if errors.Is(err, services.ErrInvalidRange) {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	a.internalError(w, err)
+}
+
+func (a *ReportsAPI) internalError(w http.ResponseWriter, err error) {
+	a.Logger.WithError(err).Error("Reports API request failed")
+	writeError(w, http.StatusInternalServerError, "internal error")
+}
+
+// reportRange parses the RFC 3339 from and to query parameters. They default to the last
+// seven days.
+func reportRange(w http.ResponseWriter, r *http.Request) (time.Time, time.Time, bool) {
+	to := time.Now()
+	if value := r.URL.Query().Get("to"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid to, expected RFC 3339")
+			return time.Time{}, time.Time{}, false
+		}
+		to = parsed
+	}
+
+	from := to.Add(-defaultReportRange)
+	if value := r.URL.Query().Get("from"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid from, expected RFC 3339")
+			return time.Time{}, time.Time{}, false
+		}
+		from = parsed
+	}
+
+	if !from.Before(to) || from.After(time.Now()) {
+		writeError(w, http.StatusBadRequest, "from must be before to and in the past")
+		return time.Time{}, time.Time{}, false
+	}
+	return from, to, true
+}
+
+// page parses the limit and offset query parameters
+func page(w http.ResponseWriter, r *http.Request) (int, int, bool) {
+	limit, offset := defaultPageLimit, 0
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxPageLimit {
+			writeError(w, http.StatusBadRequest, "invalid limit, expected 1 to "+strconv.Itoa(maxPageLimit))
+			return 0, 0, false
+		}
+		limit = parsed
+	}
+	if value := r.URL.Query().Get("offset"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			writeError(w, http.StatusBadRequest, "invalid offset")
+			return 0, 0, false
+		}
+		offset = parsed
+	}
+	return limit, offset, true
+}
+
+// optionalTime parses an optional RFC 3339 query parameter
+func optionalTime(w http.ResponseWriter, r *http.Request, name string) (*time.Time, bool) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return nil, true
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid "+name+", expected RFC 3339")
+		return nil, false
+	}
+	return &parsed, true
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
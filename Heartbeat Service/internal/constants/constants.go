@@ -1,4 +1,48 @@
-package constants
-
-const QUEUE_MODE = "queue"
-const MQTT_MODE = "mqtt"
+package constants
+
+const QUEUE_MODE = "queue"
+const MQTT_MODE = "mqtt"
+
+// Device states whose data is not accepted as regular data
+const DEVICE_STATE_SUSPENDED = "suspended"
+const DEVICE_STATE_DECOMMISSIONED = "decommissioned"
+
+// What happens to data from suspended and decommissioned devices
+const BLOCKED_ACTION_DROP = "drop" // discard the data
+const BLOCKED_ACTION_FLAG = "flag" // store the data with the device state in the flag column
+
+// What happens to data from devices that aren't registered
+const UNKNOWN_ACTION_REJECT = "reject"         // discard the data
+const UNKNOWN_ACTION_QUARANTINE = "quarantine" // store the data in the quarantine table with a reason
+const UNKNOWN_ACTION_FLAG = "flag"             // store the data flagged as unknown
+
+const FLAG_UNKNOWN_DEVICE = "unknown"
+const FLAG_CLOCK_SKEW = "clock_skew" // the device timestamp was further off than the allowed skew
+
+// Reasons data is quarantined
+const QUARANTINE_REASON_MISSING_ID = "missing device ID"
+const QUARANTINE_REASON_INVALID_ID = "invalid device ID"
+const QUARANTINE_REASON_UNKNOWN_DEVICE = "unknown device"
+
+// The heartbeats hypertable and its continuous aggregates
+const HEARTBEATS_TABLE = "heartbeats"
+const HEARTBEATS_5M = "heartbeats_5m"
+const HEARTBEATS_1H = "heartbeats_1h"
+const HEARTBEATS_1D = "heartbeats_1d"
+
+// Presence states derived from heartbeats
+const PRESENCE_ONLINE = "online"
+const PRESENCE_OFFLINE = "offline"
+
+const PRESENCE_EVENT_VERSION = 1
+
+// Name the heartbeat service's migrations are recorded under in schema_migrations
+const MIGRATIONS_SERVICE = "heartbeat"
+
+// Event published when a device's boot ID changes
+const DEVICE_EVENT_REBOOTED = "device.rebooted"
+
+const REBOOT_EVENT_VERSION = 1
+
+// Presence of a registered device that never sent a heartbeat
+const PRESENCE_NEVER_SEEN = "never_seen"
@@ -1,113 +1,600 @@
-package database
-
-import (
-	"github.com/sirupsen/logrus"
-	"gorm.io/driver/postgres"
-	"gorm.io/gorm"
-)
-
-// DB interface with new methods for GORM operations
-type DB interface {
-	Connect(connStr string) error
-	Close() error
-	GetConn() *gorm.DB
-	EnsureHeartbeatTable()
-	createHeartbeatTable()
-	isHypertable(tableName string) bool
-	convertToHypertable()
-}
-
-// Database holds the connection pool to the PostgreSQL database using GORM
-type Database struct {
-	Conn   *gorm.DB
-	Logger *logrus.Logger
-}
-
-// NewDatabase initializes a new Database instance
-func NewDatabase(logger *logrus.Logger) *Database {
-	return &Database{
-		Logger: logger,
-	}
-}
-
-// Connect establishes the database connection using GORM
-func (d *Database) Connect(connStr string) error {
-	var err error
-	d.Conn, err = gorm.Open(postgres.Open(connStr), &gorm.Config{})
-	if err != nil {
-		d.Logger.WithError(err).Fatal("Failed to open database connection")
-		return err
-	}
-
-	// Ensure the heartbeats table exists and is a hypertable
-	d.EnsureHeartbeatTable()
-
-	d.Logger.Info("Connected to TimescaleDB")
-	return nil
-}
-
-// EnsureHeartbeatTable ensures that the heartbeats table and hypertable exist
-func (d *Database) EnsureHeartbeatTable() {
-	// Check if the heartbeats table exists
-	if !d.tableExists("heartbeats") {
-		d.createHeartbeatTable()
-	} else {
-		d.Logger.Info("Table 'heartbeats' already exists")
-	}
-
-	// Check if it's already a hypertable
-	if !d.isHypertable("heartbeats") {
-		d.convertToHypertable()
-	} else {
-		d.Logger.Info("Table 'heartbeats' is already a hypertable")
-	}
-}
-
-// Check if the table exists
-func (d *Database) tableExists(tableName string) bool {
-	var exists bool
-	d.Conn.Raw("SELECT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = ?)", tableName).Scan(&exists)
-	return exists
-}
-
-// Create the heartbeats table
-func (d *Database) createHeartbeatTable() {
-	createTableSQL := `
-        CREATE TABLE heartbeats (
-            device_id TEXT NOT NULL,
-            timestamp TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
-            status TEXT
-        );`
-	if err := d.Conn.Exec(createTableSQL).Error; err != nil {
-		d.Logger.Fatalf("Error creating heartbeats table: %v", err)
-	}
-	d.Logger.Info("Created 'heartbeats' table")
-}
-
-// Check if the table is a hypertable
-func (d *Database) isHypertable(tableName string) bool {
-	var exists bool
-	d.Conn.Raw("SELECT EXISTS (SELECT 1 FROM timescaledb_information.hypertables WHERE hypertable_name = ?)", tableName).Scan(&exists)
-	return exists
-}
-
-// Convert the table to a hypertable
-func (d *Database) convertToHypertable() {
-	convertSQL := "SELECT create_hypertable('heartbeats', 'timestamp');"
-	if err := d.Conn.Exec(convertSQL).Error; err != nil {
-		d.Logger.Fatalf("Error converting table to hypertable: %v", err)
-	}
-	d.Logger.Info("Converted 'heartbeats' table to hypertable")
-}
-
-// Close closes the database connection
-func (d *Database) Close() error {
-	// GORM handles connection pooling, so Close is not implemented like in sql.DB
-	d.Logger.Info("Database connection closed (handled by GORM)")
-	return nil
-}
-
-// GetConn returns the underlying GORM database connection
-func (d *Database) GetConn() *gorm.DB {
-	return d.Conn
-}
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/benmeehan/iot-heartbeat-service/internal/constants"
+	"github.com/benmeehan/iot-heartbeat-service/internal/models"
+	"github.com/benmeehan/iot-heartbeat-service/pkg/migrate"
+	"github.com/sirupsen/logrus"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// DB interface with new methods for GORM operations
+type DB interface {
+	Open(connStr string) error
+	Connect(connStr string) error
+	Migrate() error
+	NewMigrator() (*migrate.Migrator, error)
+	Close() error
+	GetConn() *gorm.DB
+	InsertHeartbeats(heartbeats []models.Heartbeat) error
+	ApplyStoragePolicy(table string, policy models.StoragePolicy) error
+	CountActiveBuckets(view string, from, to time.Time, deviceID string) (map[string]int64, error)
+	ListActiveBuckets(deviceID string, from, to time.Time) ([]time.Time, error)
+	RefreshAggregate(view string, since *time.Time) error
+	ListDeviceCreationTimes(deviceID string) (map[string]time.Time, error)
+	ListDevicePresence(filter models.PresenceFilter, missedIntervals int, defaultInterval time.Duration) (map[string]int64, []models.DevicePresence, error)
+	UpdateDeviceClocks(clocks []models.DeviceClock) error
+	GetDeviceBoots(deviceIDs []string) (map[string]models.DeviceBoot, error)
+	UpdateDeviceBoots(boots []models.DeviceBoot) error
+	ListDevices() (map[string]string, error)
+	GetDeviceState(deviceID string) (string, bool, error)
+	InsertQuarantinedHeartbeats(heartbeats []models.QuarantinedHeartbeat) error
+	MarkDevicesSeen(seen []models.DeviceSeen) ([]models.DeviceStatus, error)
+	MarkOfflineDevices(missedIntervals int) ([]models.DeviceStatus, error)
+	MarkDeviceOffline(deviceID string) (*models.DeviceStatus, bool, error)
+	ListDeviceGroups(label string) (map[string]string, error)
+}
+
+// Database holds the connection pool to the PostgreSQL database using GORM
+type Database struct {
+	Conn   *gorm.DB
+	Logger *logrus.Logger
+}
+
+// NewDatabase initializes a new Database instance
+func NewDatabase(logger *logrus.Logger) *Database {
+	return &Database{
+		Logger: logger,
+	}
+}
+
+// Open establishes the database connection using GORM without touching the schema
+func (d *Database) Open(connStr string) error {
+	var err error
+	d.Conn, err = gorm.Open(postgres.Open(connStr), &gorm.Config{})
+	if err != nil {
+		d.Logger.WithError(err).Fatal("Failed to open database connection")
+		return err
+	}
+	return nil
+}
+
+// Connect establishes the database connection and applies the pending schema migrations
+func (d *Database) Connect(connStr string) error {
+	if err := d.Open(connStr); err != nil {
+		return err
+	}
+	if err := d.Migrate(); err != nil {
+		d.Logger.WithError(err).Fatal("Failed to migrate database schema")
+		return err
+	}
+
+	d.Logger.Info("Connected to TimescaleDB")
+	return nil
+}
+
+// ApplyStoragePolicy sets the hypertable's chunk interval and reconciles its compression and
+// retention policies with the given policy. It is safe to run on every start: policies that
+// already match are left alone and changed ones are replaced. Compression segments by device
+// and orders by time; once enabled it stays enabled, only its policy is removed.
+func (d *Database) ApplyStoragePolicy(table string, policy models.StoragePolicy) error {
+	if policy.ChunkTimeInterval > 0 {
+		err := d.Conn.Exec("SELECT set_chunk_time_interval(CAST(? AS regclass), make_interval(secs => ?))",
+			table, policy.ChunkTimeInterval.Seconds()).Error
+		if err != nil {
+			return fmt.Errorf("failed to set chunk interval of %s: %w", table, err)
+		}
+	}
+
+	if policy.CompressAfter > 0 {
+		var enabled bool
+		err := d.Conn.Raw("SELECT compression_enabled FROM timescaledb_information.hypertables WHERE hypertable_name = ?", table).
+			Scan(&enabled).Error
+		if err != nil {
+			return fmt.Errorf("failed to check compression of %s: %w", table, err)
+		}
+		if !enabled {
+			err := d.Conn.Exec("ALTER TABLE " + table + " SET (timescaledb.compress, " +
+				"timescaledb.compress_segmentby = 'device_id', timescaledb.compress_orderby = 'timestamp DESC')").Error
+			if err != nil {
+				return fmt.Errorf("failed to enable compression of %s: %w", table, err)
+			}
+			d.Logger.Infof("Enabled compression of '%s'", table)
+		}
+	}
+
+	if err := d.reconcilePolicy(table, "policy_compression", "compress_after", "compression", policy.CompressAfter); err != nil {
+		return err
+	}
+	return d.reconcilePolicy(table, "policy_retention", "drop_after", "retention", policy.DropAfter)
+}
+
+// reconcilePolicy makes the table's compression or retention job match the wanted age,
+// removing the job when the age is zero
+func (d *Database) reconcilePolicy(table, procName, configKey, policyName string, after time.Duration) error {
+	var current []string
+	err := d.Conn.Raw("SELECT config ->> ? FROM timescaledb_information.jobs WHERE proc_name = ? AND hypertable_name = ?",
+		configKey, procName, table).Scan(&current).Error
+	if err != nil {
+		return fmt.Errorf("failed to read %s policy of %s: %w", policyName, table, err)
+	}
+
+	if len(current) == 1 && after > 0 {
+		var same bool
+		err := d.Conn.Raw("SELECT CAST(? AS interval) = make_interval(secs => ?)", current[0], after.Seconds()).Scan(&same).Error
+		if err != nil {
+			return fmt.Errorf("failed to compare %s policy of %s: %w", policyName, table, err)
+		}
+		if same {
+			return nil
+		}
+	}
+
+	if len(current) > 0 {
+		if err := d.Conn.Exec("SELECT remove_"+policyName+"_policy(CAST(? AS regclass), if_exists => true)", table).Error; err != nil {
+			return fmt.Errorf("failed to remove %s policy of %s: %w", policyName, table, err)
+		}
+		d.Logger.Infof("Removed %s policy of '%s'", policyName, table)
+	}
+	if after <= 0 {
+		return nil
+	}
+
+	if err := d.Conn.Exec("SELECT add_"+policyName+"_policy(CAST(? AS regclass), make_interval(secs => ?))", table, after.Seconds()).Error; err != nil {
+		return fmt.Errorf("failed to add %s policy of %s: %w", policyName, table, err)
+	}
+	d.Logger.Infof("Set %s policy of '%s' to %s", policyName, table, after)
+	return nil
+}
+
+// CountActiveBuckets returns the number of 5 minute buckets with a heartbeat in [from, to) for
+// each device, or only for deviceID if it isn't empty. view is one of the heartbeat aggregates
+// and from and to must be aligned to its buckets.
+func (d *Database) CountActiveBuckets(view string, from, to time.Time, deviceID string) (map[string]int64, error) {
+	// Every row of heartbeats_5m is one active bucket
+	var active string
+	switch view {
+	case constants.HEARTBEATS_5M:
+		active = "count(*)"
+	case constants.HEARTBEATS_1H, constants.HEARTBEATS_1D:
+		active = "sum(active_5m)"
+	default:
+		return nil, fmt.Errorf("unknown heartbeat aggregate %q", view)
+	}
+
+	query := d.Conn.Table(view).
+		Select("device_id, "+active+" AS active").
+		Where("bucket >= ? AND bucket < ?", from, to).
+		Group("device_id")
+	if deviceID != "" {
+		query = query.Where("device_id = ?", deviceID)
+	}
+
+	var rows []struct {
+		DeviceID string
+		Active   int64
+	}
+	if err := query.Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int64, len(rows))
+	for _, row := range rows {
+		counts[row.DeviceID] = row.Active
+	}
+	return counts, nil
+}
+
+// ListActiveBuckets returns the start of every 5 minute bucket in [from, to) in which the
+// device sent a heartbeat, in order
+func (d *Database) ListActiveBuckets(deviceID string, from, to time.Time) ([]time.Time, error) {
+	var buckets []time.Time
+	err := d.Conn.Table(constants.HEARTBEATS_5M).
+		Where("device_id = ? AND bucket >= ? AND bucket < ?", deviceID, from, to).
+		Order("bucket").
+		Pluck("bucket", &buckets).Error
+	return buckets, err
+}
+
+// RefreshAggregate materializes the continuous aggregate from since, or from its start when
+// since is nil, up to now. Buckets that are already materialized and haven't changed are
+// skipped, so only the first refresh of a range does real work. Raw data dropped by retention
+// would drop its buckets from the aggregate as well, so since must not reach back past it.
+func (d *Database) RefreshAggregate(view string, since *time.Time) error {
+	return d.Conn.Exec("CALL refresh_continuous_aggregate(CAST(? AS regclass), CAST(? AS timestamptz), now())", view, since).Error
+}
+
+// ListDeviceCreationTimes returns when each registered device was created, or only deviceID if
+// it isn't empty. Decommissioned devices are left out.
+func (d *Database) ListDeviceCreationTimes(deviceID string) (map[string]time.Time, error) {
+	created := make(map[string]time.Time)
+
+	// The registration service creates the table, it may not have run yet
+	if !d.tableExists("devices") {
+		return created, nil
+	}
+
+	query := d.Conn.Table("devices").Select("id, created_at").Where("deleted_at IS NULL")
+	if deviceID != "" {
+		query = query.Where("id = ?", deviceID)
+	}
+	var rows []struct {
+		ID        string
+		CreatedAt time.Time
+	}
+	if err := query.Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		created[row.ID] = row.CreatedAt
+	}
+	return created, nil
+}
+
+// ListDevicePresence counts the registered devices matching the filter by presence state and
+// returns the page of them the filter selects, sorted by last seen. The state and last seen
+// time are the ones presence tracking keeps in device_status, so they agree with the presence
+// events, including devices their last will marked offline.
+//
+// Devices without a device_status row, which sent no heartbeat since presence tracking
+// started, fall back to their last heartbeat: they are online while it was received within
+// missedIntervals of defaultInterval, and never_seen without one. The last heartbeat is looked
+// up per device through idx_heartbeats_device_id_timestamp, only for those devices. This is
+// what DISTINCT ON (device_id) computes, but it reads one row per device instead of scanning
+// every heartbeat, so it stays fast with a large fleet and a long retention.
+func (d *Database) ListDevicePresence(filter models.PresenceFilter, missedIntervals int, defaultInterval time.Duration) (map[string]int64, []models.DevicePresence, error) {
+	counts := make(map[string]int64)
+
+	// The registration service creates the table, it may not have run yet
+	if !d.tableExists("devices") {
+		return counts, nil, nil
+	}
+
+	devicesWhere := "d.deleted_at IS NULL"
+	if filter.Tag != "" {
+		devicesWhere += " AND d.tags @> jsonb_build_array(CAST(@tag AS text))"
+	}
+	presenceSQL := `
+        WITH presence AS (
+            SELECT CAST(d.id AS text) AS device_id, COALESCE(s.last_seen, last.received_at) AS last_seen,
+                CASE
+                    WHEN s.state IS NOT NULL THEN s.state
+                    WHEN last.received_at IS NULL THEN @never_seen
+                    WHEN last.received_at >= now() - make_interval(secs => CAST(@missed * @default_ms AS double precision) / 1000) THEN @online
+                    ELSE @offline
+                END AS state
+            FROM devices d
+            LEFT JOIN device_status s ON s.device_id = CAST(d.id AS text)
+            LEFT JOIN LATERAL (
+                SELECT COALESCE(h.received_at, h.timestamp) AS received_at FROM heartbeats h
+                WHERE s.device_id IS NULL AND h.device_id = CAST(d.id AS text)
+                ORDER BY h.timestamp DESC
+                LIMIT 1
+            ) last ON true
+            WHERE ` + devicesWhere + `
+        )`
+
+	where := "true"
+	if filter.SeenAfter != nil {
+		where += " AND last_seen >= @seen_after"
+	}
+	if filter.SeenBefore != nil {
+		where += " AND last_seen < @seen_before"
+	}
+
+	args := map[string]interface{}{
+		"tag":         filter.Tag,
+		"seen_after":  filter.SeenAfter,
+		"seen_before": filter.SeenBefore,
+		"state":       filter.State,
+		"missed":      missedIntervals,
+		"default_ms":  defaultInterval.Milliseconds(),
+		"online":      constants.PRESENCE_ONLINE,
+		"offline":     constants.PRESENCE_OFFLINE,
+		"never_seen":  constants.PRESENCE_NEVER_SEEN,
+		"limit":       filter.Limit,
+		"offset":      filter.Offset,
+	}
+
+	var rows []struct {
+		State string
+		Count int64
+	}
+	err := d.Conn.Raw(presenceSQL+" SELECT state, count(*) AS count FROM presence WHERE "+where+" GROUP BY state", args).
+		Scan(&rows).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, row := range rows {
+		counts[row.State] = row.Count
+	}
+
+	if filter.State != "" {
+		where += " AND state = @state"
+	}
+	order := "last_seen DESC NULLS LAST, device_id"
+	if filter.Ascending {
+		order = "last_seen ASC NULLS FIRST, device_id"
+	}
+	var devices []models.DevicePresence
+	err = d.Conn.Raw(presenceSQL+" SELECT device_id, state, last_seen FROM presence WHERE "+where+
+		" ORDER BY "+order+" LIMIT @limit OFFSET @offset", args).
+		Scan(&devices).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	return counts, devices, nil
+}
+
+// InsertHeartbeats inserts the heartbeats with a single multi-row INSERT
+func (d *Database) InsertHeartbeats(heartbeats []models.Heartbeat) error {
+	if len(heartbeats) == 0 {
+		return nil
+	}
+	return d.Conn.Create(&heartbeats).Error
+}
+
+// UpdateDeviceClocks records the latest clock offset of each device. A measurement older than
+// the stored one is ignored. Each device may only appear once.
+func (d *Database) UpdateDeviceClocks(clocks []models.DeviceClock) error {
+	if len(clocks) == 0 {
+		return nil
+	}
+
+	ids := make([]string, len(clocks))
+	offsets := make([]int64, len(clocks))
+	skewed := make([]bool, len(clocks))
+	measuredAt := make([]time.Time, len(clocks))
+	for i, c := range clocks {
+		ids[i], offsets[i], skewed[i], measuredAt[i] = c.DeviceID, c.OffsetMS, c.Skewed, c.MeasuredAt
+	}
+
+	return d.Conn.Exec(`
+        INSERT INTO device_clock (device_id, offset_ms, skewed, measured_at)
+        SELECT * FROM unnest(CAST(@ids AS text[]), CAST(@offsets AS bigint[]), CAST(@skewed AS boolean[]), CAST(@measured_at AS timestamptz[]))
+        ON CONFLICT (device_id) DO UPDATE SET
+            offset_ms = EXCLUDED.offset_ms,
+            skewed = EXCLUDED.skewed,
+            measured_at = EXCLUDED.measured_at
+        WHERE EXCLUDED.measured_at > device_clock.measured_at`,
+		sql.Named("ids", ids),
+		sql.Named("offsets", offsets),
+		sql.Named("skewed", skewed),
+		sql.Named("measured_at", measuredAt),
+	).Error
+}
+
+// GetDeviceBoots returns the last known boot of each of the devices, keyed by device ID
+func (d *Database) GetDeviceBoots(deviceIDs []string) (map[string]models.DeviceBoot, error) {
+	boots := make(map[string]models.DeviceBoot)
+	if len(deviceIDs) == 0 {
+		return boots, nil
+	}
+
+	var rows []models.DeviceBoot
+	if err := d.Conn.Where("device_id IN ?", deviceIDs).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		boots[row.DeviceID] = row
+	}
+	return boots, nil
+}
+
+// UpdateDeviceBoots records the current boot of each device. A record older than the stored
+// one is ignored. Each device may only appear once.
+func (d *Database) UpdateDeviceBoots(boots []models.DeviceBoot) error {
+	if len(boots) == 0 {
+		return nil
+	}
+
+	ids := make([]string, len(boots))
+	bootIDs := make([]string, len(boots))
+	sequences := make([]*int64, len(boots))
+	bootedAt := make([]time.Time, len(boots))
+	seenAt := make([]time.Time, len(boots))
+	for i, b := range boots {
+		ids[i], bootIDs[i], sequences[i], bootedAt[i], seenAt[i] = b.DeviceID, b.BootID, b.Sequence, b.BootedAt, b.SeenAt
+	}
+
+	return d.Conn.Exec(`
+        INSERT INTO device_boot (device_id, boot_id, sequence, booted_at, seen_at)
+        SELECT * FROM unnest(CAST(@ids AS text[]), CAST(@boot_ids AS text[]), CAST(@sequences AS bigint[]),
+            CAST(@booted_at AS timestamptz[]), CAST(@seen_at AS timestamptz[]))
+        ON CONFLICT (device_id) DO UPDATE SET
+            boot_id = EXCLUDED.boot_id,
+            sequence = EXCLUDED.sequence,
+            booted_at = EXCLUDED.booted_at,
+            seen_at = EXCLUDED.seen_at
+        WHERE EXCLUDED.seen_at >= device_boot.seen_at`,
+		sql.Named("ids", ids),
+		sql.Named("boot_ids", bootIDs),
+		sql.Named("sequences", sequences),
+		sql.Named("booted_at", bootedAt),
+		sql.Named("seen_at", seenAt),
+	).Error
+}
+
+// Check if the table exists
+func (d *Database) tableExists(tableName string) bool {
+	var exists bool
+	d.Conn.Raw("SELECT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = ?)", tableName).Scan(&exists)
+	return exists
+}
+
+// ListDevices returns the state of every device in the registration service's devices table,
+// keyed by device ID
+func (d *Database) ListDevices() (map[string]string, error) {
+	devices := make(map[string]string)
+
+	// The registration service creates the table, it may not have run yet
+	if !d.tableExists("devices") {
+		return devices, nil
+	}
+
+	var rows []struct {
+		ID    string
+		State string
+	}
+	// Decommissioned devices are soft deleted, so deleted_at is deliberately not filtered
+	if err := d.Conn.Raw("SELECT id, state FROM devices").Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		devices[row.ID] = row.State
+	}
+	return devices, nil
+}
+
+// GetDeviceState returns the state of a single device and whether it exists
+func (d *Database) GetDeviceState(deviceID string) (string, bool, error) {
+	if !d.tableExists("devices") {
+		return "", false, nil
+	}
+
+	var states []string
+	if err := d.Conn.Raw("SELECT state FROM devices WHERE id = ?", deviceID).Scan(&states).Error; err != nil {
+		return "", false, err
+	}
+	if len(states) == 0 {
+		return "", false, nil
+	}
+	return states[0], true, nil
+}
+
+// InsertQuarantinedHeartbeats stores heartbeats that were not accepted, with the reason, in
+// one multi-row INSERT
+func (d *Database) InsertQuarantinedHeartbeats(heartbeats []models.QuarantinedHeartbeat) error {
+	if len(heartbeats) == 0 {
+		return nil
+	}
+	return d.Conn.Create(&heartbeats).Error
+}
+
+// MarkDevicesSeen records when devices were last heard from and marks them online. A device
+// marked offline after the given time stays offline, so a heartbeat that was queued while the
+// device's last will arrived doesn't bring it back. The returned statuses are the devices whose
+// state changed. Replicas receiving heartbeats from the same device concurrently agree on which
+// one brought it online.
+func (d *Database) MarkDevicesSeen(seen []models.DeviceSeen) ([]models.DeviceStatus, error) {
+	if len(seen) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]string, len(seen))
+	seenAt := make([]time.Time, len(seen))
+	intervals := make([]int64, len(seen))
+	seenAtByID := make(map[string]time.Time, len(seen))
+	for i, s := range seen {
+		ids[i] = s.DeviceID
+		// Postgres keeps microseconds, the comparison below needs the stored value
+		seenAt[i] = s.SeenAt.Truncate(time.Microsecond)
+		intervals[i] = s.Interval.Milliseconds()
+		seenAtByID[s.DeviceID] = seenAt[i]
+	}
+
+	// state_since only moves when the state changes, and then it is the device's seen time
+	var statuses []models.DeviceStatus
+	err := d.Conn.Raw(`
+        INSERT INTO device_status (device_id, state, last_seen, state_since, interval_ms)
+        SELECT s.device_id, @online, s.seen_at, s.seen_at, s.interval_ms
+        FROM unnest(CAST(@ids AS text[]), CAST(@seen_at AS timestamptz[]), CAST(@intervals AS bigint[])) AS s(device_id, seen_at, interval_ms)
+        ON CONFLICT (device_id) DO UPDATE SET
+            last_seen = GREATEST(device_status.last_seen, EXCLUDED.last_seen),
+            interval_ms = EXCLUDED.interval_ms,
+            state_since = CASE WHEN device_status.state = @online OR EXCLUDED.last_seen <= device_status.state_since
+                THEN device_status.state_since ELSE EXCLUDED.last_seen END,
+            state = CASE WHEN EXCLUDED.last_seen > device_status.state_since THEN @online ELSE device_status.state END
+        RETURNING device_id, state, last_seen, state_since, interval_ms`,
+		sql.Named("online", constants.PRESENCE_ONLINE),
+		sql.Named("ids", ids),
+		sql.Named("seen_at", seenAt),
+		sql.Named("intervals", intervals),
+	).Scan(&statuses).Error
+	if err != nil {
+		return nil, err
+	}
+
+	changed := statuses[:0]
+	for _, status := range statuses {
+		if status.State == constants.PRESENCE_ONLINE && status.StateSince.Equal(seenAtByID[status.DeviceID]) {
+			changed = append(changed, status)
+		}
+	}
+	return changed, nil
+}
+
+// MarkOfflineDevices marks online devices offline once they missed the given number of their
+// heartbeat intervals, and returns them. Each device is only returned by one replica.
+func (d *Database) MarkOfflineDevices(missedIntervals int) ([]models.DeviceStatus, error) {
+	var statuses []models.DeviceStatus
+	err := d.Conn.Raw(`
+        UPDATE device_status SET state = @offline, state_since = now()
+        WHERE state = @online
+          AND last_seen + interval_ms * @missed * INTERVAL '1 millisecond' < now()
+        RETURNING device_id, state, last_seen, state_since, interval_ms`,
+		sql.Named("offline", constants.PRESENCE_OFFLINE),
+		sql.Named("online", constants.PRESENCE_ONLINE),
+		sql.Named("missed", missedIntervals),
+	).Scan(&statuses).Error
+	return statuses, err
+}
+
+// MarkDeviceOffline marks an online device offline right away, e.g. when the broker published
+// its last will. It reports whether the device was online.
+func (d *Database) MarkDeviceOffline(deviceID string) (*models.DeviceStatus, bool, error) {
+	var statuses []models.DeviceStatus
+	err := d.Conn.Raw(`
+        UPDATE device_status SET state = @offline, state_since = now()
+        WHERE device_id = @device_id AND state = @online
+        RETURNING device_id, state, last_seen, state_since, interval_ms`,
+		sql.Named("offline", constants.PRESENCE_OFFLINE),
+		sql.Named("online", constants.PRESENCE_ONLINE),
+		sql.Named("device_id", deviceID),
+	).Scan(&statuses).Error
+	if err != nil || len(statuses) == 0 {
+		return nil, false, err
+	}
+	return &statuses[0], true, nil
+}
+
+// ListDeviceGroups returns the value of the given label for every device that has it, keyed
+// by device ID
+func (d *Database) ListDeviceGroups(label string) (map[string]string, error) {
+	groups := make(map[string]string)
+
+	// The registration service creates the table, it may not have run yet
+	if !d.tableExists("devices") {
+		return groups, nil
+	}
+
+	var rows []struct {
+		ID    string
+		Group string
+	}
+	err := d.Conn.Raw(`SELECT id, labels ->> @label AS "group" FROM devices WHERE deleted_at IS NULL AND labels ->> @label IS NOT NULL`,
+		sql.Named("label", label)).Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		groups[row.ID] = row.Group
+	}
+	return groups, nil
+}
+
+// Close closes the database connection
+func (d *Database) Close() error {
+	// GORM handles connection pooling, so Close is not implemented like in sql.DB
+	d.Logger.Info("Database connection closed (handled by GORM)")
+	return nil
+}
+
+// GetConn returns the underlying GORM database connection
+func (d *Database) GetConn() *gorm.DB {
+	return d.Conn
+}
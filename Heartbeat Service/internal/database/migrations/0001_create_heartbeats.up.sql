@@ -0,0 +1,13 @@
+-- Databases set up before migrations already have the table, possibly without the later columns
+CREATE TABLE IF NOT EXISTS heartbeats (
+    device_id TEXT NOT NULL,
+    timestamp TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    status TEXT
+);
+
+ALTER TABLE heartbeats
+    ADD COLUMN IF NOT EXISTS flag TEXT,
+    ADD COLUMN IF NOT EXISTS received_at TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS clock_skew_ms BIGINT;
+
+SELECT create_hypertable('heartbeats', 'timestamp', if_not_exists => TRUE);
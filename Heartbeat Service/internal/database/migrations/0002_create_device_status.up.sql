@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS device_status (
+    device_id TEXT PRIMARY KEY,
+    state TEXT NOT NULL,
+    last_seen TIMESTAMPTZ NOT NULL,
+    state_since TIMESTAMPTZ NOT NULL,
+    interval_ms BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_device_status_state ON device_status (state);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS quarantined_heartbeats (
+    id BIGSERIAL PRIMARY KEY,
+    device_id TEXT,
+    received_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    reason TEXT NOT NULL,
+    payload TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_quarantined_heartbeats_received_at ON quarantined_heartbeats (received_at);
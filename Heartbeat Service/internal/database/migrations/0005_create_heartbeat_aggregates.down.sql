@@ -0,0 +1,3 @@
+DROP MATERIALIZED VIEW IF EXISTS heartbeats_1d;
+DROP MATERIALIZED VIEW IF EXISTS heartbeats_1h;
+DROP MATERIALIZED VIEW IF EXISTS heartbeats_5m;
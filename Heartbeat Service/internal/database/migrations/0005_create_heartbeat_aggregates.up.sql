@@ -0,0 +1,36 @@
+-- Availability reports are computed from these. heartbeats_5m counts the heartbeats of each
+-- device per 5 minutes; heartbeats_1h and heartbeats_1d roll it up and count the 5 minute
+-- buckets that had a heartbeat in active_5m. The aggregates include the not yet materialized
+-- data, so reports cover the most recent minutes.
+CREATE MATERIALIZED VIEW IF NOT EXISTS heartbeats_5m
+    WITH (timescaledb.continuous, timescaledb.materialized_only = false) AS
+    SELECT device_id, time_bucket(INTERVAL '5 minutes', timestamp) AS bucket, count(*) AS heartbeats
+    FROM heartbeats
+    GROUP BY device_id, time_bucket(INTERVAL '5 minutes', timestamp)
+    WITH NO DATA;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS heartbeats_1h
+    WITH (timescaledb.continuous, timescaledb.materialized_only = false) AS
+    SELECT device_id, time_bucket(INTERVAL '1 hour', bucket) AS bucket, sum(heartbeats) AS heartbeats, count(*) AS active_5m
+    FROM heartbeats_5m
+    GROUP BY device_id, time_bucket(INTERVAL '1 hour', bucket)
+    WITH NO DATA;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS heartbeats_1d
+    WITH (timescaledb.continuous, timescaledb.materialized_only = false) AS
+    SELECT device_id, time_bucket(INTERVAL '1 day', bucket) AS bucket, sum(heartbeats) AS heartbeats, sum(active_5m) AS active_5m
+    FROM heartbeats_1h
+    GROUP BY device_id, time_bucket(INTERVAL '1 day', bucket)
+    WITH NO DATA;
+
+SELECT add_continuous_aggregate_policy('heartbeats_5m',
+    start_offset => INTERVAL '1 hour', end_offset => INTERVAL '5 minutes',
+    schedule_interval => INTERVAL '5 minutes', if_not_exists => true);
+
+SELECT add_continuous_aggregate_policy('heartbeats_1h',
+    start_offset => INTERVAL '1 day', end_offset => INTERVAL '1 hour',
+    schedule_interval => INTERVAL '30 minutes', if_not_exists => true);
+
+SELECT add_continuous_aggregate_policy('heartbeats_1d',
+    start_offset => INTERVAL '3 days', end_offset => INTERVAL '1 day',
+    schedule_interval => INTERVAL '1 hour', if_not_exists => true);
@@ -0,0 +1,9 @@
+DROP TABLE IF EXISTS device_boot;
+
+ALTER TABLE heartbeats
+    DROP COLUMN IF EXISTS uptime_seconds,
+    DROP COLUMN IF EXISTS agent_version,
+    DROP COLUMN IF EXISTS boot_id,
+    DROP COLUMN IF EXISTS sequence,
+    DROP COLUMN IF EXISTS sequence_gap,
+    DROP COLUMN IF EXISTS health;
@@ -0,0 +1,15 @@
+ALTER TABLE heartbeats
+    ADD COLUMN IF NOT EXISTS uptime_seconds BIGINT,
+    ADD COLUMN IF NOT EXISTS agent_version TEXT,
+    ADD COLUMN IF NOT EXISTS boot_id TEXT,
+    ADD COLUMN IF NOT EXISTS sequence BIGINT,
+    ADD COLUMN IF NOT EXISTS sequence_gap BIGINT,
+    ADD COLUMN IF NOT EXISTS health JSONB;
+
+CREATE TABLE IF NOT EXISTS device_boot (
+    device_id TEXT PRIMARY KEY,
+    boot_id TEXT NOT NULL,
+    sequence BIGINT,
+    booted_at TIMESTAMPTZ NOT NULL,
+    seen_at TIMESTAMPTZ NOT NULL
+);
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS idx_heartbeats_device_id_timestamp;
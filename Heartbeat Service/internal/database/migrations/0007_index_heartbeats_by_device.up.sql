@@ -0,0 +1,2 @@
+-- Finds the last heartbeat of a device without scanning its older heartbeats
+CREATE INDEX IF NOT EXISTS idx_heartbeats_device_id_timestamp ON heartbeats (device_id, timestamp DESC);
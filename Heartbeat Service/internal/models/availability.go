@@ -0,0 +1,33 @@
+package models
+
+import "time"
+
+// Outage is a period in which a device sent no heartbeats
+type Outage struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// DeviceAvailability is the availability of one device over a time range. Availability is
+// measured in 5 minute buckets: a bucket counts as up if the device sent a heartbeat in it.
+type DeviceAvailability struct {
+	DeviceID        string    `json:"device_id"`
+	From            time.Time `json:"from"`
+	To              time.Time `json:"to"`
+	UptimePercent   float64   `json:"uptime_percent"`
+	ActiveBuckets   int64     `json:"active_buckets"`
+	ExpectedBuckets int64     `json:"expected_buckets"` // buckets in the range since the device was registered
+	Outages         []Outage  `json:"outages,omitempty"`
+}
+
+// FleetAvailability is the availability of all devices over a time range, with one page of the
+// devices
+type FleetAvailability struct {
+	From          time.Time            `json:"from"`
+	To            time.Time            `json:"to"`
+	UptimePercent float64              `json:"uptime_percent"` // active buckets of all devices over expected buckets of all devices
+	Total         int                  `json:"total"`          // devices in the report
+	Limit         int                  `json:"limit"`
+	Offset        int                  `json:"offset"`
+	Devices       []DeviceAvailability `json:"devices"` // without outages, ordered by device ID
+}
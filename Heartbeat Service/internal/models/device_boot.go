@@ -0,0 +1,28 @@
+package models
+
+import "time"
+
+// DeviceBoot is the boot a device last sent a heartbeat from and how far its sequence got
+type DeviceBoot struct {
+	DeviceID string    `gorm:"column:device_id;primaryKey"`
+	BootID   string    `gorm:"column:boot_id"`
+	Sequence *int64    `gorm:"column:sequence"`  // highest sequence seen in this boot
+	BootedAt time.Time `gorm:"column:booted_at"` // heartbeat time minus uptime, or the first heartbeat's time
+	SeenAt   time.Time `gorm:"column:seen_at"`   // time of the latest heartbeat
+}
+
+// TableName keeps the table name singular
+func (DeviceBoot) TableName() string {
+	return "device_boot"
+}
+
+// RebootEvent is published when a device's heartbeat comes from a new boot
+type RebootEvent struct {
+	Version        int       `json:"version"`
+	DeviceID       string    `json:"device_id"`
+	Event          string    `json:"event"` // always device.rebooted
+	BootID         string    `json:"boot_id"`
+	PreviousBootID string    `json:"previous_boot_id"`
+	BootedAt       time.Time `json:"booted_at"`
+	Timestamp      time.Time `json:"timestamp"` // time of the first heartbeat from the new boot
+}
@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// DeviceClock is the last measured offset of a device's clock from server time
+type DeviceClock struct {
+	DeviceID   string    `gorm:"column:device_id;primaryKey"`
+	OffsetMS   int64     `gorm:"column:offset_ms"` // device time minus server time
+	Skewed     bool      `gorm:"column:skewed"`    // the offset exceeded the allowed skew
+	MeasuredAt time.Time `gorm:"column:measured_at"`
+}
+
+// TableName keeps the table name singular
+func (DeviceClock) TableName() string {
+	return "device_clock"
+}
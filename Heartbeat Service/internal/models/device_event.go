@@ -0,0 +1,8 @@
+package models
+
+// DeviceEvent is a lifecycle change published by the registration service
+type DeviceEvent struct {
+	DeviceID string `json:"device_id"`
+	Event    string `json:"event"`
+	State    string `json:"state"` // state the device is in after the event
+}
@@ -0,0 +1,41 @@
+package models
+
+import "time"
+
+// DeviceStatus is the presence of a device, derived from its heartbeats
+type DeviceStatus struct {
+	DeviceID   string    `json:"device_id" gorm:"column:device_id;primaryKey"`
+	State      string    `json:"state" gorm:"column:state"` // online or offline
+	LastSeen   time.Time `json:"last_seen" gorm:"column:last_seen"`
+	StateSince time.Time `json:"state_since" gorm:"column:state_since"`
+	// IntervalMS is the heartbeat interval expected from the device when it was last seen
+	IntervalMS int64 `json:"interval_ms" gorm:"column:interval_ms"`
+}
+
+// TableName keeps the table name singular
+func (DeviceStatus) TableName() string {
+	return "device_status"
+}
+
+// DeviceSeen is a heartbeat's contribution to the device's presence
+type DeviceSeen struct {
+	DeviceID string
+	SeenAt   time.Time     // when the heartbeat was received
+	Interval time.Duration // heartbeat interval expected from the device
+}
+
+// StatusMessage is an online/offline message on a device's status topic. Devices publish the
+// bare status, or a JSON object that also carries their access token.
+type StatusMessage struct {
+	Status string `json:"status"`
+	Token  string `json:"token,omitempty"` // access token issued at registration, see pkg/token
+}
+
+// PresenceEvent is published when a device goes online or offline
+type PresenceEvent struct {
+	Version   int       `json:"version"`
+	DeviceID  string    `json:"device_id"`
+	State     string    `json:"state"`
+	LastSeen  time.Time `json:"last_seen"`
+	Timestamp time.Time `json:"timestamp"` // when the device changed state
+}
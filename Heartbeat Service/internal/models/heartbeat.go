@@ -1,9 +1,65 @@
-package models
-
-import "time"
-
-type Heartbeat struct {
-	DeviceID  string    `json:"device_id" gorm:"column:device_id"`
-	Timestamp time.Time `json:"timestamp" gorm:"column:timestamp"`
-	Status    string    `json:"status" gorm:"column:status"`
-}
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Heartbeat is a device's liveness message. Only device_id is required; agents that predate
+// the uptime, boot ID, sequence and health fields leave them out.
+type Heartbeat struct {
+	DeviceID  string    `json:"device_id" gorm:"column:device_id"`
+	Timestamp time.Time `json:"timestamp" gorm:"column:timestamp"`
+	Status    string    `json:"status" gorm:"column:status"`
+	Token     string    `json:"token,omitempty" gorm:"-"`          // access token issued at registration, see pkg/token
+	Flag      string    `json:"-" gorm:"column:flag;default:null"` // comma separated: device state if blocked, unknown, clock_skew
+
+	UptimeSeconds *int64       `json:"uptime_seconds,omitempty" gorm:"column:uptime_seconds"`
+	AgentVersion  string       `json:"agent_version,omitempty" gorm:"column:agent_version;default:null"`
+	BootID        string       `json:"boot_id,omitempty" gorm:"column:boot_id;default:null"` // changes when the device reboots
+	Sequence      *int64       `json:"sequence,omitempty" gorm:"column:sequence"`            // increases by one per heartbeat within a boot
+	Health        HealthChecks `json:"health,omitempty" gorm:"column:health"`
+
+	// SequenceGap is the number of heartbeats lost since the previous one of the same boot, nil
+	// for the first heartbeat of a boot and when the device sends no sequence
+	SequenceGap *int64 `json:"-" gorm:"column:sequence_gap"`
+	// ReceivedAt is the server time the heartbeat arrived
+	ReceivedAt time.Time `json:"-" gorm:"column:received_at"`
+	// ClockSkewMS is the device timestamp minus ReceivedAt, nil when the device sent no timestamp
+	ClockSkewMS *int64 `json:"-" gorm:"column:clock_skew_ms"`
+}
+
+// HealthCheck is the result of one of the agent's health checks
+type HealthCheck struct {
+	Status  string `json:"status"` // e.g. ok, warn or fail, as reported by the agent
+	Message string `json:"message,omitempty"`
+}
+
+// HealthChecks are the agent's health checks by name, stored as JSONB
+type HealthChecks map[string]HealthCheck
+
+// Value implements driver.Valuer, no checks are stored as NULL
+func (h HealthChecks) Value() (driver.Value, error) {
+	if len(h) == 0 {
+		return nil, nil
+	}
+	b, err := json.Marshal(h)
+	return string(b), err
+}
+
+// Scan implements sql.Scanner
+func (h *HealthChecks) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*h = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, h)
+	case string:
+		return json.Unmarshal([]byte(v), h)
+	default:
+		return fmt.Errorf("cannot scan %T into HealthChecks", value)
+	}
+}
@@ -0,0 +1,33 @@
+package models
+
+import "time"
+
+// PresenceFilter selects and pages the devices of a presence snapshot
+type PresenceFilter struct {
+	Tag        string     // only devices with this tag
+	SeenAfter  *time.Time // only devices last seen at or after this time
+	SeenBefore *time.Time // only devices last seen before this time
+	State      string     // online, offline or never_seen; empty for all
+	Limit      int
+	Offset     int
+	Ascending  bool // sort by last seen, oldest first instead of newest first
+}
+
+// DevicePresence is a device's presence in a snapshot
+type DevicePresence struct {
+	DeviceID string     `json:"device_id"`
+	State    string     `json:"state"`     // online, offline or never_seen
+	LastSeen *time.Time `json:"last_seen"` // time of the last heartbeat, nil if never seen
+}
+
+// PresenceSnapshot counts the registered devices by presence and lists one page of them. The
+// counts cover every device matching the filter apart from its state.
+type PresenceSnapshot struct {
+	Online    int64            `json:"online"`
+	Offline   int64            `json:"offline"`
+	NeverSeen int64            `json:"never_seen"`
+	Total     int64            `json:"total"`
+	Limit     int              `json:"limit"`
+	Offset    int              `json:"offset"`
+	Devices   []DevicePresence `json:"devices"`
+}
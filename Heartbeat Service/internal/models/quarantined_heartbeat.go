@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// QuarantinedHeartbeat is a heartbeat kept aside because its device isn't registered
+type QuarantinedHeartbeat struct {
+	ID         uint64    `gorm:"column:id;primaryKey"`
+	DeviceID   string    `gorm:"column:device_id"`
+	ReceivedAt time.Time `gorm:"column:received_at"`
+	Reason     string    `gorm:"column:reason"`
+	Payload    string    `gorm:"column:payload"` // the message as received
+}
@@ -0,0 +1,254 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/benmeehan/iot-heartbeat-service/internal/constants"
+	"github.com/benmeehan/iot-heartbeat-service/internal/database"
+	"github.com/benmeehan/iot-heartbeat-service/internal/models"
+	"github.com/sirupsen/logrus"
+)
+
+// Bucket size of the finest heartbeat aggregate, the resolution of availability reports
+const availabilityBucket = 5 * time.Minute
+
+// ErrInvalidRange is returned when a report's range is empty once aligned to the 5 minute buckets
+var ErrInvalidRange = errors.New("the range must end after it starts and before the current 5 minutes")
+
+// aggregateRange is a part of a report's range read from one heartbeat aggregate
+type aggregateRange struct {
+	View     string
+	From, To time.Time
+}
+
+// AvailabilityService computes uptime and outages from the heartbeat continuous aggregates,
+// without reading the raw heartbeats
+type AvailabilityService struct {
+	DBClient database.DB
+	Logger   *logrus.Logger
+}
+
+// NewAvailabilityService creates a new instance of AvailabilityService
+func NewAvailabilityService(dbClient database.DB, logger *logrus.Logger) *AvailabilityService {
+	return &AvailabilityService{
+		DBClient: dbClient,
+		Logger:   logger,
+	}
+}
+
+// DeviceAvailability computes the device's uptime and outages in [from, to). The range is
+// aligned to 5 minute buckets and starts no earlier than the device's registration.
+func (a *AvailabilityService) DeviceAvailability(deviceID string, from, to time.Time) (*models.DeviceAvailability, error) {
+	from, to, err := alignRange(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	created, err := a.DBClient.ListDeviceCreationTimes(deviceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load device: %w", err)
+	}
+	active, err := a.countActive(from, to, deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	report := availability(deviceID, from, to, created, active[deviceID])
+	buckets, err := a.DBClient.ListActiveBuckets(deviceID, report.From, report.To)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load heartbeat buckets: %w", err)
+	}
+	report.Outages = outages(buckets, report.From, report.To)
+	return &report, nil
+}
+
+// Backfill materializes the heartbeat aggregates over the heartbeats stored before they were
+// created, which their refresh policies don't reach back to. Aggregates are refreshed finest
+// first, as each one is rolled up from the previous. Heartbeats older than retention have been
+// dropped and are left alone, so their buckets stay in the aggregates.
+func (a *AvailabilityService) Backfill(retention time.Duration) {
+	var since *time.Time
+	if retention > 0 {
+		start := time.Now().Add(-retention)
+		since = &start
+	}
+
+	start := time.Now()
+	for _, view := range []string{constants.HEARTBEATS_5M, constants.HEARTBEATS_1H, constants.HEARTBEATS_1D} {
+		if err := a.DBClient.RefreshAggregate(view, since); err != nil {
+			a.Logger.WithError(err).Errorf("Failed to backfill heartbeat aggregate %s", view)
+			return
+		}
+	}
+	a.Logger.Infof("Backfilled heartbeat aggregates in %s", time.Since(start))
+}
+
+// FleetAvailability computes the uptime of every registered device, and of every other device
+// that sent heartbeats, in [from, to). The fleet's uptime covers all devices, the report lists
+// the page of them ordered by device ID that offset and limit select.
+func (a *AvailabilityService) FleetAvailability(from, to time.Time, limit, offset int) (*models.FleetAvailability, error) {
+	from, to, err := alignRange(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	created, err := a.DBClient.ListDeviceCreationTimes("")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load devices: %w", err)
+	}
+	active, err := a.countActive(from, to, "")
+	if err != nil {
+		return nil, err
+	}
+
+	deviceIDs := make(map[string]struct{}, len(created))
+	for deviceID, createdAt := range created {
+		if createdAt.Before(to) {
+			deviceIDs[deviceID] = struct{}{}
+		}
+	}
+	for deviceID := range active {
+		deviceIDs[deviceID] = struct{}{}
+	}
+
+	devices := make([]models.DeviceAvailability, 0, len(deviceIDs))
+	var activeTotal, expectedTotal int64
+	for deviceID := range deviceIDs {
+		device := availability(deviceID, from, to, created, active[deviceID])
+		activeTotal += device.ActiveBuckets
+		expectedTotal += device.ExpectedBuckets
+		devices = append(devices, device)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].DeviceID < devices[j].DeviceID })
+
+	report := &models.FleetAvailability{
+		From:          from,
+		To:            to,
+		UptimePercent: uptimePercent(activeTotal, expectedTotal),
+		Total:         len(devices),
+		Limit:         limit,
+		Offset:        offset,
+		Devices:       []models.DeviceAvailability{},
+	}
+	if offset < len(devices) {
+		report.Devices = devices[offset:min(offset+limit, len(devices))]
+	}
+	return report, nil
+}
+
+// countActive sums the active buckets in [from, to), reading whole days from heartbeats_1d,
+// whole hours from heartbeats_1h and only the remaining edges from heartbeats_5m
+func (a *AvailabilityService) countActive(from, to time.Time, deviceID string) (map[string]int64, error) {
+	total := make(map[string]int64)
+	for _, r := range splitRange(from, to) {
+		counts, err := a.DBClient.CountActiveBuckets(r.View, r.From, r.To, deviceID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to count heartbeat buckets in %s: %w", r.View, err)
+		}
+		for id, count := range counts {
+			total[id] += count
+		}
+	}
+	return total, nil
+}
+
+// availability builds a device's report. Buckets before the device was registered are not
+// expected; devices that aren't registered are expected for the whole range.
+func availability(deviceID string, from, to time.Time, created map[string]time.Time, active int64) models.DeviceAvailability {
+	if createdAt, ok := created[deviceID]; ok && createdAt.After(from) {
+		from = createdAt.Truncate(availabilityBucket)
+		if from.After(to) {
+			from = to
+		}
+	}
+	expected := int64(to.Sub(from) / availabilityBucket)
+	if active > expected {
+		expected = active
+	}
+	return models.DeviceAvailability{
+		DeviceID:        deviceID,
+		From:            from,
+		To:              to,
+		UptimePercent:   uptimePercent(active, expected),
+		ActiveBuckets:   active,
+		ExpectedBuckets: expected,
+	}
+}
+
+// outages returns the runs of buckets in [from, to) that are not in the ordered active buckets
+func outages(active []time.Time, from, to time.Time) []models.Outage {
+	var result []models.Outage
+	next := from
+	for _, bucket := range active {
+		if bucket.After(next) {
+			result = append(result, models.Outage{Start: next, End: bucket})
+		}
+		next = bucket.Add(availabilityBucket)
+	}
+	if next.Before(to) {
+		result = append(result, models.Outage{Start: next, End: to})
+	}
+	return result
+}
+
+func uptimePercent(active, expected int64) float64 {
+	if expected == 0 {
+		return 0
+	}
+	return float64(active) * 100 / float64(expected)
+}
+
+// alignRange rounds the range out to whole 5 minute buckets in UTC. The current bucket is
+// left out as it is still filling.
+func alignRange(from, to time.Time) (time.Time, time.Time, error) {
+	from = from.UTC().Truncate(availabilityBucket)
+	to = to.UTC().Add(availabilityBucket - 1).Truncate(availabilityBucket)
+	if now := time.Now().UTC().Truncate(availabilityBucket); to.After(now) {
+		to = now
+	}
+	if !from.Before(to) {
+		return from, to, ErrInvalidRange
+	}
+	return from, to, nil
+}
+
+// splitRange splits an aligned range into the parts read from each aggregate: whole days in
+// the middle, whole hours around them and 5 minute buckets at the edges
+func splitRange(from, to time.Time) []aggregateRange {
+	var ranges []aggregateRange
+	add := func(view string, from, to time.Time) {
+		if from.Before(to) {
+			ranges = append(ranges, aggregateRange{View: view, From: from, To: to})
+		}
+	}
+
+	hourFrom, hourTo := ceil(from, time.Hour), to.Truncate(time.Hour)
+	if !hourFrom.Before(hourTo) {
+		add(constants.HEARTBEATS_5M, from, to)
+		return ranges
+	}
+	add(constants.HEARTBEATS_5M, from, hourFrom)
+	add(constants.HEARTBEATS_5M, hourTo, to)
+
+	dayFrom, dayTo := ceil(hourFrom, 24*time.Hour), hourTo.Truncate(24*time.Hour)
+	if !dayFrom.Before(dayTo) {
+		add(constants.HEARTBEATS_1H, hourFrom, hourTo)
+		return ranges
+	}
+	add(constants.HEARTBEATS_1H, hourFrom, dayFrom)
+	add(constants.HEARTBEATS_1H, dayTo, hourTo)
+	add(constants.HEARTBEATS_1D, dayFrom, dayTo)
+	return ranges
+}
+
+// ceil rounds t up to a multiple of d
+func ceil(t time.Time, d time.Duration) time.Time {
+	truncated := t.Truncate(d)
+	if truncated.Equal(t) {
+		return t
+	}
+	return truncated.Add(d)
+}
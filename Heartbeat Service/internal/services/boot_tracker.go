@@ -0,0 +1,164 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/benmeehan/iot-heartbeat-service/internal/constants"
+	"github.com/benmeehan/iot-heartbeat-service/internal/database"
+	"github.com/benmeehan/iot-heartbeat-service/internal/models"
+	"github.com/benmeehan/iot-heartbeat-service/pkg/kafka"
+	"github.com/benmeehan/iot-heartbeat-service/pkg/mqtt"
+	"github.com/sirupsen/logrus"
+)
+
+// BootTracker follows the boot ID and heartbeat sequence of each device. Every heartbeat is
+// stored with the number of heartbeats lost since the previous one of the same boot, so a gap
+// in a device's heartbeats can be told apart from downtime, and a change of boot ID is
+// published as a device.rebooted event.
+//
+// Heartbeats without a boot ID or sequence are not tracked. A heartbeat older than the
+// device's latest one is stored without a gap and doesn't change the tracked boot.
+type BootTracker struct {
+	MqttClient  mqtt.MQTTClient
+	KafkaClient *kafka.KafkaClient // nil outside queue mode, then events only go to MQTT
+	DBClient    database.DB
+	MqttTopic   string // events are published on <MqttTopic>/<device ID>
+	KafkaTopic  string // events are keyed by device ID
+	QOS         int
+	Logger      *logrus.Logger
+}
+
+// NewBootTracker creates a new instance of BootTracker
+func NewBootTracker(mqttClient mqtt.MQTTClient, kafkaClient *kafka.KafkaClient, dbClient database.DB, mqttTopic, kafkaTopic string, qos int, logger *logrus.Logger) *BootTracker {
+	return &BootTracker{
+		MqttClient:  mqttClient,
+		KafkaClient: kafkaClient,
+		DBClient:    dbClient,
+		MqttTopic:   mqttTopic,
+		KafkaTopic:  kafkaTopic,
+		QOS:         qos,
+		Logger:      logger,
+	}
+}
+
+// Annotate sets the sequence gap of each heartbeat from the device's previous heartbeat. It
+// returns the devices' new boot records and the reboots in the batch, which Record saves and
+// publishes once the heartbeats are written.
+func (t *BootTracker) Annotate(heartbeats []models.Heartbeat) ([]models.DeviceBoot, []models.RebootEvent) {
+	var deviceIDs []string
+	tracked := make(map[string]bool)
+	for _, hb := range heartbeats {
+		if (hb.BootID != "" || hb.Sequence != nil) && !tracked[hb.DeviceID] {
+			deviceIDs = append(deviceIDs, hb.DeviceID)
+			tracked[hb.DeviceID] = true
+		}
+	}
+	if len(deviceIDs) == 0 {
+		return nil, nil
+	}
+
+	boots, err := t.DBClient.GetDeviceBoots(deviceIDs)
+	if err != nil {
+		t.Logger.WithError(err).Errorf("Failed to load boots of %d devices", len(deviceIDs))
+		return nil, nil
+	}
+
+	changed := make(map[string]bool)
+	var reboots []models.RebootEvent
+	for i := range heartbeats {
+		hb := &heartbeats[i]
+		if hb.BootID == "" && hb.Sequence == nil {
+			continue
+		}
+		previous, known := boots[hb.DeviceID]
+		if known && hb.Timestamp.Before(previous.SeenAt) {
+			continue
+		}
+
+		// An agent that only sends a sequence stays on the boot it was last seen with
+		bootID := hb.BootID
+		if bootID == "" {
+			bootID = previous.BootID
+		}
+
+		if !known || bootID != previous.BootID {
+			boot := models.DeviceBoot{DeviceID: hb.DeviceID, BootID: bootID, Sequence: hb.Sequence, BootedAt: bootedAt(hb), SeenAt: hb.Timestamp}
+			// A device that didn't send a boot ID before can't be known to have rebooted
+			if known && previous.BootID != "" {
+				reboots = append(reboots, models.RebootEvent{
+					Version:        constants.REBOOT_EVENT_VERSION,
+					DeviceID:       hb.DeviceID,
+					Event:          constants.DEVICE_EVENT_REBOOTED,
+					BootID:         bootID,
+					PreviousBootID: previous.BootID,
+					BootedAt:       boot.BootedAt,
+					Timestamp:      hb.Timestamp,
+				})
+			}
+			boots[hb.DeviceID] = boot
+			changed[hb.DeviceID] = true
+			continue
+		}
+
+		if hb.Sequence != nil && (previous.Sequence == nil || *hb.Sequence > *previous.Sequence) {
+			if previous.Sequence != nil {
+				gap := *hb.Sequence - *previous.Sequence - 1
+				hb.SequenceGap = &gap
+			}
+			previous.Sequence = hb.Sequence
+		}
+		previous.SeenAt = hb.Timestamp
+		boots[hb.DeviceID] = previous
+		changed[hb.DeviceID] = true
+	}
+
+	updated := make([]models.DeviceBoot, 0, len(changed))
+	for deviceID := range changed {
+		updated = append(updated, boots[deviceID])
+	}
+	return updated, reboots
+}
+
+// Record saves the devices' boot records and publishes the reboots
+func (t *BootTracker) Record(boots []models.DeviceBoot, reboots []models.RebootEvent) {
+	if err := t.DBClient.UpdateDeviceBoots(boots); err != nil {
+		t.Logger.WithError(err).Errorf("Failed to update boots of %d devices", len(boots))
+	}
+	for i := range reboots {
+		t.publish(&reboots[i])
+	}
+}
+
+// publish announces the reboot. The heartbeats are already saved, so failures are only logged.
+func (t *BootTracker) publish(event *models.RebootEvent) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		t.Logger.WithError(err).Error("Failed to marshal reboot event")
+		return
+	}
+
+	topic := fmt.Sprintf("%s/%s", t.MqttTopic, event.DeviceID)
+	token := t.MqttClient.Publish(topic, byte(t.QOS), false, payload)
+	token.Wait()
+	if err := token.Error(); err != nil {
+		t.Logger.WithError(err).Errorf("Failed to publish reboot event for device: %s", event.DeviceID)
+	}
+
+	if t.KafkaClient != nil {
+		if err := t.KafkaClient.PublishMessage(t.KafkaTopic, event.DeviceID, payload); err != nil {
+			t.Logger.WithError(err).Errorf("Failed to produce reboot event for device: %s", event.DeviceID)
+		}
+	}
+
+	t.Logger.Infof("Device %s rebooted", event.DeviceID)
+}
+
+// bootedAt estimates when the device booted from the heartbeat's uptime
+func bootedAt(hb *models.Heartbeat) time.Time {
+	if hb.UptimeSeconds == nil {
+		return hb.Timestamp
+	}
+	return hb.Timestamp.Add(-time.Duration(*hb.UptimeSeconds) * time.Second)
+}
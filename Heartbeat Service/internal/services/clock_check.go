@@ -0,0 +1,61 @@
+package services
+
+import (
+	"strings"
+	"time"
+
+	"github.com/benmeehan/iot-heartbeat-service/internal/constants"
+)
+
+// ClockCheck compares device timestamps with the time a message was received. A missing
+// timestamp is replaced by the receive time. A timestamp further off than MaxSkew is flagged
+// and, with CorrectSkewed, replaced by the receive time so the row lands in the right chunk;
+// the original is still receive time plus the recorded skew.
+type ClockCheck struct {
+	MaxSkew       time.Duration // 0 disables skew detection
+	CorrectSkewed bool
+}
+
+// NewClockCheck creates a new instance of ClockCheck
+func NewClockCheck(maxSkew time.Duration, correctSkewed bool) *ClockCheck {
+	return &ClockCheck{
+		MaxSkew:       maxSkew,
+		CorrectSkewed: correctSkewed,
+	}
+}
+
+// Apply checks the timestamp against receivedAt and fixes it up. It returns the device clock's
+// offset in milliseconds, nil when the device sent no timestamp, and whether the clock is skewed.
+func (c *ClockCheck) Apply(timestamp *time.Time, receivedAt time.Time) (*int64, bool) {
+	if timestamp.IsZero() {
+		*timestamp = receivedAt
+		return nil, false
+	}
+
+	skew := timestamp.Sub(receivedAt)
+	offset := skew.Milliseconds()
+	skewed := c.MaxSkew > 0 && (skew > c.MaxSkew || skew < -c.MaxSkew)
+	if skewed && c.CorrectSkewed {
+		*timestamp = receivedAt
+	}
+	return &offset, skewed
+}
+
+// addFlag adds a flag to a comma separated list of flags
+func addFlag(flags, flag string) string {
+	if flags == "" {
+		return flag
+	}
+	if strings.Contains(","+flags+",", ","+flag+",") {
+		return flags
+	}
+	return flags + "," + flag
+}
+
+// clockSkewFlag returns the flags with the clock skew flag added when the clock is skewed
+func clockSkewFlag(flags string, skewed bool) string {
+	if !skewed {
+		return flags
+	}
+	return addFlag(flags, constants.FLAG_CLOCK_SKEW)
+}
@@ -0,0 +1,258 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/benmeehan/iot-heartbeat-service/internal/constants"
+	"github.com/benmeehan/iot-heartbeat-service/internal/database"
+	"github.com/benmeehan/iot-heartbeat-service/internal/models"
+	"github.com/benmeehan/iot-heartbeat-service/pkg/kafka"
+	"github.com/benmeehan/iot-heartbeat-service/pkg/mqtt"
+	KAFKA "github.com/confluentinc/confluent-kafka-go/kafka"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// maxUnknownDevices bounds the IDs remembered as unknown between reloads. The oldest are
+// forgotten first.
+const maxUnknownDevices = 100000
+
+// DeviceRegistry keeps track of the registered devices and their states, so data from unknown
+// devices can be rejected or quarantined and data from suspended and decommissioned devices
+// dropped or flagged. It is loaded from the devices table and kept current from the device
+// events published by the registration service.
+//
+// IDs that aren't cached are looked up in the database at no more than LookupRate per second,
+// so a flood of made-up IDs can't turn into a flood of queries. IDs over the rate are treated
+// as unknown without a lookup.
+type DeviceRegistry struct {
+	MqttClient    mqtt.MQTTClient
+	KafkaClient   *kafka.KafkaClient
+	DBClient      database.DB
+	EventTopic    string
+	QOS           int
+	BlockedAction string
+	UnknownAction string
+	LookupRate    float64 // database lookups of uncached IDs per second
+	Logger        *logrus.Logger
+	Mode          string
+
+	mu           sync.RWMutex
+	devices      map[string]string   // device ID -> state
+	unknown      map[string]struct{} // IDs looked up in the database since the last reload and not found
+	unknownOrder []string            // unknown IDs, oldest first
+	lookupTokens float64             // lookups left, refilled at LookupRate up to one second's worth
+	lookupAt     time.Time           // when lookupTokens was last refilled
+}
+
+// NewDeviceRegistry creates a new instance of DeviceRegistry
+func NewDeviceRegistry(mode string, mqttClient mqtt.MQTTClient, kafkaClient *kafka.KafkaClient, dbClient database.DB, eventTopic string, qos int, blockedAction, unknownAction string, lookupRate float64, logger *logrus.Logger) (*DeviceRegistry, error) {
+	switch blockedAction {
+	case constants.BLOCKED_ACTION_DROP, constants.BLOCKED_ACTION_FLAG:
+	default:
+		return nil, fmt.Errorf("unknown blocked device action %q", blockedAction)
+	}
+	switch unknownAction {
+	case constants.UNKNOWN_ACTION_REJECT, constants.UNKNOWN_ACTION_QUARANTINE, constants.UNKNOWN_ACTION_FLAG:
+	default:
+		return nil, fmt.Errorf("unknown action for unknown devices %q", unknownAction)
+	}
+	if lookupRate <= 0 {
+		lookupRate = 50
+	}
+
+	return &DeviceRegistry{
+		MqttClient:    mqttClient,
+		KafkaClient:   kafkaClient,
+		DBClient:      dbClient,
+		EventTopic:    eventTopic,
+		QOS:           qos,
+		BlockedAction: blockedAction,
+		UnknownAction: unknownAction,
+		LookupRate:    lookupRate,
+		Logger:        logger,
+		Mode:          mode,
+		devices:       make(map[string]string),
+		unknown:       make(map[string]struct{}),
+	}, nil
+}
+
+// Start loads the devices, subscribes to device events and reloads the devices
+// periodically. The reload covers events that were missed, e.g. while the service was down
+// or when another consumer in the Kafka group received them.
+func (r *DeviceRegistry) Start(refreshInterval time.Duration) error {
+	if err := r.reload(); err != nil {
+		return err
+	}
+
+	switch r.Mode {
+	case constants.QUEUE_MODE:
+		if err := r.KafkaClient.Subscribe(r.EventTopic, r.handleKafkaEvent); err != nil {
+			return fmt.Errorf("error subscribing to Kafka topic %s: %w", r.EventTopic, err)
+		}
+	default:
+		token := r.MqttClient.Subscribe(r.EventTopic, byte(r.QOS), r.handleEvent)
+		token.Wait()
+		if token.Error() != nil {
+			return fmt.Errorf("error subscribing to topic %s: %w", r.EventTopic, token.Error())
+		}
+	}
+	r.Logger.Infof("Subscribed to device events on %s", r.EventTopic)
+
+	if refreshInterval <= 0 {
+		refreshInterval = time.Minute
+	}
+	go func() {
+		ticker := time.NewTicker(refreshInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := r.reload(); err != nil {
+				r.Logger.WithError(err).Error("Failed to reload devices")
+			}
+		}
+	}()
+	return nil
+}
+
+// Check decides what to do with data from a device. It returns false if the data should not be
+// stored, together with the reason to quarantine it under or an empty reason if it is rejected.
+// Otherwise it returns the flag to store with the data, which is empty for registered devices
+// in good standing.
+func (r *DeviceRegistry) Check(deviceID string) (flag string, accept bool, quarantineReason string) {
+	state, known, reason := r.lookup(deviceID)
+
+	if !known {
+		switch r.UnknownAction {
+		case constants.UNKNOWN_ACTION_FLAG:
+			return constants.FLAG_UNKNOWN_DEVICE, true, ""
+		case constants.UNKNOWN_ACTION_QUARANTINE:
+			return "", false, reason
+		default:
+			return "", false, ""
+		}
+	}
+
+	switch state {
+	case constants.DEVICE_STATE_SUSPENDED, constants.DEVICE_STATE_DECOMMISSIONED:
+		if r.BlockedAction == constants.BLOCKED_ACTION_DROP {
+			return "", false, ""
+		}
+		return state, true, ""
+	}
+	return "", true, ""
+}
+
+// lookup returns the device's state. A device that isn't cached is looked up in the database
+// once per reload, rate permitting, which covers devices registered since the last reload whose
+// event hasn't arrived yet. For unknown devices it returns why the device isn't known.
+func (r *DeviceRegistry) lookup(deviceID string) (string, bool, string) {
+	if deviceID == "" {
+		return "", false, constants.QUARANTINE_REASON_MISSING_ID
+	}
+	if _, err := uuid.Parse(deviceID); err != nil {
+		return "", false, constants.QUARANTINE_REASON_INVALID_ID
+	}
+
+	r.mu.RLock()
+	state, known := r.devices[deviceID]
+	_, missed := r.unknown[deviceID]
+	r.mu.RUnlock()
+	if known {
+		return state, true, ""
+	}
+	if missed || !r.allowLookup() {
+		return "", false, constants.QUARANTINE_REASON_UNKNOWN_DEVICE
+	}
+
+	state, found, err := r.DBClient.GetDeviceState(deviceID)
+	if err != nil {
+		// Without an answer the data is let through rather than lost
+		r.Logger.WithError(err).Errorf("Failed to look up device: %s", deviceID)
+		return "", true, ""
+	}
+
+	r.mu.Lock()
+	if found {
+		r.devices[deviceID] = state
+	} else {
+		r.rememberUnknown(deviceID)
+	}
+	r.mu.Unlock()
+
+	if !found {
+		return "", false, constants.QUARANTINE_REASON_UNKNOWN_DEVICE
+	}
+	return state, true, ""
+}
+
+// allowLookup takes a database lookup from the bucket if one is left
+func (r *DeviceRegistry) allowLookup() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	r.lookupTokens = math.Min(math.Max(r.LookupRate, 1), r.lookupTokens+now.Sub(r.lookupAt).Seconds()*r.LookupRate)
+	r.lookupAt = now
+	if r.lookupTokens < 1 {
+		return false
+	}
+	r.lookupTokens--
+	return true
+}
+
+// rememberUnknown caches an ID that isn't registered, forgetting the oldest one when the cache
+// is full. It must be called with mu held.
+func (r *DeviceRegistry) rememberUnknown(deviceID string) {
+	if _, ok := r.unknown[deviceID]; ok {
+		return
+	}
+	if len(r.unknownOrder) >= maxUnknownDevices {
+		delete(r.unknown, r.unknownOrder[0])
+		r.unknownOrder = r.unknownOrder[1:]
+	}
+	r.unknown[deviceID] = struct{}{}
+	r.unknownOrder = append(r.unknownOrder, deviceID)
+}
+
+func (r *DeviceRegistry) reload() error {
+	devices, err := r.DBClient.ListDevices()
+	if err != nil {
+		return fmt.Errorf("failed to load devices: %w", err)
+	}
+
+	r.mu.Lock()
+	r.devices = devices
+	r.unknown = make(map[string]struct{})
+	r.unknownOrder = nil
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *DeviceRegistry) handleEvent(client MQTT.Client, msg MQTT.Message) {
+	r.applyEvent(msg.Payload())
+}
+
+func (r *DeviceRegistry) handleKafkaEvent(msg *KAFKA.Message) {
+	r.applyEvent(msg.Value)
+}
+
+// applyEvent updates the device's entry from a lifecycle event
+func (r *DeviceRegistry) applyEvent(payload []byte) {
+	var event models.DeviceEvent
+	if err := json.Unmarshal(payload, &event); err != nil || event.DeviceID == "" {
+		r.Logger.Errorf("Failed to decode device event: %v", err)
+		return
+	}
+
+	r.mu.Lock()
+	r.devices[event.DeviceID] = event.State
+	delete(r.unknown, event.DeviceID)
+	r.mu.Unlock()
+
+	r.Logger.Infof("Device %s is now %s", event.DeviceID, event.State)
+}
@@ -0,0 +1,269 @@
+package services
+
+import (
+	"errors"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/benmeehan/iot-heartbeat-service/internal/constants"
+	"github.com/benmeehan/iot-heartbeat-service/internal/database"
+	"github.com/benmeehan/iot-heartbeat-service/internal/models"
+	"github.com/sirupsen/logrus"
+)
+
+// Postgres allows 65535 parameters per statement and a heartbeat row takes one per column
+const heartbeatColumns = 12
+
+const maxBatchSize = 65535 / heartbeatColumns
+
+// A batch that fails to insert is retried insertRetries times, waiting insertRetryDelay and then
+// twice as long before each retry
+const insertRetries = 3
+
+var insertRetryDelay = time.Second
+
+// ErrQueueFull is returned when a heartbeat could not be queued within the enqueue timeout
+var ErrQueueFull = errors.New("heartbeat queue is full")
+
+// HeartbeatBatcher takes heartbeats off the MQTT and Kafka callbacks and writes them in
+// batches. Heartbeats go into bounded queues, one per worker; each worker flushes with one
+// multi-row INSERT when its batch is full or FlushInterval has passed. A device's heartbeats
+// always go to the same worker, so its boot, sequence gaps and presence are updated in order
+// and never by two workers at once.
+//
+// When the database can't keep up a queue fills and Enqueue blocks the callback for up to
+// EnqueueTimeout. Blocking the callback stops paho from reading further messages, which pushes
+// back on the broker. Heartbeats that still don't fit are dropped and counted; a heartbeat is
+// only a liveness signal and the next one follows within one interval.
+type HeartbeatBatcher struct {
+	DBClient       database.DB
+	Presence       *PresenceService
+	Boots          *BootTracker
+	BatchSize      int
+	FlushInterval  time.Duration
+	EnqueueTimeout time.Duration // 0 blocks until there is room
+	Logger         *logrus.Logger
+
+	queues  []chan models.Heartbeat // one per worker
+	wg      sync.WaitGroup
+	dropped atomic.Int64
+
+	mu     sync.RWMutex // held for reading while enqueuing, so Close can't close the queues under a sender
+	closed bool
+}
+
+// NewHeartbeatBatcher creates a new instance of HeartbeatBatcher
+func NewHeartbeatBatcher(dbClient database.DB, presence *PresenceService, boots *BootTracker, queueSize, workers, batchSize int, flushInterval, enqueueTimeout time.Duration, logger *logrus.Logger) *HeartbeatBatcher {
+	if workers <= 0 {
+		workers = 4
+	}
+	if batchSize <= 0 {
+		batchSize = 500
+	}
+	if batchSize > maxBatchSize {
+		batchSize = maxBatchSize
+	}
+	if queueSize < batchSize*workers {
+		queueSize = batchSize * workers
+	}
+	if flushInterval <= 0 {
+		flushInterval = time.Second
+	}
+	queues := make([]chan models.Heartbeat, workers)
+	for i := range queues {
+		queues[i] = make(chan models.Heartbeat, max(queueSize/workers, 1))
+	}
+	return &HeartbeatBatcher{
+		DBClient:       dbClient,
+		Presence:       presence,
+		Boots:          boots,
+		BatchSize:      batchSize,
+		FlushInterval:  flushInterval,
+		EnqueueTimeout: enqueueTimeout,
+		Logger:         logger,
+		queues:         queues,
+	}
+}
+
+// Start starts the workers
+func (b *HeartbeatBatcher) Start() {
+	for _, queue := range b.queues {
+		b.wg.Add(1)
+		go b.work(queue)
+	}
+	b.Logger.Infof("Started %d heartbeat writers", len(b.queues))
+}
+
+// Enqueue queues a heartbeat for writing by the device's worker. It blocks while the queue is
+// full, for at most EnqueueTimeout, and returns ErrQueueFull if the heartbeat was dropped.
+func (b *HeartbeatBatcher) Enqueue(hb models.Heartbeat) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return ErrQueueFull
+	}
+	if hb.ReceivedAt.IsZero() {
+		hb.ReceivedAt = time.Now()
+	}
+	queue := b.queues[b.shard(hb.DeviceID)]
+
+	select {
+	case queue <- hb:
+		return nil
+	default:
+	}
+
+	if b.EnqueueTimeout <= 0 {
+		queue <- hb
+		return nil
+	}
+	timer := time.NewTimer(b.EnqueueTimeout)
+	defer timer.Stop()
+	select {
+	case queue <- hb:
+		return nil
+	case <-timer.C:
+		b.dropped.Add(1)
+		return ErrQueueFull
+	}
+}
+
+// Close stops accepting heartbeats and waits until the queued ones are written. Heartbeats
+// enqueued afterwards are dropped, so the MQTT client should be disconnected first.
+func (b *HeartbeatBatcher) Close() {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.closed = true
+	for _, queue := range b.queues {
+		close(queue)
+	}
+	b.mu.Unlock()
+
+	b.wg.Wait()
+	b.Logger.Info("Flushed heartbeat queue")
+}
+
+// shard returns the index of the worker that writes the device's heartbeats
+func (b *HeartbeatBatcher) shard(deviceID string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(deviceID))
+	return int(hash.Sum32() % uint32(len(b.queues)))
+}
+
+// work collects heartbeats from its queue into a batch and flushes it when it is full, when
+// the flush interval has passed and when the queue is closed
+func (b *HeartbeatBatcher) work(queue <-chan models.Heartbeat) {
+	defer b.wg.Done()
+
+	batch := make([]models.Heartbeat, 0, b.BatchSize)
+	ticker := time.NewTicker(b.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case hb, ok := <-queue:
+			if !ok {
+				b.flush(batch)
+				return
+			}
+			batch = append(batch, hb)
+			if len(batch) >= b.BatchSize {
+				b.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			b.flush(batch)
+			batch = batch[:0]
+			if dropped := b.dropped.Swap(0); dropped > 0 {
+				b.Logger.Warnf("Dropped %d heartbeats because the queue was full", dropped)
+			}
+		}
+	}
+}
+
+// flush writes the batch and then records the latest heartbeat, boot and clock offset of each
+// device that had a heartbeat written
+func (b *HeartbeatBatcher) flush(heartbeats []models.Heartbeat) {
+	if len(heartbeats) == 0 {
+		return
+	}
+
+	boots, reboots := b.Boots.Annotate(heartbeats)
+
+	start := time.Now()
+	written := b.insert(heartbeats)
+	if len(written) == 0 {
+		return
+	}
+	b.Logger.Debugf("Inserted %d heartbeats in %s", len(written), time.Since(start))
+
+	seen := make(map[string]time.Time)
+	clocks := make(map[string]models.DeviceClock)
+	for _, hb := range written {
+		if hb.ReceivedAt.After(seen[hb.DeviceID]) {
+			seen[hb.DeviceID] = hb.ReceivedAt
+		}
+		if hb.ClockSkewMS != nil && hb.ReceivedAt.After(clocks[hb.DeviceID].MeasuredAt) {
+			clocks[hb.DeviceID] = models.DeviceClock{
+				DeviceID:   hb.DeviceID,
+				OffsetMS:   *hb.ClockSkewMS,
+				Skewed:     strings.Contains(hb.Flag, constants.FLAG_CLOCK_SKEW),
+				MeasuredAt: hb.ReceivedAt,
+			}
+		}
+	}
+
+	b.Presence.SeenAll(seen)
+	b.Boots.Record(boots, reboots)
+
+	offsets := make([]models.DeviceClock, 0, len(clocks))
+	for _, clock := range clocks {
+		offsets = append(offsets, clock)
+	}
+	if err := b.DBClient.UpdateDeviceClocks(offsets); err != nil {
+		b.Logger.WithError(err).Error("Error updating device clock offsets")
+	}
+}
+
+// insert writes the heartbeats and returns the ones that were written. A failed batch is
+// retried with a growing delay, which rides out a lost connection and holds the worker back
+// meanwhile. If it still fails it is split in halves that are inserted on their own, down to
+// single heartbeats, so a heartbeat the database rejects only costs itself.
+func (b *HeartbeatBatcher) insert(heartbeats []models.Heartbeat) []models.Heartbeat {
+	err := b.DBClient.InsertHeartbeats(heartbeats)
+	for retry := 0; err != nil && retry < insertRetries; retry++ {
+		b.Logger.WithError(err).Warnf("Error inserting %d heartbeats into DB, retrying", len(heartbeats))
+		time.Sleep(insertRetryDelay << retry)
+		err = b.DBClient.InsertHeartbeats(heartbeats)
+	}
+	if err == nil {
+		return heartbeats
+	}
+	return b.split(heartbeats, err)
+}
+
+// split inserts the halves of a batch that failed with err on their own and splits them
+// further while they fail. A single heartbeat that fails is dropped.
+func (b *HeartbeatBatcher) split(heartbeats []models.Heartbeat, err error) []models.Heartbeat {
+	if len(heartbeats) == 1 {
+		b.Logger.WithError(err).Errorf("Dropped heartbeat from device %s that could not be inserted into DB", heartbeats[0].DeviceID)
+		return nil
+	}
+
+	half := len(heartbeats) / 2
+	var written []models.Heartbeat
+	for _, part := range [][]models.Heartbeat{heartbeats[:half], heartbeats[half:]} {
+		if err := b.DBClient.InsertHeartbeats(part); err != nil {
+			written = append(written, b.split(part, err)...)
+		} else {
+			written = append(written, part...)
+		}
+	}
+	return written
+}
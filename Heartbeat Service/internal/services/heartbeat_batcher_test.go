@@ -0,0 +1,124 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benmeehan/iot-heartbeat-service/internal/database"
+	"github.com/benmeehan/iot-heartbeat-service/internal/models"
+	"github.com/sirupsen/logrus"
+)
+
+// fakeDB stands in for the database the batcher writes to. Every statement costs a round trip
+// of Latency, and InsertHeartbeats fails for batches holding a heartbeat of RejectDevice.
+type fakeDB struct {
+	database.DB
+
+	Latency      time.Duration
+	RejectDevice string
+
+	mu         sync.Mutex
+	statements int
+	inserted   []models.Heartbeat
+}
+
+func (f *fakeDB) roundTrip() {
+	f.mu.Lock()
+	f.statements++
+	f.mu.Unlock()
+	if f.Latency > 0 {
+		time.Sleep(f.Latency)
+	}
+}
+
+func (f *fakeDB) InsertHeartbeats(heartbeats []models.Heartbeat) error {
+	f.roundTrip()
+	for _, hb := range heartbeats {
+		if hb.DeviceID == f.RejectDevice {
+			return errors.New("invalid heartbeat")
+		}
+	}
+	f.mu.Lock()
+	f.inserted = append(f.inserted, heartbeats...)
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *fakeDB) MarkDevicesSeen(seen []models.DeviceSeen) ([]models.DeviceStatus, error) {
+	f.roundTrip()
+	return nil, nil
+}
+
+func (f *fakeDB) UpdateDeviceClocks(clocks []models.DeviceClock) error {
+	f.roundTrip()
+	return nil
+}
+
+func (f *fakeDB) UpdateDeviceBoots(boots []models.DeviceBoot) error {
+	return nil
+}
+
+func newTestBatcher(db *fakeDB, workers, batchSize int) *HeartbeatBatcher {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	presence := NewPresenceService(nil, nil, db, "", "", 0, 0, 0, nil, nil, "", logger)
+	boots := NewBootTracker(nil, nil, db, "", "", 0, logger)
+	return NewHeartbeatBatcher(db, presence, boots, 0, workers, batchSize, time.Hour, 0, logger)
+}
+
+// BenchmarkHeartbeatBatcher compares writing heartbeats in batches with writing them one row
+// per INSERT, with a simulated round trip per statement
+func BenchmarkHeartbeatBatcher(b *testing.B) {
+	for _, batchSize := range []int{1, 100, 1000} {
+		name := fmt.Sprintf("batch=%d", batchSize)
+		if batchSize == 1 {
+			name = "per-row"
+		}
+		b.Run(name, func(b *testing.B) {
+			db := &fakeDB{Latency: 200 * time.Microsecond}
+			batcher := newTestBatcher(db, 4, batchSize)
+			batcher.Start()
+
+			b.ResetTimer()
+			now := time.Now()
+			for i := 0; i < b.N; i++ {
+				hb := models.Heartbeat{DeviceID: fmt.Sprintf("device-%d", i%1000), Timestamp: now, ReceivedAt: now}
+				if err := batcher.Enqueue(hb); err != nil {
+					b.Fatal(err)
+				}
+			}
+			batcher.Close()
+			b.StopTimer()
+
+			b.ReportMetric(float64(db.statements)/float64(b.N), "statements/op")
+		})
+	}
+}
+
+func TestHeartbeatBatcherDropsOnlyRejectedHeartbeats(t *testing.T) {
+	defer func(delay time.Duration) { insertRetryDelay = delay }(insertRetryDelay)
+	insertRetryDelay = time.Millisecond
+
+	db := &fakeDB{RejectDevice: "device-5"}
+	batcher := newTestBatcher(db, 1, 100)
+
+	now := time.Now()
+	var heartbeats []models.Heartbeat
+	for i := 0; i < 10; i++ {
+		heartbeats = append(heartbeats, models.Heartbeat{DeviceID: fmt.Sprintf("device-%d", i), Timestamp: now, ReceivedAt: now})
+	}
+	batcher.flush(heartbeats)
+
+	if len(db.inserted) != 9 {
+		t.Fatalf("inserted %d heartbeats, want 9", len(db.inserted))
+	}
+	for _, hb := range db.inserted {
+		if hb.DeviceID == db.RejectDevice {
+			t.Fatalf("inserted the rejected heartbeat of %s", hb.DeviceID)
+		}
+	}
+}
@@ -1,104 +1,223 @@
-package services
-
-import (
-	"encoding/json"
-
-	"github.com/benmeehan/iot-heartbeat-service/internal/constants"
-	"github.com/benmeehan/iot-heartbeat-service/internal/database"
-	"github.com/benmeehan/iot-heartbeat-service/internal/models"
-	"github.com/benmeehan/iot-heartbeat-service/pkg/kafka"
-	"github.com/benmeehan/iot-heartbeat-service/pkg/mqtt"
-	KAFKA "github.com/confluentinc/confluent-kafka-go/kafka"
-	MQTT "github.com/eclipse/paho.mqtt.golang"
-
-	"github.com/sirupsen/logrus"
-)
-
-type HeartbeatService struct {
-	MqttClient  mqtt.MQTTClient
-	KafkaClient *kafka.KafkaClient
-	DBClient    database.DB
-	SubTopic    string
-	QOS         int
-	Logger      *logrus.Logger
-	Mode        string
-}
-
-// NewHeartbeatService creates a new instance of HeartbeatService
-func NewHeartbeatService(mode string, mqttClient mqtt.MQTTClient, KafkaClient *kafka.KafkaClient, dbClient database.DB, subTopic string, qos int, logger *logrus.Logger) *HeartbeatService {
-	return &HeartbeatService{
-		MqttClient:  mqttClient,
-		KafkaClient: KafkaClient,
-		DBClient:    dbClient,
-		SubTopic:    subTopic,
-		QOS:         qos,
-		Logger:      logger,
-		Mode:        mode,
-	}
-}
-
-func (h *HeartbeatService) ListenForDeviceHeartbeats() {
-	switch h.Mode {
-	case constants.QUEUE_MODE:
-		if err := h.KafkaClient.Subscribe(h.SubTopic, h.handleKafkaMessage); err != nil {
-			h.Logger.Errorf("Error subscribing to Kafka topic %s: %v", h.SubTopic, err)
-		} else {
-			h.Logger.Infof("Subscribed to Kafka topic: %s", h.SubTopic)
-		}
-	default:
-		// Subscribe to MQTT
-		token := h.MqttClient.Subscribe(h.SubTopic, byte(h.QOS), h.handleMessage)
-		token.Wait()
-		if token.Error() != nil {
-			h.Logger.Errorf("Error subscribing to topic %s: %v", h.SubTopic, token.Error())
-		} else {
-			h.Logger.Infof("Subscribed to topic: %s", h.SubTopic)
-		}
-	}
-}
-
-func (h *HeartbeatService) handleMessage(client MQTT.Client, msg MQTT.Message) {
-	h.Logger.WithFields(logrus.Fields{
-		"topic":   msg.Topic(),
-		"payload": string(msg.Payload()),
-	}).Info("Received message")
-
-	var hb models.Heartbeat
-	err := json.Unmarshal(msg.Payload(), &hb)
-	if err != nil {
-		h.Logger.Errorf("Failed to decode message: %v", err)
-		return
-	}
-
-	if err := h.insertHeartbeat(hb); err != nil {
-		h.Logger.Errorf("Error inserting heartbeat into DB: %v", err)
-	} else {
-		h.Logger.Infof("Inserted heartbeat for device: %s", hb.DeviceID)
-	}
-}
-
-func (h *HeartbeatService) handleKafkaMessage(msg *KAFKA.Message) {
-	h.Logger.WithFields(logrus.Fields{
-		"topic":   *msg.TopicPartition.Topic,
-		"payload": string(msg.Value),
-	}).Info("Received message from Kafka")
-
-	var hb models.Heartbeat
-	err := json.Unmarshal(msg.Value, &hb)
-	if err != nil {
-		h.Logger.Errorf("Failed to decode Kafka message: %v", err)
-		return
-	}
-
-	// Insert heartbeat into the database
-	if err := h.insertHeartbeat(hb); err != nil {
-		h.Logger.Errorf("Error inserting heartbeat into DB: %v", err)
-	} else {
-		h.Logger.Infof("Inserted heartbeat for device: %s", hb.DeviceID)
-	}
-}
-
-func (h *HeartbeatService) insertHeartbeat(hb models.Heartbeat) error {
-	result := h.DBClient.GetConn().Create(&hb)
-	return result.Error
-}
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/benmeehan/iot-heartbeat-service/internal/constants"
+	"github.com/benmeehan/iot-heartbeat-service/internal/database"
+	"github.com/benmeehan/iot-heartbeat-service/internal/models"
+	"github.com/benmeehan/iot-heartbeat-service/pkg/kafka"
+	"github.com/benmeehan/iot-heartbeat-service/pkg/mqtt"
+	"github.com/benmeehan/iot-heartbeat-service/pkg/token"
+	KAFKA "github.com/confluentinc/confluent-kafka-go/kafka"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/sirupsen/logrus"
+)
+
+type HeartbeatService struct {
+	MqttClient  mqtt.MQTTClient
+	KafkaClient *kafka.KafkaClient
+	DBClient    database.DB
+	Devices     *DeviceRegistry
+	Presence    *PresenceService
+	Batcher     *HeartbeatBatcher
+	Quarantine  *QuarantineWriter
+	Clock       *ClockCheck
+	Tokens      *token.Verifier // nil when access tokens are not required
+	SubTopic    string
+	StatusTopic string // retained online/offline messages, usually also the devices' last will
+	QOS         int
+	Logger      *logrus.Logger
+	Mode        string
+}
+
+// NewHeartbeatService creates a new instance of HeartbeatService
+func NewHeartbeatService(mode string, mqttClient mqtt.MQTTClient, KafkaClient *kafka.KafkaClient, dbClient database.DB, devices *DeviceRegistry, presence *PresenceService, batcher *HeartbeatBatcher, quarantine *QuarantineWriter, clock *ClockCheck, tokens *token.Verifier, subTopic, statusTopic string, qos int, logger *logrus.Logger) *HeartbeatService {
+	return &HeartbeatService{
+		MqttClient:  mqttClient,
+		KafkaClient: KafkaClient,
+		DBClient:    dbClient,
+		Devices:     devices,
+		Presence:    presence,
+		Batcher:     batcher,
+		Quarantine:  quarantine,
+		Clock:       clock,
+		Tokens:      tokens,
+		SubTopic:    subTopic,
+		StatusTopic: statusTopic,
+		QOS:         qos,
+		Logger:      logger,
+		Mode:        mode,
+	}
+}
+
+func (h *HeartbeatService) ListenForDeviceHeartbeats() {
+	switch h.Mode {
+	case constants.QUEUE_MODE:
+		if err := h.KafkaClient.Subscribe(h.SubTopic, h.handleKafkaMessage); err != nil {
+			h.Logger.Errorf("Error subscribing to Kafka topic %s: %v", h.SubTopic, err)
+		} else {
+			h.Logger.Infof("Subscribed to Kafka topic: %s", h.SubTopic)
+		}
+	default:
+		// Subscribe to MQTT
+		token := h.MqttClient.Subscribe(h.SubTopic, byte(h.QOS), h.handleMessage)
+		token.Wait()
+		if token.Error() != nil {
+			h.Logger.Errorf("Error subscribing to topic %s: %v", h.SubTopic, token.Error())
+		} else {
+			h.Logger.Infof("Subscribed to topic: %s", h.SubTopic)
+		}
+	}
+}
+
+// ListenForDeviceStatus subscribes to the devices' status topic. The broker publishes a device's
+// last will there when it disconnects ungracefully, so the device is marked offline within
+// seconds instead of after missed heartbeats. The topic should be a shared subscription, so
+// each status is handled by one instance of the service.
+func (h *HeartbeatService) ListenForDeviceStatus() {
+	if h.StatusTopic == "" {
+		return
+	}
+	token := h.MqttClient.Subscribe(h.StatusTopic, byte(h.QOS), h.handleStatusMessage)
+	token.Wait()
+	if token.Error() != nil {
+		h.Logger.Errorf("Error subscribing to topic %s: %v", h.StatusTopic, token.Error())
+	} else {
+		h.Logger.Infof("Subscribed to topic: %s", h.StatusTopic)
+	}
+}
+
+// handleStatusMessage handles an "online" or "offline" message on <status topic>/<device ID>.
+// It only updates the device's presence, status messages are not stored as heartbeats.
+// Retained messages replay an old status and are skipped.
+func (h *HeartbeatService) handleStatusMessage(client MQTT.Client, msg MQTT.Message) {
+	if msg.Retained() {
+		return
+	}
+
+	deviceID := msg.Topic()[strings.LastIndex(msg.Topic(), "/")+1:]
+	status := parseStatusMessage(msg.Payload())
+	if deviceID == "" || (status.Status != constants.PRESENCE_ONLINE && status.Status != constants.PRESENCE_OFFLINE) {
+		// An empty payload clears the retained message and is not a status
+		if len(msg.Payload()) > 0 {
+			h.Logger.Warnf("Ignored unknown status %q on topic %s", status.Status, msg.Topic())
+		}
+		return
+	}
+
+	if h.Tokens != nil {
+		if err := h.Tokens.VerifyDevice(status.Token, deviceID); err != nil {
+			h.Logger.WithError(err).Warnf("Dropped status with an invalid access token from device: %s", deviceID)
+			return
+		}
+	}
+
+	if _, accept, reason := h.Devices.Check(deviceID); !accept {
+		h.reject(deviceID, msg.Payload(), reason)
+		return
+	}
+
+	if status.Status == constants.PRESENCE_OFFLINE {
+		h.Presence.Disconnected(deviceID)
+	} else {
+		h.Presence.Seen(deviceID, time.Now())
+	}
+}
+
+// parseStatusMessage reads a status message, either the bare status or a JSON StatusMessage.
+// A message that can't be read has no status.
+func parseStatusMessage(payload []byte) models.StatusMessage {
+	var message models.StatusMessage
+	trimmed := bytes.TrimSpace(payload)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		if err := json.Unmarshal(trimmed, &message); err != nil {
+			return models.StatusMessage{}
+		}
+	} else {
+		message.Status = strings.Trim(string(trimmed), `"`)
+	}
+	message.Status = strings.ToLower(message.Status)
+	return message
+}
+
+func (h *HeartbeatService) handleMessage(client MQTT.Client, msg MQTT.Message) {
+	h.Logger.WithFields(logrus.Fields{
+		"topic":   msg.Topic(),
+		"payload": string(msg.Payload()),
+	}).Debug("Received message")
+
+	var hb models.Heartbeat
+	err := json.Unmarshal(msg.Payload(), &hb)
+	if err != nil {
+		h.Logger.Errorf("Failed to decode message: %v", err)
+		return
+	}
+
+	h.storeHeartbeat(hb, msg.Payload(), time.Now())
+}
+
+func (h *HeartbeatService) handleKafkaMessage(msg *KAFKA.Message) {
+	h.Logger.WithFields(logrus.Fields{
+		"topic":   *msg.TopicPartition.Topic,
+		"payload": string(msg.Value),
+	}).Debug("Received message from Kafka")
+
+	payload, receivedAt := kafka.Unwrap(msg)
+	var hb models.Heartbeat
+	err := json.Unmarshal(payload, &hb)
+	if err != nil {
+		h.Logger.Errorf("Failed to decode Kafka message: %v", err)
+		return
+	}
+
+	h.storeHeartbeat(hb, payload, receivedAt)
+}
+
+// storeHeartbeat queues the heartbeat for writing unless it lacks a required access token or
+// comes from an unknown or blocked device that is not accepted. receivedAt is when the message
+// came in from MQTT, in queue mode when the MQTT-Kafka connector received it.
+func (h *HeartbeatService) storeHeartbeat(hb models.Heartbeat, payload []byte, receivedAt time.Time) {
+	hb.ReceivedAt = receivedAt
+	if h.Tokens != nil {
+		if err := h.Tokens.VerifyDevice(hb.Token, hb.DeviceID); err != nil {
+			h.Logger.WithError(err).Warnf("Dropped heartbeat with an invalid access token from device: %s", hb.DeviceID)
+			return
+		}
+	}
+
+	flag, accept, reason := h.Devices.Check(hb.DeviceID)
+	if !accept {
+		h.reject(hb.DeviceID, payload, reason)
+		return
+	}
+	hb.Flag = flag
+
+	offset, skewed := h.Clock.Apply(&hb.Timestamp, hb.ReceivedAt)
+	hb.ClockSkewMS = offset
+	hb.Flag = clockSkewFlag(hb.Flag, skewed)
+
+	// The batcher writes the heartbeat and updates the device's presence
+	if err := h.Batcher.Enqueue(hb); err != nil {
+		h.Logger.Warnf("Dropped heartbeat from device %s: %v", hb.DeviceID, err)
+	}
+}
+
+// reject drops a message the device registry didn't accept, or queues it for the quarantine
+// table when there is a reason to quarantine it
+func (h *HeartbeatService) reject(deviceID string, payload []byte, reason string) {
+	if reason == "" {
+		h.Logger.Warnf("Dropped heartbeat from device: %s", deviceID)
+		return
+	}
+
+	quarantined := models.QuarantinedHeartbeat{DeviceID: deviceID, ReceivedAt: time.Now(), Reason: reason, Payload: string(payload)}
+	if err := h.Quarantine.Enqueue(quarantined); err != nil {
+		return
+	}
+	h.Logger.Debugf("Quarantined heartbeat from device %q: %s", deviceID, reason)
+}
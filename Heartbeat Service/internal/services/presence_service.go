@@ -0,0 +1,235 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/benmeehan/iot-heartbeat-service/internal/constants"
+	"github.com/benmeehan/iot-heartbeat-service/internal/database"
+	"github.com/benmeehan/iot-heartbeat-service/internal/models"
+	"github.com/benmeehan/iot-heartbeat-service/pkg/kafka"
+	"github.com/benmeehan/iot-heartbeat-service/pkg/mqtt"
+	"github.com/sirupsen/logrus"
+)
+
+// PresenceService tracks whether devices are online from their heartbeats and status messages.
+// A device is online from its first heartbeat until it misses MissedIntervals of its heartbeat
+// intervals or its status topic says it is offline, and every change is published as a
+// presence event.
+type PresenceService struct {
+	MqttClient  mqtt.MQTTClient
+	KafkaClient *kafka.KafkaClient // nil without a Kafka topic, then events only go to MQTT
+	DBClient    database.DB
+	MqttTopic   string // events are published retained on <MqttTopic>/<device ID>
+	KafkaTopic  string // events are keyed by device ID
+	QOS         int
+
+	Interval        time.Duration            // default heartbeat interval
+	MissedIntervals int                      // intervals without a heartbeat before a device is offline
+	DeviceIntervals map[string]time.Duration // interval by device ID, overrides the group interval
+	GroupIntervals  map[string]time.Duration // interval by the value of the device's GroupLabel
+	GroupLabel      string                   // device label naming the group
+
+	Logger *logrus.Logger
+
+	mu     sync.RWMutex
+	groups map[string]string // device ID -> group
+}
+
+// NewPresenceService creates a new instance of PresenceService
+func NewPresenceService(mqttClient mqtt.MQTTClient, kafkaClient *kafka.KafkaClient, dbClient database.DB, mqttTopic, kafkaTopic string, qos int, interval time.Duration, missedIntervals int, deviceIntervals, groupIntervals map[string]time.Duration, groupLabel string, logger *logrus.Logger) *PresenceService {
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	if missedIntervals <= 0 {
+		missedIntervals = 3
+	}
+	return &PresenceService{
+		MqttClient:      mqttClient,
+		KafkaClient:     kafkaClient,
+		DBClient:        dbClient,
+		MqttTopic:       mqttTopic,
+		KafkaTopic:      kafkaTopic,
+		QOS:             qos,
+		Interval:        interval,
+		MissedIntervals: missedIntervals,
+		DeviceIntervals: deviceIntervals,
+		GroupIntervals:  groupIntervals,
+		GroupLabel:      groupLabel,
+		Logger:          logger,
+		groups:          make(map[string]string),
+	}
+}
+
+// Start loads the device groups and starts the sweeper that marks devices offline. Groups are
+// reloaded every refreshInterval.
+func (p *PresenceService) Start(sweepInterval, refreshInterval time.Duration) error {
+	if err := p.reloadGroups(); err != nil {
+		return err
+	}
+
+	if sweepInterval <= 0 {
+		sweepInterval = 10 * time.Second
+	}
+	if refreshInterval <= 0 {
+		refreshInterval = time.Minute
+	}
+	go func() {
+		sweep := time.NewTicker(sweepInterval)
+		defer sweep.Stop()
+		refresh := time.NewTicker(refreshInterval)
+		defer refresh.Stop()
+		for {
+			select {
+			case <-sweep.C:
+				p.sweep()
+			case <-refresh.C:
+				if err := p.reloadGroups(); err != nil {
+					p.Logger.WithError(err).Error("Failed to reload device groups")
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Seen records a heartbeat from the device and publishes an event if it came online
+func (p *PresenceService) Seen(deviceID string, at time.Time) {
+	p.SeenAll(map[string]time.Time{deviceID: at})
+}
+
+// SeenAll records the latest heartbeat of each device in one statement and publishes an event
+// for every device that came online
+func (p *PresenceService) SeenAll(seen map[string]time.Time) {
+	if len(seen) == 0 {
+		return
+	}
+
+	devices := make([]models.DeviceSeen, 0, len(seen))
+	for deviceID, at := range seen {
+		devices = append(devices, models.DeviceSeen{DeviceID: deviceID, SeenAt: at, Interval: p.interval(deviceID)})
+	}
+
+	statuses, err := p.DBClient.MarkDevicesSeen(devices)
+	if err != nil {
+		p.Logger.WithError(err).Errorf("Failed to update presence of %d devices", len(devices))
+		return
+	}
+	for i := range statuses {
+		p.publish(&statuses[i])
+	}
+}
+
+// Disconnected marks the device offline without waiting for missed heartbeats and publishes an
+// event if it was online
+func (p *PresenceService) Disconnected(deviceID string) {
+	status, changed, err := p.DBClient.MarkDeviceOffline(deviceID)
+	if err != nil {
+		p.Logger.WithError(err).Errorf("Failed to update presence of device: %s", deviceID)
+		return
+	}
+	if changed {
+		p.publish(status)
+	}
+}
+
+// Snapshot counts the registered devices by presence and lists the page of them the filter
+// selects. Presence is read from device_status, see ListDevicePresence.
+func (p *PresenceService) Snapshot(filter models.PresenceFilter) (*models.PresenceSnapshot, error) {
+	counts, devices, err := p.DBClient.ListDevicePresence(filter, p.MissedIntervals, p.Interval)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list device presence: %w", err)
+	}
+
+	snapshot := &models.PresenceSnapshot{
+		Online:    counts[constants.PRESENCE_ONLINE],
+		Offline:   counts[constants.PRESENCE_OFFLINE],
+		NeverSeen: counts[constants.PRESENCE_NEVER_SEEN],
+		Limit:     filter.Limit,
+		Offset:    filter.Offset,
+		Devices:   devices,
+	}
+	snapshot.Total = snapshot.Online + snapshot.Offline + snapshot.NeverSeen
+	if snapshot.Devices == nil {
+		snapshot.Devices = []models.DevicePresence{}
+	}
+	return snapshot, nil
+}
+
+// interval returns the heartbeat interval expected from the device
+func (p *PresenceService) interval(deviceID string) time.Duration {
+	if interval, ok := p.DeviceIntervals[deviceID]; ok {
+		return interval
+	}
+
+	p.mu.RLock()
+	group, ok := p.groups[deviceID]
+	p.mu.RUnlock()
+	if ok {
+		if interval, ok := p.GroupIntervals[group]; ok {
+			return interval
+		}
+	}
+	return p.Interval
+}
+
+// sweep marks devices that stopped sending heartbeats offline
+func (p *PresenceService) sweep() {
+	statuses, err := p.DBClient.MarkOfflineDevices(p.MissedIntervals)
+	if err != nil {
+		p.Logger.WithError(err).Error("Failed to mark devices offline")
+		return
+	}
+	for i := range statuses {
+		p.publish(&statuses[i])
+	}
+}
+
+func (p *PresenceService) reloadGroups() error {
+	if p.GroupLabel == "" || len(p.GroupIntervals) == 0 {
+		return nil
+	}
+
+	groups, err := p.DBClient.ListDeviceGroups(p.GroupLabel)
+	if err != nil {
+		return fmt.Errorf("failed to load device groups: %w", err)
+	}
+
+	p.mu.Lock()
+	p.groups = groups
+	p.mu.Unlock()
+	return nil
+}
+
+// publish announces the device's new state. The state is already saved, so failures are only
+// logged; the retained MQTT message is corrected by the next change.
+func (p *PresenceService) publish(status *models.DeviceStatus) {
+	payload, err := json.Marshal(models.PresenceEvent{
+		Version:   constants.PRESENCE_EVENT_VERSION,
+		DeviceID:  status.DeviceID,
+		State:     status.State,
+		LastSeen:  status.LastSeen,
+		Timestamp: status.StateSince,
+	})
+	if err != nil {
+		p.Logger.WithError(err).Error("Failed to marshal presence event")
+		return
+	}
+
+	topic := fmt.Sprintf("%s/%s", p.MqttTopic, status.DeviceID)
+	token := p.MqttClient.Publish(topic, byte(p.QOS), true, payload)
+	token.Wait()
+	if err := token.Error(); err != nil {
+		p.Logger.WithError(err).Errorf("Failed to publish presence event for device: %s", status.DeviceID)
+	}
+
+	if p.KafkaClient != nil && p.KafkaTopic != "" {
+		if err := p.KafkaClient.PublishMessage(p.KafkaTopic, status.DeviceID, payload); err != nil {
+			p.Logger.WithError(err).Errorf("Failed to produce presence event for device: %s", status.DeviceID)
+		}
+	}
+
+	p.Logger.Infof("Device %s is now %s", status.DeviceID, status.State)
+}
@@ -0,0 +1,132 @@
+package services
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/benmeehan/iot-heartbeat-service/internal/database"
+	"github.com/benmeehan/iot-heartbeat-service/internal/models"
+	"github.com/sirupsen/logrus"
+)
+
+// QuarantineWriter takes quarantined heartbeats off the message callbacks and writes them in
+// batches. Unlike heartbeats they never block the callback: when the queue is full they are
+// dropped and counted, so a flood of data from unknown devices can't hold back the heartbeats
+// of registered ones.
+type QuarantineWriter struct {
+	DBClient      database.DB
+	BatchSize     int
+	FlushInterval time.Duration
+	Logger        *logrus.Logger
+
+	queue   chan models.QuarantinedHeartbeat
+	done    chan struct{}
+	dropped atomic.Int64
+
+	mu     sync.RWMutex // held for reading while enqueuing, so Close can't close the queue under a sender
+	closed bool
+}
+
+// NewQuarantineWriter creates a new instance of QuarantineWriter
+func NewQuarantineWriter(dbClient database.DB, queueSize, batchSize int, flushInterval time.Duration, logger *logrus.Logger) *QuarantineWriter {
+	if batchSize <= 0 {
+		batchSize = 500
+	}
+	if batchSize > maxBatchSize {
+		batchSize = maxBatchSize
+	}
+	if queueSize < batchSize {
+		queueSize = batchSize
+	}
+	if flushInterval <= 0 {
+		flushInterval = time.Second
+	}
+	return &QuarantineWriter{
+		DBClient:      dbClient,
+		BatchSize:     batchSize,
+		FlushInterval: flushInterval,
+		Logger:        logger,
+		queue:         make(chan models.QuarantinedHeartbeat, queueSize),
+		done:          make(chan struct{}),
+	}
+}
+
+// Start starts the writer
+func (q *QuarantineWriter) Start() {
+	go q.work()
+}
+
+// Enqueue queues a quarantined heartbeat for writing. It returns ErrQueueFull without waiting
+// if there is no room.
+func (q *QuarantineWriter) Enqueue(heartbeat models.QuarantinedHeartbeat) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return ErrQueueFull
+	}
+
+	select {
+	case q.queue <- heartbeat:
+		return nil
+	default:
+		q.dropped.Add(1)
+		return ErrQueueFull
+	}
+}
+
+// Close stops accepting quarantined heartbeats and waits until the queued ones are written
+func (q *QuarantineWriter) Close() {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return
+	}
+	q.closed = true
+	close(q.queue)
+	q.mu.Unlock()
+
+	<-q.done
+}
+
+// work collects quarantined heartbeats into a batch and flushes it when it is full, when the
+// flush interval has passed and when the queue is closed
+func (q *QuarantineWriter) work() {
+	defer close(q.done)
+
+	batch := make([]models.QuarantinedHeartbeat, 0, q.BatchSize)
+	ticker := time.NewTicker(q.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case heartbeat, ok := <-q.queue:
+			if !ok {
+				q.flush(batch)
+				return
+			}
+			batch = append(batch, heartbeat)
+			if len(batch) >= q.BatchSize {
+				q.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			q.flush(batch)
+			batch = batch[:0]
+			if dropped := q.dropped.Swap(0); dropped > 0 {
+				q.Logger.Warnf("Dropped %d quarantined heartbeats because the queue was full", dropped)
+			}
+		}
+	}
+}
+
+// flush writes the batch. Quarantined data is kept for inspection only, so a failed batch is
+// logged and dropped.
+func (q *QuarantineWriter) flush(batch []models.QuarantinedHeartbeat) {
+	if len(batch) == 0 {
+		return
+	}
+	if err := q.DBClient.InsertQuarantinedHeartbeats(batch); err != nil {
+		q.Logger.WithError(err).Errorf("Error quarantining %d heartbeats", len(batch))
+	}
+}
@@ -1,69 +1,183 @@
-package kafka
-
-import (
-	"fmt"
-
-	"github.com/confluentinc/confluent-kafka-go/kafka"
-	"github.com/sirupsen/logrus"
-)
-
-type KafkaClient struct {
-	Consumer *kafka.Consumer
-	Logger   *logrus.Logger
-}
-
-// NewKafkaClient creates a new Kafka consumer
-func NewKafkaClient(securityProtocol, CACert, cert, key, mechanism, username, password string, brokers []string, groupID string, logger *logrus.Logger) (*KafkaClient, error) {
-	// Kafka consumer configuration
-	kafkaConfig := &kafka.ConfigMap{
-		"bootstrap.servers": brokers[0],
-		"group.id":          groupID,
-		"auto.offset.reset": "earliest", // Start reading at the earliest message
-		// Uncomment the following lines to enable SSL and SASL
-		// "security.protocol": securityProtocol,
-		// "ssl.ca.location":          CACert,
-		// "ssl.certificate.location": cert,
-		// "ssl.key.location":         key,
-		// "sasl.mechanism":           mechanism,
-		// "sasl.username":            username,
-		// "sasl.password":            password,
-	}
-
-	// Create a new consumer
-	consumer, err := kafka.NewConsumer(kafkaConfig)
-	if err != nil {
-		return nil, err
-	}
-
-	logger.Info("Kafka consumer created successfully")
-
-	return &KafkaClient{Consumer: consumer, Logger: logger}, nil
-}
-
-// Subscribe subscribes to a Kafka topic and starts polling messages with a handler function
-func (k *KafkaClient) Subscribe(topic string, handler func(*kafka.Message)) error {
-	err := k.Consumer.Subscribe(topic, nil)
-	if err != nil {
-		return fmt.Errorf("failed to subscribe to topic %s: %w", topic, err)
-	}
-	k.Logger.Infof("Subscribed to topic: %s", topic)
-
-	// Start a goroutine to poll messages and invoke the handler
-	go func() {
-		for {
-			message, err := k.Consumer.ReadMessage(-1) // -1 means blocking until a message is available
-			if err == nil {
-				handler(message)
-			} else {
-				k.Logger.Errorf("Error while receiving message: %v", err)
-			}
-		}
-	}()
-	return nil
-}
-
-// Close cleans up the Kafka consumer
-func (k *KafkaClient) Close() {
-	k.Consumer.Close()
-	k.Logger.Info("Kafka consumer closed")
-}
+package kafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/sirupsen/logrus"
+)
+
+type KafkaClient struct {
+	Consumer *kafka.Consumer
+	Producer *kafka.Producer
+	Logger   *logrus.Logger
+
+	mu       sync.RWMutex
+	handlers map[string]func(*kafka.Message)
+	polling  bool
+}
+
+// NewKafkaClient creates a new Kafka producer and, when a group ID is given, a consumer
+func NewKafkaClient(securityProtocol, CACert, cert, key, mechanism, username, password string, brokers []string, groupID string, logger *logrus.Logger) (*KafkaClient, error) {
+	// The producer publishes presence events
+	producer, err := kafka.NewProducer(clientConfig(brokers, securityProtocol, CACert, cert, key, mechanism, username, password))
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("Kafka producer created successfully")
+
+	client := &KafkaClient{Producer: producer, Logger: logger, handlers: make(map[string]func(*kafka.Message))}
+	if groupID == "" {
+		return client, nil
+	}
+
+	// Kafka consumer configuration
+	kafkaConfig := clientConfig(brokers, securityProtocol, CACert, cert, key, mechanism, username, password)
+	kafkaConfig.SetKey("group.id", groupID)
+	kafkaConfig.SetKey("auto.offset.reset", "earliest") // Start reading at the earliest message
+
+	// Create a new consumer
+	consumer, err := kafka.NewConsumer(kafkaConfig)
+	if err != nil {
+		producer.Close()
+		return nil, err
+	}
+	client.Consumer = consumer
+
+	logger.Info("Kafka consumer created successfully")
+
+	return client, nil
+}
+
+// Subscribe subscribes to a Kafka topic and starts polling messages with a handler function.
+// It can be called for several topics; each message is dispatched to the handler of its topic.
+func (k *KafkaClient) Subscribe(topic string, handler func(*kafka.Message)) error {
+	if k.Consumer == nil {
+		return fmt.Errorf("no consumer group configured, can't subscribe to topic %s", topic)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.handlers[topic] = handler
+	topics := make([]string, 0, len(k.handlers))
+	for t := range k.handlers {
+		topics = append(topics, t)
+	}
+
+	// The consumer's subscription is replaced, so it always lists every topic
+	if err := k.Consumer.SubscribeTopics(topics, nil); err != nil {
+		delete(k.handlers, topic)
+		return fmt.Errorf("failed to subscribe to topic %s: %w", topic, err)
+	}
+	k.Logger.Infof("Subscribed to topic: %s", topic)
+
+	// Start a single goroutine to poll messages and invoke the handlers
+	if !k.polling {
+		k.polling = true
+		go k.poll()
+	}
+	return nil
+}
+
+// poll reads messages and invokes the handler registered for the message's topic
+func (k *KafkaClient) poll() {
+	for {
+		message, err := k.Consumer.ReadMessage(-1) // -1 means blocking until a message is available
+		if err != nil {
+			k.Logger.Errorf("Error while receiving message: %v", err)
+			continue
+		}
+
+		k.mu.RLock()
+		handler, ok := k.handlers[*message.TopicPartition.Topic]
+		k.mu.RUnlock()
+		if ok {
+			handler(message)
+		}
+	}
+}
+
+// PublishMessage publishes a message to a specified Kafka topic. Delivery failures are logged.
+func (k *KafkaClient) PublishMessage(topic string, key string, value []byte) error {
+	message := &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+		Key:            []byte(key),
+		Value:          value,
+	}
+
+	// Produce the message asynchronously
+	deliveryChan := make(chan kafka.Event, 1)
+	if err := k.Producer.Produce(message, deliveryChan); err != nil {
+		return fmt.Errorf("failed to produce message: %w", err)
+	}
+
+	// Wait for delivery report
+	go func() {
+		m := (<-deliveryChan).(*kafka.Message)
+		if m.TopicPartition.Error != nil {
+			k.Logger.Errorf("Delivery failed for message: %v", m.TopicPartition.Error)
+		}
+	}()
+	return nil
+}
+
+// Unwrap returns the original MQTT payload of a message forwarded by the MQTT-Kafka connector,
+// which wraps it as {"payload": ..., "timestamp": ...}, and when the message was received. That
+// is the Kafka timestamp the connector set when it forwarded the message, or else the
+// envelope's timestamp, so time spent in Kafka isn't counted as clock skew. Other messages are
+// returned unchanged.
+func Unwrap(msg *kafka.Message) ([]byte, time.Time) {
+	payload, receivedAt := msg.Value, time.Now()
+
+	var envelope struct {
+		Payload   *string `json:"payload"`
+		Timestamp int64   `json:"timestamp"`
+	}
+	if json.Unmarshal(msg.Value, &envelope) == nil && envelope.Payload != nil {
+		payload = []byte(*envelope.Payload)
+		if envelope.Timestamp > 0 {
+			receivedAt = time.Unix(envelope.Timestamp, 0)
+		}
+	}
+	if msg.TimestampType != kafka.TimestampNotAvailable && !msg.Timestamp.IsZero() {
+		receivedAt = msg.Timestamp
+	}
+	return payload, receivedAt
+}
+
+// Close cleans up the Kafka consumer and producer
+func (k *KafkaClient) Close() {
+	if k.Consumer != nil {
+		k.Consumer.Close()
+	}
+	k.Producer.Flush(15 * 1000)
+	k.Producer.Close()
+	k.Logger.Info("Kafka client closed")
+}
+
+// clientConfig returns the connection settings of the consumer and the producer. Security
+// settings that are not configured are left out.
+func clientConfig(brokers []string, securityProtocol, caCert, cert, key, mechanism, username, password string) *kafka.ConfigMap {
+	config := &kafka.ConfigMap{"bootstrap.servers": strings.Join(brokers, ",")}
+	settings := map[string]string{
+		"security.protocol":        securityProtocol,
+		"ssl.ca.location":          caCert,
+		"ssl.certificate.location": cert,
+		"ssl.key.location":         key,
+		"sasl.mechanism":           mechanism,
+		"sasl.username":            username,
+		"sasl.password":            password,
+	}
+	for name, value := range settings {
+		if value != "" {
+			config.SetKey(name, value)
+		}
+	}
+	return config
+}
@@ -0,0 +1,43 @@
+package token
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+)
+
+// Errors returned when a token can't be trusted
+var (
+	ErrMalformed    = errors.New("token is malformed")
+	ErrBadSignature = errors.New("token signature is invalid")
+	ErrExpired      = errors.New("token has expired")
+	ErrWrongSubject = errors.New("token was issued to a different device")
+)
+
+// Algorithm is the only JWS algorithm device tokens are signed with
+const Algorithm = "EdDSA"
+
+// Claims are the JWT claims of a device access token. The subject is the device ID.
+type Claims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	ID        string `json:"jti"`
+}
+
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+var encoding = base64.RawURLEncoding
+
+// KeyID derives the key ID put in the token header from the public key
+func KeyID(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,70 @@
+package services
+
+import (
+	"fmt"
+
+	"github.com/benmeehan/mqtt-kafka-connector-service/pkg/kafka"
+	"github.com/benmeehan/mqtt-kafka-connector-service/pkg/mqtt"
+	KAFKA "github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/sirupsen/logrus"
+)
+
+// ReverseMapping maps a Kafka topic to the MQTT topic its messages are delivered on
+type ReverseMapping struct {
+	KafkaTopic string
+	MQTTTopic  string
+	Retained   bool
+}
+
+// KafkaMqttConnector delivers Kafka messages to MQTT. A message goes to <MQTTTopic>/<key>,
+// so a response keyed by client ID reaches that client's response topic.
+type KafkaMqttConnector struct {
+	mqttService  *mqtt.MqttService
+	kafkaService *kafka.KafkaClient
+	Mappings     []ReverseMapping
+	QOS          int
+	Logger       *logrus.Logger
+}
+
+// NewKafkaMqttConnector creates a new instance of KafkaMqttConnector
+func NewKafkaMqttConnector(mqttService *mqtt.MqttService, kafkaService *kafka.KafkaClient, mappings []ReverseMapping, qos int, logger *logrus.Logger) *KafkaMqttConnector {
+	return &KafkaMqttConnector{
+		mqttService:  mqttService,
+		kafkaService: kafkaService,
+		Mappings:     mappings,
+		QOS:          qos,
+		Logger:       logger,
+	}
+}
+
+// Start begins consuming the Kafka topics and publishing messages to MQTT
+func (c *KafkaMqttConnector) Start() error {
+	for _, mapping := range c.Mappings {
+		mapping := mapping
+		kafkaCallback := func(msg *KAFKA.Message) {
+			c.handleKafkaMessage(msg, mapping)
+		}
+
+		if err := c.kafkaService.Subscribe(mapping.KafkaTopic, kafkaCallback); err != nil {
+			return fmt.Errorf("failed to subscribe to Kafka topic %s: %w", mapping.KafkaTopic, err)
+		}
+	}
+
+	return nil
+}
+
+// handleKafkaMessage publishes the message value unchanged on the mapped MQTT topic
+func (c *KafkaMqttConnector) handleKafkaMessage(msg *KAFKA.Message, mapping ReverseMapping) {
+	mqttTopic := mapping.MQTTTopic
+	if len(msg.Key) > 0 {
+		mqttTopic = fmt.Sprintf("%s/%s", mapping.MQTTTopic, msg.Key)
+	}
+
+	token := c.mqttService.Publish(mqttTopic, byte(c.QOS), mapping.Retained, msg.Value)
+	token.Wait()
+	if err := token.Error(); err != nil {
+		c.Logger.WithError(err).Errorf("Failed to publish message to MQTT topic %s", mqttTopic)
+		return
+	}
+	c.Logger.Infof("Published message from Kafka topic %s to MQTT topic %s", mapping.KafkaTopic, mqttTopic)
+}
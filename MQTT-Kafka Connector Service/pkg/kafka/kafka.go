@@ -1,74 +1,165 @@
-package kafka
-
-import (
-	"fmt"
-
-	"github.com/confluentinc/confluent-kafka-go/kafka"
-	"github.com/sirupsen/logrus"
-)
-
-type KafkaClient struct {
-	Producer *kafka.Producer
-	Logger   *logrus.Logger
-}
-
-func NewKafkaClient(securityProtocol, CACert, cert, key, mechanism, username, password string, brokers []string, logger *logrus.Logger) (*KafkaClient, error) {
-	// Kafka producer configuration
-	kafkaConfig := &kafka.ConfigMap{
-		"bootstrap.servers": brokers[0],
-		// "security.protocol": securityProtocol,
-		// "ssl.ca.location":          CACert,
-		// "ssl.certificate.location": cert,
-		// "ssl.key.location":         key,
-		// "sasl.mechanism":           mechanism,
-		// "sasl.username":            username,
-		// "sasl.password":            password,
-	}
-
-	// Create a new producer
-	producer, err := kafka.NewProducer(kafkaConfig)
-	if err != nil {
-		return nil, err
-	}
-
-	logger.Info("Kafka producer created successfully")
-
-	return &KafkaClient{Producer: producer, Logger: logger}, nil
-}
-
-// PublishMessage publishes a message to a specified Kafka topic
-func (k *KafkaClient) PublishMessage(topic string, key string, value []byte) error {
-	// Create a new message
-	message := &kafka.Message{
-		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
-		Key:            []byte(key),
-		Value:          value,
-	}
-
-	// Produce the message asynchronously
-	deliveryChan := make(chan kafka.Event)
-
-	err := k.Producer.Produce(message, deliveryChan)
-	if err != nil {
-		return fmt.Errorf("failed to produce message: %w", err)
-	}
-
-	// Wait for delivery report
-	go func() {
-		e := <-deliveryChan
-		m := e.(*kafka.Message)
-		if m.TopicPartition.Error != nil {
-			k.Logger.Errorf("Delivery failed for message: %v", m.TopicPartition.Error)
-		} else {
-			k.Logger.Infof("Message delivered to %v [%v] at offset %v\n", *m.TopicPartition.Topic, m.TopicPartition.Partition, m.TopicPartition.Offset)
-		}
-	}()
-
-	return nil
-}
-
-// Close cleans up the Kafka producer
-func (k *KafkaClient) Close() {
-	k.Producer.Flush(15 * 1000)
-	k.Producer.Close()
-}
+package kafka
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/sirupsen/logrus"
+)
+
+type KafkaClient struct {
+	Producer *kafka.Producer
+	Consumer *kafka.Consumer
+	Logger   *logrus.Logger
+
+	mu       sync.RWMutex
+	handlers map[string]func(*kafka.Message)
+	polling  bool
+}
+
+// NewKafkaClient creates a new Kafka producer and, when a group ID is given, a consumer for
+// the reverse mappings
+func NewKafkaClient(securityProtocol, CACert, cert, key, mechanism, username, password string, brokers []string, groupID string, logger *logrus.Logger) (*KafkaClient, error) {
+	// Kafka producer configuration
+	kafkaConfig := clientConfig(brokers, securityProtocol, CACert, cert, key, mechanism, username, password)
+
+	// Create a new producer
+	producer, err := kafka.NewProducer(kafkaConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("Kafka producer created successfully")
+
+	client := &KafkaClient{Producer: producer, Logger: logger, handlers: make(map[string]func(*kafka.Message))}
+	if groupID == "" {
+		return client, nil
+	}
+
+	// Kafka consumer configuration
+	consumerConfig := clientConfig(brokers, securityProtocol, CACert, cert, key, mechanism, username, password)
+	consumerConfig.SetKey("group.id", groupID)
+	consumerConfig.SetKey("auto.offset.reset", "earliest") // Start reading at the earliest message
+	consumer, err := kafka.NewConsumer(consumerConfig)
+	if err != nil {
+		producer.Close()
+		return nil, err
+	}
+	client.Consumer = consumer
+
+	logger.Info("Kafka consumer created successfully")
+
+	return client, nil
+}
+
+// Subscribe subscribes to a Kafka topic and starts polling messages with a handler function.
+// It can be called for several topics; each message is dispatched to the handler of its topic.
+func (k *KafkaClient) Subscribe(topic string, handler func(*kafka.Message)) error {
+	if k.Consumer == nil {
+		return fmt.Errorf("no consumer group configured, can't subscribe to topic %s", topic)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.handlers[topic] = handler
+	topics := make([]string, 0, len(k.handlers))
+	for t := range k.handlers {
+		topics = append(topics, t)
+	}
+
+	// The consumer's subscription is replaced, so it always lists every topic
+	if err := k.Consumer.SubscribeTopics(topics, nil); err != nil {
+		delete(k.handlers, topic)
+		return fmt.Errorf("failed to subscribe to topic %s: %w", topic, err)
+	}
+	k.Logger.Infof("Subscribed to Kafka topic: %s", topic)
+
+	// Start a single goroutine to poll messages and invoke the handlers
+	if !k.polling {
+		k.polling = true
+		go k.poll()
+	}
+	return nil
+}
+
+// poll reads messages and invokes the handler registered for the message's topic
+func (k *KafkaClient) poll() {
+	for {
+		message, err := k.Consumer.ReadMessage(-1) // -1 means blocking until a message is available
+		if err != nil {
+			k.Logger.Errorf("Error while receiving message: %v", err)
+			continue
+		}
+
+		k.mu.RLock()
+		handler, ok := k.handlers[*message.TopicPartition.Topic]
+		k.mu.RUnlock()
+		if ok {
+			handler(message)
+		}
+	}
+}
+
+// PublishMessage publishes a message to a specified Kafka topic
+func (k *KafkaClient) PublishMessage(topic string, key string, value []byte) error {
+	// Create a new message
+	message := &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+		Key:            []byte(key),
+		Value:          value,
+	}
+
+	// Produce the message asynchronously
+	deliveryChan := make(chan kafka.Event)
+
+	err := k.Producer.Produce(message, deliveryChan)
+	if err != nil {
+		return fmt.Errorf("failed to produce message: %w", err)
+	}
+
+	// Wait for delivery report
+	go func() {
+		e := <-deliveryChan
+		m := e.(*kafka.Message)
+		if m.TopicPartition.Error != nil {
+			k.Logger.Errorf("Delivery failed for message: %v", m.TopicPartition.Error)
+		} else {
+			k.Logger.Infof("Message delivered to %v [%v] at offset %v\n", *m.TopicPartition.Topic, m.TopicPartition.Partition, m.TopicPartition.Offset)
+		}
+	}()
+
+	return nil
+}
+
+// Close cleans up the Kafka consumer and producer
+func (k *KafkaClient) Close() {
+	if k.Consumer != nil {
+		k.Consumer.Close()
+	}
+	k.Producer.Flush(15 * 1000)
+	k.Producer.Close()
+}
+
+// clientConfig returns the connection settings of the consumer and the producer. Security
+// settings that are not configured are left out.
+func clientConfig(brokers []string, securityProtocol, caCert, cert, key, mechanism, username, password string) *kafka.ConfigMap {
+	config := &kafka.ConfigMap{"bootstrap.servers": strings.Join(brokers, ",")}
+	settings := map[string]string{
+		"security.protocol":        securityProtocol,
+		"ssl.ca.location":          caCert,
+		"ssl.certificate.location": cert,
+		"ssl.key.location":         key,
+		"sasl.mechanism":           mechanism,
+		"sasl.username":            username,
+		"sasl.password":            password,
+	}
+	for name, value := range settings {
+		if value != "" {
+			config.SetKey(name, value)
+		}
+	}
+	return config
+}
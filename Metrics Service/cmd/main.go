@@ -1,82 +1,230 @@
-package main
-
-import (
-	"fmt"
-	"os"
-
-	"github.com/benmeehan/iot-metrics-service/internal/constants"
-	"github.com/benmeehan/iot-metrics-service/internal/database"
-	"github.com/benmeehan/iot-metrics-service/internal/services"
-	"github.com/benmeehan/iot-metrics-service/internal/utils"
-	"github.com/benmeehan/iot-metrics-service/pkg/kafka"
-	"github.com/benmeehan/iot-metrics-service/pkg/mqtt"
-	"github.com/google/uuid"
-
-	"github.com/sirupsen/logrus"
-)
-
-func main() {
-	// Set up structured logging with JSON output
-	var log = &logrus.Logger{
-		Out:       os.Stdout,
-		Formatter: new(logrus.JSONFormatter),
-		Hooks:     make(logrus.LevelHooks),
-		Level:     logrus.InfoLevel,
-	}
-
-	// Load configuration from file
-	config, err := utils.LoadConfig("config/config.yaml", log)
-	if err != nil {
-		logrus.WithError(err).Fatal("Failed to load configuration")
-	}
-
-	// Generate a unique MQTT Client ID by appending a UUID
-	config.MQTT.ClientID = config.MQTT.ClientID + "-" + uuid.New().String()
-	logrus.Infof("Using MQTT Client ID: %s", config.MQTT.ClientID)
-
-	// Initialize the shared MQTT connection
-	mqttClient := mqtt.NewMqttService(log)
-	err = mqttClient.Initialize(config.MQTT.Broker, config.MQTT.ClientID, config.MQTT.TLS.CACert)
-	if err != nil {
-		logrus.WithError(err).Fatal("Failed to initialize MQTT connection")
-	}
-
-	// Initialize the database connection
-	dBClient := database.NewDatabase(log)
-	connStr := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
-		config.DB.Host, config.DB.Port, config.DB.User, config.DB.Password, config.DB.Name, config.DB.SSLMode)
-
-	if err := dBClient.Connect(connStr); err != nil {
-		logrus.WithError(err).Fatal("Failed to initialize database connection")
-	}
-	defer dBClient.Close()
-
-	var kafkaClient *kafka.KafkaClient
-
-	// Initialize Kafka client only if the mode is queue
-	if config.Service.Mode == constants.QUEUE_MODE {
-		kafkaClient, err = kafka.NewKafkaClient(
-			config.Kafka.SecurityProtocol,
-			config.Kafka.SSL.CACert,
-			config.Kafka.SSL.Cert,
-			config.Kafka.SSL.Key,
-			config.Kafka.SASL.Mechanism,
-			config.Kafka.SASL.Username,
-			config.Kafka.SASL.Password,
-			config.Kafka.Brokers,
-			config.Kafka.GroupID,
-			log,
-		)
-		if err != nil {
-			log.WithError(err).Fatal("Failed to initialize Kafka Client")
-		}
-	}
-
-	// Start metrics service and listen for device metrics
-	metricsService := services.NewMetricsService(config.Service.Mode, mqttClient, kafkaClient, dBClient, config.MQTT.Topic, config.MQTT.QOS, log)
-	metricsService.ListenForDeviceMetrics()
-
-	// Block the main thread to keep services running
-	logrus.Info("Metric service is running...")
-	select {}
-}
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/benmeehan/iot-metrics-service/internal/api"
+	"github.com/benmeehan/iot-metrics-service/internal/constants"
+	"github.com/benmeehan/iot-metrics-service/internal/database"
+	"github.com/benmeehan/iot-metrics-service/internal/services"
+	"github.com/benmeehan/iot-metrics-service/internal/utils"
+	"github.com/benmeehan/iot-metrics-service/pkg/kafka"
+	"github.com/benmeehan/iot-metrics-service/pkg/mqtt"
+	"github.com/benmeehan/iot-metrics-service/pkg/token"
+	"github.com/google/uuid"
+
+	"github.com/sirupsen/logrus"
+)
+
+func main() {
+	// Set up structured logging with JSON output
+	var log = &logrus.Logger{
+		Out:       os.Stdout,
+		Formatter: new(logrus.JSONFormatter),
+		Hooks:     make(logrus.LevelHooks),
+		Level:     logrus.InfoLevel,
+	}
+
+	// Load configuration from file
+	config, err := utils.LoadConfig("config/config.yaml", log)
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to load configuration")
+	}
+
+	connStr := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		config.DB.Host, config.DB.Port, config.DB.User, config.DB.Password, config.DB.Name, config.DB.SSLMode)
+
+	// "migrate up|down [steps]|status" manages the database schema and exits
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrate(connStr, os.Args[2:], log)
+		return
+	}
+
+	// Generate a unique MQTT Client ID by appending a UUID
+	config.MQTT.ClientID = config.MQTT.ClientID + "-" + uuid.New().String()
+	logrus.Infof("Using MQTT Client ID: %s", config.MQTT.ClientID)
+
+	// Initialize the shared MQTT connection
+	mqttClient := mqtt.NewMqttService(log)
+	err = mqttClient.Initialize(config.MQTT.Broker, config.MQTT.ClientID, config.MQTT.TLS.CACert)
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to initialize MQTT connection")
+	}
+
+	// Initialize the database connection
+	dBClient := database.NewDatabase(log)
+	if err := dBClient.Connect(connStr); err != nil {
+		logrus.WithError(err).Fatal("Failed to initialize database connection")
+	}
+	defer dBClient.Close()
+
+	// Apply chunking, compression and retention to the hypertables
+	for table, policy := range config.Storage {
+		if err := dBClient.ApplyStoragePolicy(table, policy); err != nil {
+			log.WithError(err).Fatal("Failed to apply storage policy")
+		}
+	}
+
+	// Keep the rollups for as long as configured, independent of the raw samples
+	rollupService := services.NewRollupService(dBClient, config.Rollups.MaxPoints, config.Rollups.Retention, log)
+	if err := rollupService.ApplyRetention(); err != nil {
+		log.WithError(err).Fatal("Failed to apply rollup retention")
+	}
+
+	// The rollups are created empty, materialize the samples stored before them
+	rawRetention := make(map[string]time.Duration)
+	for table, policy := range config.Storage {
+		rawRetention[table] = policy.DropAfter
+	}
+	go rollupService.Backfill(rawRetention)
+
+	var kafkaClient *kafka.KafkaClient
+
+	// Initialize Kafka client only if the mode is queue
+	if config.Service.Mode == constants.QUEUE_MODE {
+		kafkaClient, err = kafka.NewKafkaClient(
+			config.Kafka.SecurityProtocol,
+			config.Kafka.SSL.CACert,
+			config.Kafka.SSL.Cert,
+			config.Kafka.SSL.Key,
+			config.Kafka.SASL.Mechanism,
+			config.Kafka.SASL.Username,
+			config.Kafka.SASL.Password,
+			config.Kafka.Brokers,
+			config.Kafka.GroupID,
+			log,
+		)
+		if err != nil {
+			log.WithError(err).Fatal("Failed to initialize Kafka Client")
+		}
+	}
+
+	// Access tokens are only checked when they are required
+	var tokenVerifier *token.Verifier
+	if config.Auth.RequireToken {
+		tokenVerifier, err = token.LoadVerifier(config.Auth.PublicKeyFiles, config.Auth.Issuer, config.Auth.Leeway)
+		if err != nil {
+			log.WithError(err).Fatal("Failed to load token public keys")
+		}
+	}
+
+	// Track suspended and decommissioned devices
+	deviceEventsTopic := config.MQTT.DeviceEventsTopic
+	if config.Service.Mode == constants.QUEUE_MODE {
+		deviceEventsTopic = config.Kafka.DeviceEventsTopic
+	}
+	deviceRegistry, err := services.NewDeviceRegistry(config.Service.Mode, mqttClient, kafkaClient, dBClient, deviceEventsTopic, config.MQTT.QOS, config.Devices.BlockedAction, log)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to create device registry")
+	}
+	if err := deviceRegistry.Start(config.Devices.RefreshInterval); err != nil {
+		log.WithError(err).Fatal("Failed to start device registry")
+	}
+
+	// Write metrics in batches off the message callbacks, with rates derived from the counters
+	rates := services.NewRateTracker(dBClient, config.Rates.MaxGap, log)
+	batcher := services.NewMetricsBatcher(dBClient, rates, config.Ingest.QueueSize, config.Ingest.Workers, config.Ingest.BatchSize,
+		config.Ingest.FlushInterval, config.Ingest.EnqueueTimeout, log)
+	batcher.Start()
+
+	// Start metrics service and listen for device metrics
+	metricsService := services.NewMetricsService(config.Service.Mode, mqttClient, kafkaClient, dBClient, deviceRegistry, batcher, services.NewClockCheck(config.Clock.MaxSkew, config.Clock.CorrectSkewed), tokenVerifier, config.MQTT.Topic, config.MQTT.QOS, log)
+	metricsService.ListenForDeviceMetrics()
+
+	// Serve system metrics and top processes from the rollups. The API is left off without a
+	// token.
+	apiToken, err := readToken(config.API.TokenFile)
+	if err != nil {
+		log.WithError(err).Warn("Metrics API is disabled, it needs a token")
+	} else {
+		metricsAPI := api.NewMetricsAPI(rollupService, apiToken, log)
+		metricsAPI.Start(config.API.Address)
+	}
+
+	// Run until the service is stopped, then stop receiving and write the queued metrics
+	logrus.Info("Metric service is running...")
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+
+	log.Info("Shutting down metrics service")
+	mqttClient.Disconnect(250)
+	batcher.Close()
+}
+
+// readToken reads the API token from the file. A missing file or an empty token is an error.
+func readToken(file string) (string, error) {
+	if file == "" {
+		return "", fmt.Errorf("no token file configured")
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", file)
+	}
+	return token, nil
+}
+
+// runMigrate runs the migrate subcommand: "up" applies the pending migrations, "down [steps]"
+// reverts the last one or the given number and "status" lists them all. The service applies
+// its pending migrations at startup as well.
+func runMigrate(connStr string, args []string, log *logrus.Logger) {
+	dBClient := database.NewDatabase(log)
+	if err := dBClient.Open(connStr); err != nil {
+		log.WithError(err).Fatal("Failed to initialize database connection")
+	}
+	defer dBClient.Close()
+
+	migrator, err := dBClient.NewMigrator()
+	if err != nil {
+		log.WithError(err).Fatal("Failed to load migrations")
+	}
+
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	switch command {
+	case "up":
+		applied, err := migrator.Up()
+		if err != nil {
+			log.WithError(err).Fatal("Failed to apply migrations")
+		}
+		log.Infof("Applied %d migrations", applied)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				log.Fatalf("Invalid number of migrations to revert: %s", args[1])
+			}
+		}
+		if err := migrator.Down(steps); err != nil {
+			log.WithError(err).Fatal("Failed to revert migrations")
+		}
+	case "status":
+		statuses, err := migrator.Status()
+		if err != nil {
+			log.WithError(err).Fatal("Failed to read migration status")
+		}
+		for _, status := range statuses {
+			applied := "pending"
+			if status.AppliedAt != nil {
+				applied = "applied " + status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%s\t%s\n", status.Version, status.Name, applied)
+		}
+	default:
+		log.Fatalf("Unknown migrate command %q, use up, down [steps] or status", command)
+	}
+}
@@ -0,0 +1,187 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/benmeehan/iot-metrics-service/internal/constants"
+	"github.com/benmeehan/iot-metrics-service/internal/services"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// Range queried when the request doesn't give one
+const defaultQueryRange = 24 * time.Hour
+
+// Processes returned per bucket
+const (
+	defaultTopProcesses = 5
+	maxTopProcesses     = 50
+)
+
+// MetricsAPI serves the metrics rollups over HTTP
+type MetricsAPI struct {
+	Rollups *services.RollupService
+	Token   string
+	Logger  *logrus.Logger
+}
+
+// NewMetricsAPI creates a new instance of MetricsAPI
+func NewMetricsAPI(rollups *services.RollupService, token string, logger *logrus.Logger) *MetricsAPI {
+	return &MetricsAPI{
+		Rollups: rollups,
+		Token:   token,
+		Logger:  logger,
+	}
+}
+
+// Start serves the metrics API on the given address in the background
+func (a *MetricsAPI) Start(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("GET /devices/{id}/system", a.authorize(a.systemSeries))
+	mux.Handle("GET /devices/{id}/processes", a.authorize(a.processSeries))
+
+	go func() {
+		a.Logger.Infof("Metrics API listening on %s", address)
+		if err := http.ListenAndServe(address, mux); err != nil {
+			a.Logger.WithError(err).Fatal("Metrics API server stopped")
+		}
+	}()
+}
+
+// authorize rejects requests that don't carry the API bearer token
+func (a *MetricsAPI) authorize(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || a.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) != 1 {
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next(w, r)
+	})
+}
+
+// systemSeries returns the device's system metrics. Query parameters: from and to (RFC 3339)
+// and resolution (a duration such as 5m).
+func (a *MetricsAPI) systemSeries(w http.ResponseWriter, r *http.Request) {
+	id, from, to, resolution, ok := seriesQuery(w, r)
+	if !ok {
+		return
+	}
+
+	series, err := a.Rollups.SystemSeries(id, from, to, resolution)
+	if err != nil {
+		a.queryError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, series)
+}
+
+// processSeries returns the device's top processes. Query parameters: those of systemSeries,
+// top and by (cpu, the default, or memory).
+func (a *MetricsAPI) processSeries(w http.ResponseWriter, r *http.Request) {
+	id, from, to, resolution, ok := seriesQuery(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	top := defaultTopProcesses
+	if value := query.Get("top"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxTopProcesses {
+			writeError(w, http.StatusBadRequest, "invalid top, expected 1 to "+strconv.Itoa(maxTopProcesses))
+			return
+		}
+		top = parsed
+	}
+
+	by := query.Get("by")
+	switch by {
+	case "":
+		by = constants.RANK_BY_CPU
+	case constants.RANK_BY_CPU, constants.RANK_BY_MEMORY:
+	default:
+		writeError(w, http.StatusBadRequest, "invalid by, expected cpu or memory")
+		return
+	}
+
+	series, err := a.Rollups.ProcessSeries(id, from, to, resolution, top, by)
+	if err != nil {
+		a.queryError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, series)
+}
+
+// queryError answers a range that is too large for the rollups with a bad request and
+// anything else with an internal error
+func (a *MetricsAPI) queryError(w http.ResponseWriter, err error) {
+	if errors.Is(err, services.ErrRangeTooLarge) {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	a.Logger.WithError(err).Error("Metrics API request failed")
+	writeError(w, http.StatusInternalServerError, "internal error")
+}
+
+// seriesQuery parses the device ID, the RFC 3339 from and to query parameters, which default
+// to the last day, and the optional resolution
+func seriesQuery(w http.ResponseWriter, r *http.Request) (string, time.Time, time.Time, time.Duration, bool) {
+	id := r.PathValue("id")
+	if _, err := uuid.Parse(id); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid device id")
+		return "", time.Time{}, time.Time{}, 0, false
+	}
+	query := r.URL.Query()
+
+	to := time.Now()
+	if value := query.Get("to"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid to, expected RFC 3339")
+			return "", time.Time{}, time.Time{}, 0, false
+		}
+		to = parsed
+	}
+
+	from := to.Add(-defaultQueryRange)
+	if value := query.Get("from"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid from, expected RFC 3339")
+			return "", time.Time{}, time.Time{}, 0, false
+		}
+		from = parsed
+	}
+	if !from.Before(to) {
+		writeError(w, http.StatusBadRequest, "from must be before to")
+		return "", time.Time{}, time.Time{}, 0, false
+	}
+
+	var resolution time.Duration
+	if value := query.Get("resolution"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 {
+			writeError(w, http.StatusBadRequest, "invalid resolution, expected a duration such as 5m")
+			return "", time.Time{}, time.Time{}, 0, false
+		}
+		resolution = parsed
+	}
+	return id, from, to, resolution, true
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -1,4 +1,31 @@
-package constants
-
-const QUEUE_MODE = "queue"
-const MQTT_MODE = "mqtt"
+package constants
+
+const QUEUE_MODE = "queue"
+const MQTT_MODE = "mqtt"
+
+// Device states whose data is not accepted as regular data
+const DEVICE_STATE_SUSPENDED = "suspended"
+const DEVICE_STATE_DECOMMISSIONED = "decommissioned"
+
+// What happens to data from suspended and decommissioned devices
+const BLOCKED_ACTION_DROP = "drop" // discard the data
+const BLOCKED_ACTION_FLAG = "flag" // store the data with the device state in the flag column
+
+const FLAG_CLOCK_SKEW = "clock_skew" // the device timestamp was further off than the allowed skew
+
+// Kinds of custom metrics. Gauges are stored as they are; counters are cumulative and get a
+// per-second rate next to the raw value.
+const METRIC_KIND_GAUGE = "gauge"
+const METRIC_KIND_COUNTER = "counter"
+
+// Rollups of the system and process metrics, continuous aggregates named <table>_<suffix>
+const ROLLUP_1M = "1m"
+const ROLLUP_1H = "1h"
+const ROLLUP_1D = "1d"
+
+// What the top processes of a rollup bucket are ranked by
+const RANK_BY_CPU = "cpu"
+const RANK_BY_MEMORY = "memory"
+
+// Name the metrics service's migrations are recorded under in schema_migrations
+const MIGRATIONS_SERVICE = "metrics"
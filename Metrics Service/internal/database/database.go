@@ -1,136 +1,372 @@
-package database
-
-import (
-	"github.com/sirupsen/logrus"
-	"gorm.io/driver/postgres"
-	"gorm.io/gorm"
-)
-
-// DB interface with methods for GORM operations related to metrics
-type DB interface {
-	Connect(connStr string) error
-	Close() error
-	GetConn() *gorm.DB
-	EnsureMetricsTables()
-	createMetricsTables()
-	isHypertable(tableName string) bool
-	convertToHypertable(tableName string)
-}
-
-// Database holds the connection pool to the PostgreSQL database using GORM
-type Database struct {
-	Conn   *gorm.DB
-	Logger *logrus.Logger
-}
-
-// NewDatabase initializes a new Database instance
-func NewDatabase(logger *logrus.Logger) *Database {
-	return &Database{
-		Logger: logger,
-	}
-}
-
-// Connect establishes the database connection using GORM
-func (d *Database) Connect(connStr string) error {
-	var err error
-	d.Conn, err = gorm.Open(postgres.Open(connStr), &gorm.Config{})
-	if err != nil {
-		d.Logger.WithError(err).Fatal("Failed to open database connection")
-		return err
-	}
-
-	// Ensure the system_metrics and process_metrics tables exist and are hypertables
-	d.EnsureMetricsTables()
-
-	d.Logger.Info("Connected to TimescaleDB")
-	return nil
-}
-
-// EnsureMetricsTables ensures that both system and process metrics tables exist and are hypertables
-func (d *Database) EnsureMetricsTables() {
-	tables := []string{"system_metrics", "process_metrics"}
-
-	for _, tableName := range tables {
-		// Check if the table exists
-		if !d.tableExists(tableName) {
-			d.createMetricsTables()
-		} else {
-			d.Logger.Infof("Table '%s' already exists", tableName)
-		}
-
-		// Check if it's a hypertable
-		if !d.isHypertable(tableName) {
-			d.convertToHypertable(tableName)
-		} else {
-			d.Logger.Infof("Table '%s' is already a hypertable", tableName)
-		}
-	}
-}
-
-// Check if the table exists
-func (d *Database) tableExists(tableName string) bool {
-	var exists bool
-	d.Conn.Raw("SELECT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = ?)", tableName).Scan(&exists)
-	return exists
-}
-
-// Create both the system_metrics and process_metrics tables if they don't exist
-func (d *Database) createMetricsTables() {
-	// Create system_metrics table
-	createSystemMetricsSQL := `
-        CREATE TABLE IF NOT EXISTS system_metrics (
-            device_id TEXT NOT NULL,
-            timestamp TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
-            cpu_usage FLOAT,
-            memory FLOAT,
-            disk FLOAT,
-            network FLOAT,
-            PRIMARY KEY (device_id, timestamp)
-        );`
-	if err := d.Conn.Exec(createSystemMetricsSQL).Error; err != nil {
-		d.Logger.Fatalf("Error creating system_metrics table: %v", err)
-	}
-	d.Logger.Info("Created 'system_metrics' table")
-
-	// Create process_metrics table (without foreign key constraint)
-	createProcessMetricsSQL := `
-        CREATE TABLE IF NOT EXISTS process_metrics (
-            device_id TEXT NOT NULL,
-            timestamp TIMESTAMPTZ NOT NULL,
-            process_name TEXT NOT NULL,
-            cpu_usage FLOAT,
-            memory FLOAT,
-            PRIMARY KEY (device_id, timestamp, process_name)
-        );`
-	if err := d.Conn.Exec(createProcessMetricsSQL).Error; err != nil {
-		d.Logger.Fatalf("Error creating process_metrics table: %v", err)
-	}
-	d.Logger.Info("Created 'process_metrics' table")
-}
-
-// Check if the table is a hypertable
-func (d *Database) isHypertable(tableName string) bool {
-	var exists bool
-	d.Conn.Raw("SELECT EXISTS (SELECT 1 FROM timescaledb_information.hypertables WHERE hypertable_name = ?)", tableName).Scan(&exists)
-	return exists
-}
-
-// Convert the table to a hypertable
-func (d *Database) convertToHypertable(tableName string) {
-	convertSQL := "SELECT create_hypertable(?, 'timestamp');"
-	if err := d.Conn.Exec(convertSQL, tableName).Error; err != nil {
-		d.Logger.Fatalf("Error converting table %s to hypertable: %v", tableName, err)
-	}
-	d.Logger.Infof("Converted '%s' table to hypertable", tableName)
-}
-
-// Close closes the database connection
-func (d *Database) Close() error {
-	d.Logger.Info("Database connection closed (handled by GORM)")
-	return nil
-}
-
-// GetConn returns the underlying GORM database connection
-func (d *Database) GetConn() *gorm.DB {
-	return d.Conn
-}
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/benmeehan/iot-metrics-service/internal/constants"
+	"github.com/benmeehan/iot-metrics-service/internal/models"
+	"github.com/benmeehan/iot-metrics-service/pkg/migrate"
+	"github.com/sirupsen/logrus"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Rows per INSERT statement. Postgres allows 65535 parameters per statement; a system metrics
+// row takes nine, a process metrics row six, a disk eight, an interface sixteen and a custom
+// metric nine.
+const (
+	systemMetricsPerInsert  = 5000
+	processMetricsPerInsert = 8000
+	diskMetricsPerInsert    = 8000
+	networkMetricsPerInsert = 4000
+	customMetricsPerInsert  = 7000
+)
+
+// DB interface with methods for GORM operations related to metrics
+type DB interface {
+	Open(connStr string) error
+	Connect(connStr string) error
+	Migrate() error
+	NewMigrator() (*migrate.Migrator, error)
+	Close() error
+	GetConn() *gorm.DB
+	ListBlockedDevices() (map[string]string, error)
+	InsertMetrics(batch *models.MetricsBatch) error
+	UpdateDeviceClocks(clocks []models.DeviceClock) error
+	LatestNetworkMetrics(deviceIDs []string, since time.Time) ([]models.NetworkMetrics, error)
+	LatestCounterMetrics(deviceIDs []string, since time.Time) ([]models.Metric, error)
+	ApplyStoragePolicy(table string, policy models.StoragePolicy) error
+	ApplyRollupRetention(view string, dropAfter time.Duration) error
+	RefreshRollup(view string, since *time.Time) error
+	ListSystemRollups(view, deviceID string, from, to time.Time) ([]models.SystemRollup, error)
+	ListTopProcesses(view, deviceID string, from, to time.Time, top int, by string) ([]models.ProcessRollup, error)
+}
+
+// Database holds the connection pool to the PostgreSQL database using GORM
+type Database struct {
+	Conn   *gorm.DB
+	Logger *logrus.Logger
+}
+
+// NewDatabase initializes a new Database instance
+func NewDatabase(logger *logrus.Logger) *Database {
+	return &Database{
+		Logger: logger,
+	}
+}
+
+// Open establishes the database connection using GORM without touching the schema
+func (d *Database) Open(connStr string) error {
+	var err error
+	d.Conn, err = gorm.Open(postgres.Open(connStr), &gorm.Config{})
+	if err != nil {
+		d.Logger.WithError(err).Fatal("Failed to open database connection")
+		return err
+	}
+	return nil
+}
+
+// Connect establishes the database connection and applies the pending schema migrations
+func (d *Database) Connect(connStr string) error {
+	if err := d.Open(connStr); err != nil {
+		return err
+	}
+	if err := d.Migrate(); err != nil {
+		d.Logger.WithError(err).Fatal("Failed to migrate database schema")
+		return err
+	}
+
+	d.Logger.Info("Connected to TimescaleDB")
+	return nil
+}
+
+// InsertMetrics inserts the rows of a batch of samples into all metrics tables in one
+// transaction with multi-row INSERTs, so a sample is never stored in part. Rows that are already
+// stored, such as redelivered samples, are skipped.
+func (d *Database) InsertMetrics(batch *models.MetricsBatch) error {
+	if batch.Empty() {
+		return nil
+	}
+	return d.Conn.Transaction(func(tx *gorm.DB) error {
+		tx = tx.Clauses(clause.OnConflict{DoNothing: true})
+		if len(batch.System) > 0 {
+			if err := tx.CreateInBatches(&batch.System, systemMetricsPerInsert).Error; err != nil {
+				return fmt.Errorf("failed to insert system metrics: %w", err)
+			}
+		}
+		if len(batch.Processes) > 0 {
+			if err := tx.CreateInBatches(&batch.Processes, processMetricsPerInsert).Error; err != nil {
+				return fmt.Errorf("failed to insert process metrics: %w", err)
+			}
+		}
+		if len(batch.Disks) > 0 {
+			if err := tx.CreateInBatches(&batch.Disks, diskMetricsPerInsert).Error; err != nil {
+				return fmt.Errorf("failed to insert disk metrics: %w", err)
+			}
+		}
+		if len(batch.Interfaces) > 0 {
+			if err := tx.CreateInBatches(&batch.Interfaces, networkMetricsPerInsert).Error; err != nil {
+				return fmt.Errorf("failed to insert network metrics: %w", err)
+			}
+		}
+		if len(batch.Custom) > 0 {
+			if err := tx.CreateInBatches(&batch.Custom, customMetricsPerInsert).Error; err != nil {
+				return fmt.Errorf("failed to insert custom metrics: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// UpdateDeviceClocks records the latest clock offset of each device. A measurement older than
+// the stored one is ignored. Each device may only appear once.
+func (d *Database) UpdateDeviceClocks(clocks []models.DeviceClock) error {
+	if len(clocks) == 0 {
+		return nil
+	}
+
+	ids := make([]string, len(clocks))
+	offsets := make([]int64, len(clocks))
+	skewed := make([]bool, len(clocks))
+	measuredAt := make([]time.Time, len(clocks))
+	for i, c := range clocks {
+		ids[i], offsets[i], skewed[i], measuredAt[i] = c.DeviceID, c.OffsetMS, c.Skewed, c.MeasuredAt
+	}
+
+	return d.Conn.Exec(`
+        INSERT INTO device_clock (device_id, offset_ms, skewed, measured_at)
+        SELECT * FROM unnest(CAST(@ids AS text[]), CAST(@offsets AS bigint[]), CAST(@skewed AS boolean[]), CAST(@measured_at AS timestamptz[]))
+        ON CONFLICT (device_id) DO UPDATE SET
+            offset_ms = EXCLUDED.offset_ms,
+            skewed = EXCLUDED.skewed,
+            measured_at = EXCLUDED.measured_at
+        WHERE EXCLUDED.measured_at > device_clock.measured_at`,
+		sql.Named("ids", ids),
+		sql.Named("offsets", offsets),
+		sql.Named("skewed", skewed),
+		sql.Named("measured_at", measuredAt),
+	).Error
+}
+
+// Check if the table exists
+func (d *Database) tableExists(tableName string) bool {
+	var exists bool
+	d.Conn.Raw("SELECT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = ?)", tableName).Scan(&exists)
+	return exists
+}
+
+// LatestNetworkMetrics returns the latest counters of each interface of the devices, ignoring
+// samples older than since
+func (d *Database) LatestNetworkMetrics(deviceIDs []string, since time.Time) ([]models.NetworkMetrics, error) {
+	var metrics []models.NetworkMetrics
+	if len(deviceIDs) == 0 {
+		return metrics, nil
+	}
+	err := d.Conn.Raw(`
+        SELECT DISTINCT ON (device_id, interface) *
+        FROM network_metrics
+        WHERE device_id = ANY(CAST(@ids AS text[])) AND timestamp > @since
+        ORDER BY device_id, interface, timestamp DESC`,
+		sql.Named("ids", deviceIDs),
+		sql.Named("since", since),
+	).Scan(&metrics).Error
+	return metrics, err
+}
+
+// LatestCounterMetrics returns the latest reading of each custom counter series of the devices,
+// ignoring samples older than since
+func (d *Database) LatestCounterMetrics(deviceIDs []string, since time.Time) ([]models.Metric, error) {
+	var metrics []models.Metric
+	if len(deviceIDs) == 0 {
+		return metrics, nil
+	}
+	err := d.Conn.Raw(`
+        SELECT DISTINCT ON (device_id, name, labels) *
+        FROM metrics
+        WHERE device_id = ANY(CAST(@ids AS text[])) AND timestamp > @since AND kind = @kind
+        ORDER BY device_id, name, labels, timestamp DESC`,
+		sql.Named("ids", deviceIDs),
+		sql.Named("since", since),
+		sql.Named("kind", constants.METRIC_KIND_COUNTER),
+	).Scan(&metrics).Error
+	return metrics, err
+}
+
+// ListBlockedDevices returns the suspended and decommissioned devices from the registration
+// service's devices table, keyed by device ID
+func (d *Database) ListBlockedDevices() (map[string]string, error) {
+	blocked := make(map[string]string)
+
+	// The registration service creates the table, it may not have run yet
+	if !d.tableExists("devices") {
+		return blocked, nil
+	}
+
+	var rows []struct {
+		ID    string
+		State string
+	}
+	// Decommissioned devices are soft deleted, so deleted_at is deliberately not filtered
+	err := d.Conn.Raw("SELECT id, state FROM devices WHERE state IN ?",
+		[]string{constants.DEVICE_STATE_SUSPENDED, constants.DEVICE_STATE_DECOMMISSIONED}).Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		blocked[row.ID] = row.State
+	}
+	return blocked, nil
+}
+
+// ApplyStoragePolicy sets the hypertable's chunk interval and reconciles its compression and
+// retention policies with the given policy. It is safe to run on every start: policies that
+// already match are left alone and changed ones are replaced. Compression segments by device
+// and orders by time; once enabled it stays enabled, only its policy is removed.
+func (d *Database) ApplyStoragePolicy(table string, policy models.StoragePolicy) error {
+	if policy.ChunkTimeInterval > 0 {
+		err := d.Conn.Exec("SELECT set_chunk_time_interval(CAST(? AS regclass), make_interval(secs => ?))",
+			table, policy.ChunkTimeInterval.Seconds()).Error
+		if err != nil {
+			return fmt.Errorf("failed to set chunk interval of %s: %w", table, err)
+		}
+	}
+
+	if policy.CompressAfter > 0 {
+		var enabled bool
+		err := d.Conn.Raw("SELECT compression_enabled FROM timescaledb_information.hypertables WHERE hypertable_name = ?", table).
+			Scan(&enabled).Error
+		if err != nil {
+			return fmt.Errorf("failed to check compression of %s: %w", table, err)
+		}
+		if !enabled {
+			err := d.Conn.Exec("ALTER TABLE " + table + " SET (timescaledb.compress, " +
+				"timescaledb.compress_segmentby = 'device_id', timescaledb.compress_orderby = 'timestamp DESC')").Error
+			if err != nil {
+				return fmt.Errorf("failed to enable compression of %s: %w", table, err)
+			}
+			d.Logger.Infof("Enabled compression of '%s'", table)
+		}
+	}
+
+	if err := d.reconcilePolicy(table, table, "policy_compression", "compress_after", "compression", policy.CompressAfter); err != nil {
+		return err
+	}
+	return d.reconcilePolicy(table, table, "policy_retention", "drop_after", "retention", policy.DropAfter)
+}
+
+// RefreshRollup materializes the rollup from since, or from its start when since is nil, up to
+// now. Buckets that are already materialized and haven't changed are skipped, so only the first
+// refresh of a range does real work. Raw samples dropped by retention would drop their buckets
+// from the rollup as well, so since must not reach back past them.
+func (d *Database) RefreshRollup(view string, since *time.Time) error {
+	return d.Conn.Exec("CALL refresh_continuous_aggregate(CAST(? AS regclass), CAST(? AS timestamptz), now())", view, since).Error
+}
+
+// ApplyRollupRetention drops the rollup's buckets older than dropAfter, or keeps them all when
+// it is zero. The raw samples have their own retention in the storage policies.
+func (d *Database) ApplyRollupRetention(view string, dropAfter time.Duration) error {
+	var hypertable string
+	err := d.Conn.Raw("SELECT materialization_hypertable_name FROM timescaledb_information.continuous_aggregates WHERE view_name = ?", view).
+		Scan(&hypertable).Error
+	if err != nil {
+		return fmt.Errorf("failed to look up rollup %s: %w", view, err)
+	}
+	if hypertable == "" {
+		return fmt.Errorf("rollup %s does not exist", view)
+	}
+	return d.reconcilePolicy(view, hypertable, "policy_retention", "drop_after", "retention", dropAfter)
+}
+
+// reconcilePolicy makes the compression or retention job of a table or continuous aggregate
+// match the wanted age, removing the job when the age is zero. Jobs are listed by hypertable,
+// which for a continuous aggregate is its materialization hypertable.
+func (d *Database) reconcilePolicy(table, hypertable, procName, configKey, policyName string, after time.Duration) error {
+	var current []string
+	err := d.Conn.Raw("SELECT config ->> ? FROM timescaledb_information.jobs WHERE proc_name = ? AND hypertable_name = ?",
+		configKey, procName, hypertable).Scan(&current).Error
+	if err != nil {
+		return fmt.Errorf("failed to read %s policy of %s: %w", policyName, table, err)
+	}
+
+	if len(current) == 1 && after > 0 {
+		var same bool
+		err := d.Conn.Raw("SELECT CAST(? AS interval) = make_interval(secs => ?)", current[0], after.Seconds()).Scan(&same).Error
+		if err != nil {
+			return fmt.Errorf("failed to compare %s policy of %s: %w", policyName, table, err)
+		}
+		if same {
+			return nil
+		}
+	}
+
+	if len(current) > 0 {
+		if err := d.Conn.Exec("SELECT remove_"+policyName+"_policy(CAST(? AS regclass), if_exists => true)", table).Error; err != nil {
+			return fmt.Errorf("failed to remove %s policy of %s: %w", policyName, table, err)
+		}
+		d.Logger.Infof("Removed %s policy of '%s'", policyName, table)
+	}
+	if after <= 0 {
+		return nil
+	}
+
+	if err := d.Conn.Exec("SELECT add_"+policyName+"_policy(CAST(? AS regclass), make_interval(secs => ?))", table, after.Seconds()).Error; err != nil {
+		return fmt.Errorf("failed to add %s policy of %s: %w", policyName, table, err)
+	}
+	d.Logger.Infof("Set %s policy of '%s' to %s", policyName, table, after)
+	return nil
+}
+
+// ListSystemRollups returns the device's buckets of a system metrics rollup in [from, to)
+func (d *Database) ListSystemRollups(view, deviceID string, from, to time.Time) ([]models.SystemRollup, error) {
+	var rollups []models.SystemRollup
+	err := d.Conn.Raw(`
+        SELECT *
+        FROM `+view+`
+        WHERE device_id = @device_id AND bucket >= @from AND bucket < @to
+        ORDER BY bucket`,
+		sql.Named("device_id", deviceID),
+		sql.Named("from", from),
+		sql.Named("to", to),
+	).Scan(&rollups).Error
+	return rollups, err
+}
+
+// ListTopProcesses returns the top processes of the device in each bucket of a process metrics
+// rollup in [from, to), ranked by average CPU or memory usage
+func (d *Database) ListTopProcesses(view, deviceID string, from, to time.Time, top int, by string) ([]models.ProcessRollup, error) {
+	order := "cpu_avg"
+	if by == constants.RANK_BY_MEMORY {
+		order = "memory_avg"
+	}
+
+	var processes []models.ProcessRollup
+	err := d.Conn.Raw(`
+        SELECT *
+        FROM (
+            SELECT *, row_number() OVER (PARTITION BY bucket ORDER BY `+order+` DESC NULLS LAST, process_name) AS rank
+            FROM `+view+`
+            WHERE device_id = @device_id AND bucket >= @from AND bucket < @to
+        ) ranked
+        WHERE rank <= @top
+        ORDER BY bucket, rank`,
+		sql.Named("device_id", deviceID),
+		sql.Named("from", from),
+		sql.Named("to", to),
+		sql.Named("top", top),
+	).Scan(&processes).Error
+	return processes, err
+}
+
+// Close closes the database connection
+func (d *Database) Close() error {
+	d.Logger.Info("Database connection closed (handled by GORM)")
+	return nil
+}
+
+// GetConn returns the underlying GORM database connection
+func (d *Database) GetConn() *gorm.DB {
+	return d.Conn
+}
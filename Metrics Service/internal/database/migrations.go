@@ -0,0 +1,43 @@
+package database
+
+import (
+	"embed"
+	"io/fs"
+
+	"github.com/benmeehan/iot-metrics-service/internal/constants"
+	"github.com/benmeehan/iot-metrics-service/pkg/migrate"
+)
+
+// migrationFiles holds the schema migrations, see pkg/migrate for the file names
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// NewMigrator returns a migrator for the metrics service's schema
+func (d *Database) NewMigrator() (*migrate.Migrator, error) {
+	sqlDB, err := d.Conn.DB()
+	if err != nil {
+		return nil, err
+	}
+	files, err := fs.Sub(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	return migrate.NewMigrator(sqlDB, constants.MIGRATIONS_SERVICE, files, d.Logger)
+}
+
+// Migrate applies the pending schema migrations
+func (d *Database) Migrate() error {
+	migrator, err := d.NewMigrator()
+	if err != nil {
+		return err
+	}
+	applied, err := migrator.Up()
+	if err != nil {
+		return err
+	}
+	if applied == 0 {
+		d.Logger.Info("Database schema is up to date")
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+-- Databases set up before migrations already have the table, possibly without the later columns
+CREATE TABLE IF NOT EXISTS system_metrics (
+    device_id TEXT NOT NULL,
+    timestamp TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    cpu_usage FLOAT,
+    memory FLOAT,
+    disk FLOAT,
+    network FLOAT,
+    PRIMARY KEY (device_id, timestamp)
+);
+
+ALTER TABLE system_metrics
+    ADD COLUMN IF NOT EXISTS flag TEXT,
+    ADD COLUMN IF NOT EXISTS received_at TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS clock_skew_ms BIGINT;
+
+SELECT create_hypertable('system_metrics', 'timestamp', if_not_exists => TRUE);
@@ -0,0 +1,13 @@
+-- Databases set up before migrations already have the table, possibly without the flag column
+CREATE TABLE IF NOT EXISTS process_metrics (
+    device_id TEXT NOT NULL,
+    timestamp TIMESTAMPTZ NOT NULL,
+    process_name TEXT NOT NULL,
+    cpu_usage FLOAT,
+    memory FLOAT,
+    PRIMARY KEY (device_id, timestamp, process_name)
+);
+
+ALTER TABLE process_metrics ADD COLUMN IF NOT EXISTS flag TEXT;
+
+SELECT create_hypertable('process_metrics', 'timestamp', if_not_exists => TRUE);
@@ -0,0 +1,2 @@
+-- device_clock is shared with the heartbeat service and stays
+SELECT 1;
@@ -0,0 +1,7 @@
+-- The heartbeat service writes to the same table and creates it as well
+CREATE TABLE IF NOT EXISTS device_clock (
+    device_id TEXT PRIMARY KEY,
+    offset_ms BIGINT NOT NULL,
+    skewed BOOLEAN NOT NULL,
+    measured_at TIMESTAMPTZ NOT NULL
+);
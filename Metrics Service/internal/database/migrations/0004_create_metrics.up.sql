@@ -0,0 +1,15 @@
+-- Custom numeric series, one row per reading
+CREATE TABLE IF NOT EXISTS metrics (
+    device_id TEXT NOT NULL,
+    timestamp TIMESTAMPTZ NOT NULL,
+    name TEXT NOT NULL,
+    labels JSONB NOT NULL DEFAULT '{}',
+    value DOUBLE PRECISION NOT NULL,
+    unit TEXT,
+    flag TEXT
+);
+
+SELECT create_hypertable('metrics', 'timestamp', if_not_exists => TRUE);
+
+-- Redelivered samples are skipped on conflict, and series are read per device and name
+CREATE UNIQUE INDEX IF NOT EXISTS idx_metrics_device_id_name_labels_timestamp ON metrics (device_id, name, labels, timestamp DESC);
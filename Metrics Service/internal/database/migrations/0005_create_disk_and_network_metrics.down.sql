@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS network_metrics;
+DROP TABLE IF EXISTS disk_metrics;
@@ -0,0 +1,31 @@
+-- Usage of each mounted filesystem
+CREATE TABLE IF NOT EXISTS disk_metrics (
+    device_id TEXT NOT NULL,
+    timestamp TIMESTAMPTZ NOT NULL,
+    mount TEXT NOT NULL,
+    total_bytes BIGINT,
+    used_bytes BIGINT,
+    inodes_total BIGINT,
+    inodes_used BIGINT,
+    flag TEXT,
+    PRIMARY KEY (device_id, timestamp, mount)
+);
+
+SELECT create_hypertable('disk_metrics', 'timestamp', if_not_exists => TRUE);
+
+-- Counters of each network interface
+CREATE TABLE IF NOT EXISTS network_metrics (
+    device_id TEXT NOT NULL,
+    timestamp TIMESTAMPTZ NOT NULL,
+    interface TEXT NOT NULL,
+    rx_bytes BIGINT,
+    tx_bytes BIGINT,
+    rx_packets BIGINT,
+    tx_packets BIGINT,
+    rx_errors BIGINT,
+    tx_errors BIGINT,
+    flag TEXT,
+    PRIMARY KEY (device_id, timestamp, interface)
+);
+
+SELECT create_hypertable('network_metrics', 'timestamp', if_not_exists => TRUE);
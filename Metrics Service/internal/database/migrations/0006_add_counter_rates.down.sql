@@ -0,0 +1,11 @@
+ALTER TABLE metrics
+    DROP COLUMN IF EXISTS rate,
+    DROP COLUMN IF EXISTS kind;
+
+ALTER TABLE network_metrics
+    DROP COLUMN IF EXISTS tx_errors_rate,
+    DROP COLUMN IF EXISTS rx_errors_rate,
+    DROP COLUMN IF EXISTS tx_packets_rate,
+    DROP COLUMN IF EXISTS rx_packets_rate,
+    DROP COLUMN IF EXISTS tx_bytes_rate,
+    DROP COLUMN IF EXISTS rx_bytes_rate;
@@ -0,0 +1,13 @@
+-- Per-second rates derived from the cumulative interface counters
+ALTER TABLE network_metrics
+    ADD COLUMN IF NOT EXISTS rx_bytes_rate DOUBLE PRECISION,
+    ADD COLUMN IF NOT EXISTS tx_bytes_rate DOUBLE PRECISION,
+    ADD COLUMN IF NOT EXISTS rx_packets_rate DOUBLE PRECISION,
+    ADD COLUMN IF NOT EXISTS tx_packets_rate DOUBLE PRECISION,
+    ADD COLUMN IF NOT EXISTS rx_errors_rate DOUBLE PRECISION,
+    ADD COLUMN IF NOT EXISTS tx_errors_rate DOUBLE PRECISION;
+
+-- Custom metrics can be counters, which get a per-second rate
+ALTER TABLE metrics
+    ADD COLUMN IF NOT EXISTS kind TEXT,
+    ADD COLUMN IF NOT EXISTS rate DOUBLE PRECISION;
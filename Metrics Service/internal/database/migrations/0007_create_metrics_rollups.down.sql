@@ -0,0 +1,6 @@
+DROP MATERIALIZED VIEW IF EXISTS process_metrics_1d;
+DROP MATERIALIZED VIEW IF EXISTS process_metrics_1h;
+DROP MATERIALIZED VIEW IF EXISTS process_metrics_1m;
+DROP MATERIALIZED VIEW IF EXISTS system_metrics_1d;
+DROP MATERIALIZED VIEW IF EXISTS system_metrics_1h;
+DROP MATERIALIZED VIEW IF EXISTS system_metrics_1m;
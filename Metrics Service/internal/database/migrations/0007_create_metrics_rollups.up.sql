@@ -0,0 +1,100 @@
+-- Rollups of the system and process metrics for dashboards over long ranges. Each one is
+-- aggregated from the raw samples rather than from the finer rollup, so the 95th percentiles
+-- are exact, and outlives the raw samples it was computed from. Like the heartbeat aggregates
+-- they include the not yet materialized data.
+CREATE MATERIALIZED VIEW IF NOT EXISTS system_metrics_1m
+    WITH (timescaledb.continuous, timescaledb.materialized_only = false) AS
+    SELECT device_id, time_bucket(INTERVAL '1 minute', timestamp) AS bucket, count(*) AS samples,
+        avg(cpu_usage) AS cpu_avg, min(cpu_usage) AS cpu_min, max(cpu_usage) AS cpu_max,
+        percentile_cont(0.95) WITHIN GROUP (ORDER BY cpu_usage) AS cpu_p95,
+        avg(memory) AS memory_avg, min(memory) AS memory_min, max(memory) AS memory_max,
+        percentile_cont(0.95) WITHIN GROUP (ORDER BY memory) AS memory_p95,
+        avg(disk) AS disk_avg, min(disk) AS disk_min, max(disk) AS disk_max,
+        percentile_cont(0.95) WITHIN GROUP (ORDER BY disk) AS disk_p95,
+        avg(network) AS network_avg, min(network) AS network_min, max(network) AS network_max,
+        percentile_cont(0.95) WITHIN GROUP (ORDER BY network) AS network_p95
+    FROM system_metrics
+    GROUP BY device_id, time_bucket(INTERVAL '1 minute', timestamp)
+    WITH NO DATA;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS system_metrics_1h
+    WITH (timescaledb.continuous, timescaledb.materialized_only = false) AS
+    SELECT device_id, time_bucket(INTERVAL '1 hour', timestamp) AS bucket, count(*) AS samples,
+        avg(cpu_usage) AS cpu_avg, min(cpu_usage) AS cpu_min, max(cpu_usage) AS cpu_max,
+        percentile_cont(0.95) WITHIN GROUP (ORDER BY cpu_usage) AS cpu_p95,
+        avg(memory) AS memory_avg, min(memory) AS memory_min, max(memory) AS memory_max,
+        percentile_cont(0.95) WITHIN GROUP (ORDER BY memory) AS memory_p95,
+        avg(disk) AS disk_avg, min(disk) AS disk_min, max(disk) AS disk_max,
+        percentile_cont(0.95) WITHIN GROUP (ORDER BY disk) AS disk_p95,
+        avg(network) AS network_avg, min(network) AS network_min, max(network) AS network_max,
+        percentile_cont(0.95) WITHIN GROUP (ORDER BY network) AS network_p95
+    FROM system_metrics
+    GROUP BY device_id, time_bucket(INTERVAL '1 hour', timestamp)
+    WITH NO DATA;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS system_metrics_1d
+    WITH (timescaledb.continuous, timescaledb.materialized_only = false) AS
+    SELECT device_id, time_bucket(INTERVAL '1 day', timestamp) AS bucket, count(*) AS samples,
+        avg(cpu_usage) AS cpu_avg, min(cpu_usage) AS cpu_min, max(cpu_usage) AS cpu_max,
+        percentile_cont(0.95) WITHIN GROUP (ORDER BY cpu_usage) AS cpu_p95,
+        avg(memory) AS memory_avg, min(memory) AS memory_min, max(memory) AS memory_max,
+        percentile_cont(0.95) WITHIN GROUP (ORDER BY memory) AS memory_p95,
+        avg(disk) AS disk_avg, min(disk) AS disk_min, max(disk) AS disk_max,
+        percentile_cont(0.95) WITHIN GROUP (ORDER BY disk) AS disk_p95,
+        avg(network) AS network_avg, min(network) AS network_min, max(network) AS network_max,
+        percentile_cont(0.95) WITHIN GROUP (ORDER BY network) AS network_p95
+    FROM system_metrics
+    GROUP BY device_id, time_bucket(INTERVAL '1 day', timestamp)
+    WITH NO DATA;
+
+-- Per process, for the top processes of each bucket
+CREATE MATERIALIZED VIEW IF NOT EXISTS process_metrics_1m
+    WITH (timescaledb.continuous, timescaledb.materialized_only = false) AS
+    SELECT device_id, process_name, time_bucket(INTERVAL '1 minute', timestamp) AS bucket, count(*) AS samples,
+        avg(cpu_usage) AS cpu_avg, max(cpu_usage) AS cpu_max,
+        avg(memory) AS memory_avg, max(memory) AS memory_max
+    FROM process_metrics
+    GROUP BY device_id, process_name, time_bucket(INTERVAL '1 minute', timestamp)
+    WITH NO DATA;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS process_metrics_1h
+    WITH (timescaledb.continuous, timescaledb.materialized_only = false) AS
+    SELECT device_id, process_name, time_bucket(INTERVAL '1 hour', timestamp) AS bucket, count(*) AS samples,
+        avg(cpu_usage) AS cpu_avg, max(cpu_usage) AS cpu_max,
+        avg(memory) AS memory_avg, max(memory) AS memory_max
+    FROM process_metrics
+    GROUP BY device_id, process_name, time_bucket(INTERVAL '1 hour', timestamp)
+    WITH NO DATA;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS process_metrics_1d
+    WITH (timescaledb.continuous, timescaledb.materialized_only = false) AS
+    SELECT device_id, process_name, time_bucket(INTERVAL '1 day', timestamp) AS bucket, count(*) AS samples,
+        avg(cpu_usage) AS cpu_avg, max(cpu_usage) AS cpu_max,
+        avg(memory) AS memory_avg, max(memory) AS memory_max
+    FROM process_metrics
+    GROUP BY device_id, process_name, time_bucket(INTERVAL '1 day', timestamp)
+    WITH NO DATA;
+
+SELECT add_continuous_aggregate_policy('system_metrics_1m',
+    start_offset => INTERVAL '1 hour', end_offset => INTERVAL '1 minute',
+    schedule_interval => INTERVAL '1 minute', if_not_exists => true);
+
+SELECT add_continuous_aggregate_policy('system_metrics_1h',
+    start_offset => INTERVAL '1 day', end_offset => INTERVAL '1 hour',
+    schedule_interval => INTERVAL '30 minutes', if_not_exists => true);
+
+SELECT add_continuous_aggregate_policy('system_metrics_1d',
+    start_offset => INTERVAL '3 days', end_offset => INTERVAL '1 day',
+    schedule_interval => INTERVAL '1 hour', if_not_exists => true);
+
+SELECT add_continuous_aggregate_policy('process_metrics_1m',
+    start_offset => INTERVAL '1 hour', end_offset => INTERVAL '1 minute',
+    schedule_interval => INTERVAL '1 minute', if_not_exists => true);
+
+SELECT add_continuous_aggregate_policy('process_metrics_1h',
+    start_offset => INTERVAL '1 day', end_offset => INTERVAL '1 hour',
+    schedule_interval => INTERVAL '30 minutes', if_not_exists => true);
+
+SELECT add_continuous_aggregate_policy('process_metrics_1d',
+    start_offset => INTERVAL '3 days', end_offset => INTERVAL '1 day',
+    schedule_interval => INTERVAL '1 hour', if_not_exists => true);
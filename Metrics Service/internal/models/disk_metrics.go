@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// DiskMetrics contains the usage of one mounted filesystem, keyed by its mount point in the
+// sample's disks
+type DiskMetrics struct {
+	Timestamp   time.Time `json:"-" gorm:"column:timestamp"`
+	DeviceID    string    `json:"-" gorm:"column:device_id"`
+	Mount       string    `json:"-" gorm:"column:mount"`
+	TotalBytes  *int64    `json:"total_bytes,omitempty" gorm:"column:total_bytes"`
+	UsedBytes   *int64    `json:"used_bytes,omitempty" gorm:"column:used_bytes"`
+	InodesTotal *int64    `json:"inodes_total,omitempty" gorm:"column:inodes_total"`
+	InodesUsed  *int64    `json:"inodes_used,omitempty" gorm:"column:inodes_used"`
+	Flag        string    `json:"-" gorm:"column:flag;default:null"` // the sample's flag
+}
@@ -0,0 +1,94 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/benmeehan/iot-metrics-service/internal/constants"
+)
+
+// Limits on custom metrics. The labels are part of the unique index, and Postgres limits a
+// btree entry to about 2.7 KB including the device ID, name and timestamp, so the encoded
+// labels are kept to 2 KB.
+const (
+	maxMetricNameLength = 255
+	maxMetricLabels     = 16
+	maxLabelLength      = 255
+	maxLabelsSize       = 2048
+)
+
+// Metric is a reading of a custom numeric series, such as a temperature or a queue depth. The
+// device names the series and may add a unit and labels that tell its series apart, e.g. the
+// sensor a temperature comes from. Readings are stored in the narrow metrics table.
+type Metric struct {
+	Timestamp     time.Time `json:"-" gorm:"column:timestamp"` // the sample's timestamp
+	DeviceID      string    `json:"-" gorm:"column:device_id"`
+	Name          string    `json:"name" gorm:"column:name"`
+	Labels        Labels    `json:"labels,omitempty" gorm:"column:labels"`
+	Value         float64   `json:"value" gorm:"column:value"`
+	Unit          string    `json:"unit,omitempty" gorm:"column:unit;default:null"`
+	Kind          string    `json:"kind,omitempty" gorm:"column:kind;default:null"` // gauge (the default) or counter
+	Rate          *float64  `json:"-" gorm:"column:rate"`                           // per second, derived for counters
+	Flag          string    `json:"-" gorm:"column:flag;default:null"`              // the sample's flag
+	BootID        string    `json:"-" gorm:"-"`                                     // the sample's boot, to tell a reboot from the counters
+	UptimeSeconds *int64    `json:"-" gorm:"-"`                                     // the sample's uptime in seconds
+}
+
+// TableName names the narrow table all custom series share
+func (Metric) TableName() string {
+	return "metrics"
+}
+
+// Validate checks the metric against the size limits
+func (m *Metric) Validate() error {
+	if m.Name == "" || len(m.Name) > maxMetricNameLength {
+		return fmt.Errorf("metric names must be 1-%d characters", maxMetricNameLength)
+	}
+	if m.Kind != "" && m.Kind != constants.METRIC_KIND_GAUGE && m.Kind != constants.METRIC_KIND_COUNTER {
+		return fmt.Errorf("metric kind must be %s or %s", constants.METRIC_KIND_GAUGE, constants.METRIC_KIND_COUNTER)
+	}
+	if len(m.Unit) > maxLabelLength {
+		return fmt.Errorf("metric units must be at most %d characters", maxLabelLength)
+	}
+	if len(m.Labels) > maxMetricLabels {
+		return fmt.Errorf("at most %d labels are allowed per metric", maxMetricLabels)
+	}
+	for key, value := range m.Labels {
+		if key == "" || len(key) > maxLabelLength || len(value) > maxLabelLength {
+			return fmt.Errorf("label keys must be 1-%d characters and values at most %d", maxLabelLength, maxLabelLength)
+		}
+	}
+	if encoded, _ := json.Marshal(m.Labels); len(encoded) > maxLabelsSize {
+		return fmt.Errorf("labels must take at most %d bytes as JSON", maxLabelsSize)
+	}
+	return nil
+}
+
+// Labels are key/value pairs that tell the series of a metric apart, stored as JSONB
+type Labels map[string]string
+
+// Value implements driver.Valuer. No labels are stored as an empty object, so they compare
+// equal in the unique index.
+func (l Labels) Value() (driver.Value, error) {
+	if l == nil {
+		return "{}", nil
+	}
+	b, err := json.Marshal(l)
+	return string(b), err
+}
+
+// Scan implements sql.Scanner
+func (l *Labels) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []byte:
+		return json.Unmarshal(v, l)
+	case string:
+		return json.Unmarshal([]byte(v), l)
+	default:
+		return fmt.Errorf("unsupported JSON column type %T", value)
+	}
+}
@@ -0,0 +1,58 @@
+package models
+
+import "time"
+
+// MetricsBatch holds the rows of a batch of samples, by table
+type MetricsBatch struct {
+	System     []SystemMetrics
+	Processes  []ProcessMetrics
+	Disks      []DiskMetrics
+	Interfaces []NetworkMetrics
+	Custom     []Metric
+}
+
+// Empty reports whether the batch has no rows
+func (b *MetricsBatch) Empty() bool {
+	return len(b.System) == 0 && len(b.Processes) == 0 && len(b.Disks) == 0 && len(b.Interfaces) == 0 && len(b.Custom) == 0
+}
+
+// Samples splits the batch into one batch per sample, the rows with the same device and
+// timestamp, in the order the samples first appear
+func (b *MetricsBatch) Samples() []*MetricsBatch {
+	type sampleKey struct {
+		DeviceID  string
+		Timestamp int64
+	}
+	var samples []*MetricsBatch
+	index := make(map[sampleKey]*MetricsBatch)
+	sample := func(deviceID string, timestamp time.Time) *MetricsBatch {
+		key := sampleKey{deviceID, timestamp.UnixNano()}
+		if _, ok := index[key]; !ok {
+			index[key] = &MetricsBatch{}
+			samples = append(samples, index[key])
+		}
+		return index[key]
+	}
+
+	for _, row := range b.System {
+		s := sample(row.DeviceID, row.Timestamp)
+		s.System = append(s.System, row)
+	}
+	for _, row := range b.Processes {
+		s := sample(row.DeviceID, row.Timestamp)
+		s.Processes = append(s.Processes, row)
+	}
+	for _, row := range b.Disks {
+		s := sample(row.DeviceID, row.Timestamp)
+		s.Disks = append(s.Disks, row)
+	}
+	for _, row := range b.Interfaces {
+		s := sample(row.DeviceID, row.Timestamp)
+		s.Interfaces = append(s.Interfaces, row)
+	}
+	for _, row := range b.Custom {
+		s := sample(row.DeviceID, row.Timestamp)
+		s.Custom = append(s.Custom, row)
+	}
+	return samples
+}
@@ -0,0 +1,27 @@
+package models
+
+import "time"
+
+// NetworkMetrics contains the counters of one network interface, keyed by its name in the
+// sample's interfaces. The counters are cumulative as reported by the device; the service
+// derives their per-second rates from the previous sample.
+type NetworkMetrics struct {
+	Timestamp     time.Time `json:"-" gorm:"column:timestamp"`
+	DeviceID      string    `json:"-" gorm:"column:device_id"`
+	Interface     string    `json:"-" gorm:"column:interface"`
+	RxBytes       *int64    `json:"rx_bytes,omitempty" gorm:"column:rx_bytes"`
+	TxBytes       *int64    `json:"tx_bytes,omitempty" gorm:"column:tx_bytes"`
+	RxPackets     *int64    `json:"rx_packets,omitempty" gorm:"column:rx_packets"`
+	TxPackets     *int64    `json:"tx_packets,omitempty" gorm:"column:tx_packets"`
+	RxErrors      *int64    `json:"rx_errors,omitempty" gorm:"column:rx_errors"`
+	TxErrors      *int64    `json:"tx_errors,omitempty" gorm:"column:tx_errors"`
+	RxBytesRate   *float64  `json:"-" gorm:"column:rx_bytes_rate"`
+	TxBytesRate   *float64  `json:"-" gorm:"column:tx_bytes_rate"`
+	RxPacketsRate *float64  `json:"-" gorm:"column:rx_packets_rate"`
+	TxPacketsRate *float64  `json:"-" gorm:"column:tx_packets_rate"`
+	RxErrorsRate  *float64  `json:"-" gorm:"column:rx_errors_rate"`
+	TxErrorsRate  *float64  `json:"-" gorm:"column:tx_errors_rate"`
+	Flag          string    `json:"-" gorm:"column:flag;default:null"` // the sample's flag
+	BootID        string    `json:"-" gorm:"-"`                        // the sample's boot, to tell a reboot from the counters
+	UptimeSeconds *int64    `json:"-" gorm:"-"`                        // the sample's uptime in seconds
+}
@@ -0,0 +1,62 @@
+package models
+
+import "time"
+
+// Stats summarizes the samples of one metric in a rollup bucket
+type Stats struct {
+	Avg *float64 `json:"avg" gorm:"column:avg"`
+	Min *float64 `json:"min" gorm:"column:min"`
+	Max *float64 `json:"max" gorm:"column:max"`
+	P95 *float64 `json:"p95" gorm:"column:p95"`
+}
+
+// SystemRollup is a bucket of a device's system metrics rollup
+type SystemRollup struct {
+	Bucket   time.Time `json:"bucket" gorm:"column:bucket"`
+	Samples  int64     `json:"samples" gorm:"column:samples"`
+	CPUUsage Stats     `json:"cpu_usage" gorm:"embedded;embeddedPrefix:cpu_"`
+	Memory   Stats     `json:"memory" gorm:"embedded;embeddedPrefix:memory_"`
+	Disk     Stats     `json:"disk" gorm:"embedded;embeddedPrefix:disk_"`
+	Network  Stats     `json:"network" gorm:"embedded;embeddedPrefix:network_"`
+}
+
+// ProcessRollup is a process of a device in a bucket of the process metrics rollup
+type ProcessRollup struct {
+	Bucket      time.Time `json:"-" gorm:"column:bucket"`
+	ProcessName string    `json:"process_name" gorm:"column:process_name"`
+	Rank        int       `json:"rank" gorm:"column:rank"` // 1 for the process using the most
+	Samples     int64     `json:"samples" gorm:"column:samples"`
+	CPUAvg      *float64  `json:"cpu_avg" gorm:"column:cpu_avg"`
+	CPUMax      *float64  `json:"cpu_max" gorm:"column:cpu_max"`
+	MemoryAvg   *float64  `json:"memory_avg" gorm:"column:memory_avg"`
+	MemoryMax   *float64  `json:"memory_max" gorm:"column:memory_max"`
+}
+
+// ProcessBucket holds the top processes of a bucket
+type ProcessBucket struct {
+	Bucket    time.Time       `json:"bucket"`
+	Processes []ProcessRollup `json:"processes"`
+}
+
+// SystemSeries is a device's system metrics over a time range, read from the rollup named in
+// Rollup with buckets of BucketSeconds
+type SystemSeries struct {
+	DeviceID      string         `json:"device_id"`
+	From          time.Time      `json:"from"`
+	To            time.Time      `json:"to"`
+	Rollup        string         `json:"rollup"`
+	BucketSeconds int64          `json:"bucket_seconds"`
+	Buckets       []SystemRollup `json:"buckets"`
+}
+
+// ProcessSeries is a device's top processes over a time range, read like SystemSeries
+type ProcessSeries struct {
+	DeviceID      string          `json:"device_id"`
+	From          time.Time       `json:"from"`
+	To            time.Time       `json:"to"`
+	Rollup        string          `json:"rollup"`
+	BucketSeconds int64           `json:"bucket_seconds"`
+	Top           int             `json:"top"`
+	By            string          `json:"by"` // cpu or memory
+	Buckets       []ProcessBucket `json:"buckets"`
+}
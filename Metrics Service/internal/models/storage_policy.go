@@ -0,0 +1,11 @@
+package models
+
+import "time"
+
+// StoragePolicy configures the chunking, compression and retention of a hypertable. A zero
+// duration leaves chunking as it is, or disables compression or retention.
+type StoragePolicy struct {
+	ChunkTimeInterval time.Duration `yaml:"chunk_time_interval"` // Time range of each new chunk
+	CompressAfter     time.Duration `yaml:"compress_after"`      // Compress chunks older than this
+	DropAfter         time.Duration `yaml:"drop_after"`          // Drop chunks older than this
+}
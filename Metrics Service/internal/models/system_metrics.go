@@ -1,14 +1,31 @@
-package models
-
-import "time"
-
-// SystemMetrics represents the system metrics collected at a specific time
-type SystemMetrics struct {
-	Timestamp time.Time                  `json:"timestamp" gorm:"column:timestamp;index;not null"`
-	DeviceID  string                     `json:"device_id" gorm:"column:device_id;size:255;index;not null"`
-	CPUUsage  *float64                   `json:"cpu_usage,omitempty" gorm:"column:cpu_usage"`
-	Memory    *float64                   `json:"memory,omitempty" gorm:"column:memory"`
-	Disk      *float64                   `json:"disk,omitempty" gorm:"column:disk"`
-	Network   *float64                   `json:"network,omitempty" gorm:"column:network"`
-	Processes map[string]*ProcessMetrics `json:"processes,omitempty" gorm:"-"`
-}
+package models
+
+import "time"
+
+// SystemMetrics represents the system metrics collected at a specific time
+type SystemMetrics struct {
+	Timestamp     time.Time                  `json:"timestamp" gorm:"column:timestamp;index;not null"`
+	DeviceID      string                     `json:"device_id" gorm:"column:device_id;size:255;index;not null"`
+	CPUUsage      *float64                   `json:"cpu_usage,omitempty" gorm:"column:cpu_usage"`
+	Memory        *float64                   `json:"memory,omitempty" gorm:"column:memory"`
+	Disk          *float64                   `json:"disk,omitempty" gorm:"column:disk"`
+	Network       *float64                   `json:"network,omitempty" gorm:"column:network"`
+	Disks         map[string]*DiskMetrics    `json:"disks,omitempty" gorm:"-"`      // by mount point
+	Interfaces    map[string]*NetworkMetrics `json:"interfaces,omitempty" gorm:"-"` // by interface name
+	Token         string                     `json:"token,omitempty" gorm:"-"`      // access token issued at registration, see pkg/token
+	Processes     map[string]*ProcessMetrics `json:"processes,omitempty" gorm:"-"`
+	Metrics       []Metric                   `json:"metrics,omitempty" gorm:"-"`        // custom series, see Metric
+	BootID        string                     `json:"boot_id,omitempty" gorm:"-"`        // changes when the device reboots
+	UptimeSeconds *int64                     `json:"uptime_seconds,omitempty" gorm:"-"` // seconds since the device booted
+	Flag          string                     `json:"-" gorm:"column:flag;default:null"` // comma separated: device state if blocked, clock_skew
+	// ReceivedAt is the server time the metrics arrived
+	ReceivedAt time.Time `json:"-" gorm:"column:received_at"`
+	// ClockSkewMS is the device timestamp minus ReceivedAt, nil when the device sent no timestamp
+	ClockSkewMS *int64 `json:"-" gorm:"column:clock_skew_ms"`
+}
+
+// HasSystemValues reports whether the sample carries any of the system metrics. A sample with
+// only per-process, per-disk, per-interface or custom metrics gets no system_metrics row.
+func (m *SystemMetrics) HasSystemValues() bool {
+	return m.CPUUsage != nil || m.Memory != nil || m.Disk != nil || m.Network != nil
+}
@@ -0,0 +1,148 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/benmeehan/iot-metrics-service/internal/constants"
+	"github.com/benmeehan/iot-metrics-service/internal/database"
+	"github.com/benmeehan/iot-metrics-service/internal/models"
+	"github.com/benmeehan/iot-metrics-service/pkg/kafka"
+	"github.com/benmeehan/iot-metrics-service/pkg/mqtt"
+	KAFKA "github.com/confluentinc/confluent-kafka-go/kafka"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/sirupsen/logrus"
+)
+
+// DeviceRegistry keeps track of suspended and decommissioned devices so their data can be
+// dropped or flagged. It is loaded from the devices table and kept current from the device
+// events published by the registration service.
+type DeviceRegistry struct {
+	MqttClient    mqtt.MQTTClient
+	KafkaClient   *kafka.KafkaClient
+	DBClient      database.DB
+	EventTopic    string
+	QOS           int
+	BlockedAction string
+	Logger        *logrus.Logger
+	Mode          string
+
+	mu      sync.RWMutex
+	blocked map[string]string // device ID -> state
+}
+
+// NewDeviceRegistry creates a new instance of DeviceRegistry
+func NewDeviceRegistry(mode string, mqttClient mqtt.MQTTClient, kafkaClient *kafka.KafkaClient, dbClient database.DB, eventTopic string, qos int, blockedAction string, logger *logrus.Logger) (*DeviceRegistry, error) {
+	switch blockedAction {
+	case constants.BLOCKED_ACTION_DROP, constants.BLOCKED_ACTION_FLAG:
+	default:
+		return nil, fmt.Errorf("unknown blocked device action %q", blockedAction)
+	}
+
+	return &DeviceRegistry{
+		MqttClient:    mqttClient,
+		KafkaClient:   kafkaClient,
+		DBClient:      dbClient,
+		EventTopic:    eventTopic,
+		QOS:           qos,
+		BlockedAction: blockedAction,
+		Logger:        logger,
+		Mode:          mode,
+		blocked:       make(map[string]string),
+	}, nil
+}
+
+// Start loads the blocked devices, subscribes to device events and reloads the devices
+// periodically. The reload covers events that were missed, e.g. while the service was down
+// or when another consumer in the Kafka group received them.
+func (r *DeviceRegistry) Start(refreshInterval time.Duration) error {
+	if err := r.reload(); err != nil {
+		return err
+	}
+
+	switch r.Mode {
+	case constants.QUEUE_MODE:
+		if err := r.KafkaClient.Subscribe(r.EventTopic, r.handleKafkaEvent); err != nil {
+			return fmt.Errorf("error subscribing to Kafka topic %s: %w", r.EventTopic, err)
+		}
+	default:
+		token := r.MqttClient.Subscribe(r.EventTopic, byte(r.QOS), r.handleEvent)
+		token.Wait()
+		if token.Error() != nil {
+			return fmt.Errorf("error subscribing to topic %s: %w", r.EventTopic, token.Error())
+		}
+	}
+	r.Logger.Infof("Subscribed to device events on %s", r.EventTopic)
+
+	if refreshInterval <= 0 {
+		refreshInterval = time.Minute
+	}
+	go func() {
+		ticker := time.NewTicker(refreshInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := r.reload(); err != nil {
+				r.Logger.WithError(err).Error("Failed to reload blocked devices")
+			}
+		}
+	}()
+	return nil
+}
+
+// Check decides what to do with data from a device. It returns false if the data should be
+// dropped, otherwise the flag to store with it, which is empty for devices in good standing.
+func (r *DeviceRegistry) Check(deviceID string) (string, bool) {
+	r.mu.RLock()
+	state, blocked := r.blocked[deviceID]
+	r.mu.RUnlock()
+
+	if !blocked {
+		return "", true
+	}
+	if r.BlockedAction == constants.BLOCKED_ACTION_DROP {
+		return "", false
+	}
+	return state, true
+}
+
+func (r *DeviceRegistry) reload() error {
+	blocked, err := r.DBClient.ListBlockedDevices()
+	if err != nil {
+		return fmt.Errorf("failed to load blocked devices: %w", err)
+	}
+
+	r.mu.Lock()
+	r.blocked = blocked
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *DeviceRegistry) handleEvent(client MQTT.Client, msg MQTT.Message) {
+	r.applyEvent(msg.Payload())
+}
+
+func (r *DeviceRegistry) handleKafkaEvent(msg *KAFKA.Message) {
+	r.applyEvent(msg.Value)
+}
+
+// applyEvent updates the device's entry from a lifecycle event
+func (r *DeviceRegistry) applyEvent(payload []byte) {
+	var event models.DeviceEvent
+	if err := json.Unmarshal(payload, &event); err != nil || event.DeviceID == "" {
+		r.Logger.Errorf("Failed to decode device event: %v", err)
+		return
+	}
+
+	r.mu.Lock()
+	switch event.State {
+	case constants.DEVICE_STATE_SUSPENDED, constants.DEVICE_STATE_DECOMMISSIONED:
+		r.blocked[event.DeviceID] = event.State
+	default:
+		delete(r.blocked, event.DeviceID)
+	}
+	r.mu.Unlock()
+
+	r.Logger.Infof("Device %s is now %s", event.DeviceID, event.State)
+}
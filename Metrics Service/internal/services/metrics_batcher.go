@@ -0,0 +1,275 @@
+package services
+
+import (
+	"errors"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/benmeehan/iot-metrics-service/internal/constants"
+	"github.com/benmeehan/iot-metrics-service/internal/database"
+	"github.com/benmeehan/iot-metrics-service/internal/models"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrQueueFull is returned when a sample could not be queued within the enqueue timeout
+var ErrQueueFull = errors.New("metrics queue is full")
+
+// MetricsBatcher takes metrics samples off the MQTT and Kafka callbacks and writes them in
+// batches. Samples go into bounded queues, one per worker; each worker flushes the samples of
+// many devices, with their processes, in one transaction when its batch is full or
+// FlushInterval has passed. A batch that fails is written again one sample per transaction.
+// A device's samples always go to the same worker, so its rates are derived from its counters
+// in order. Every flush is logged with its size and latency.
+//
+// When the database can't keep up a queue fills and Enqueue blocks the callback for up to
+// EnqueueTimeout, which pushes back on the broker. Samples that still don't fit are dropped
+// and counted.
+type MetricsBatcher struct {
+	DBClient       database.DB
+	Rates          *RateTracker
+	BatchSize      int // samples per flush, each with all of its processes
+	FlushInterval  time.Duration
+	EnqueueTimeout time.Duration // 0 blocks until there is room
+	Logger         *logrus.Logger
+
+	queues  []chan models.SystemMetrics // one per worker
+	wg      sync.WaitGroup
+	dropped atomic.Int64
+
+	mu     sync.RWMutex // held for reading while enqueuing, so Close can't close the queues under a sender
+	closed bool
+}
+
+// NewMetricsBatcher creates a new instance of MetricsBatcher
+func NewMetricsBatcher(dbClient database.DB, rates *RateTracker, queueSize, workers, batchSize int, flushInterval, enqueueTimeout time.Duration, logger *logrus.Logger) *MetricsBatcher {
+	if workers <= 0 {
+		workers = 4
+	}
+	if batchSize <= 0 {
+		batchSize = 200
+	}
+	if queueSize < batchSize*workers {
+		queueSize = batchSize * workers
+	}
+	if flushInterval <= 0 {
+		flushInterval = time.Second
+	}
+	queues := make([]chan models.SystemMetrics, workers)
+	for i := range queues {
+		queues[i] = make(chan models.SystemMetrics, max(queueSize/workers, 1))
+	}
+	return &MetricsBatcher{
+		DBClient:       dbClient,
+		Rates:          rates,
+		BatchSize:      batchSize,
+		FlushInterval:  flushInterval,
+		EnqueueTimeout: enqueueTimeout,
+		Logger:         logger,
+		queues:         queues,
+	}
+}
+
+// Start starts the workers
+func (b *MetricsBatcher) Start() {
+	for _, queue := range b.queues {
+		b.wg.Add(1)
+		go b.work(queue)
+	}
+	b.Logger.Infof("Started %d metrics writers", len(b.queues))
+}
+
+// Enqueue queues a sample for writing by the device's worker. It blocks while the queue is full, for at most
+// EnqueueTimeout, and returns ErrQueueFull if the sample was dropped.
+func (b *MetricsBatcher) Enqueue(metrics models.SystemMetrics) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return ErrQueueFull
+	}
+	queue := b.queues[b.shard(metrics.DeviceID)]
+
+	select {
+	case queue <- metrics:
+		return nil
+	default:
+	}
+
+	if b.EnqueueTimeout <= 0 {
+		queue <- metrics
+		return nil
+	}
+	timer := time.NewTimer(b.EnqueueTimeout)
+	defer timer.Stop()
+	select {
+	case queue <- metrics:
+		return nil
+	case <-timer.C:
+		b.dropped.Add(1)
+		return ErrQueueFull
+	}
+}
+
+// Close stops accepting samples and waits until the queued ones are written. Samples enqueued
+// afterwards are dropped, so the MQTT client should be disconnected first.
+func (b *MetricsBatcher) Close() {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.closed = true
+	for _, queue := range b.queues {
+		close(queue)
+	}
+	b.mu.Unlock()
+
+	b.wg.Wait()
+	b.Logger.Info("Flushed metrics queue")
+}
+
+// shard returns the index of the worker that writes the device's samples
+func (b *MetricsBatcher) shard(deviceID string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(deviceID))
+	return int(hash.Sum32() % uint32(len(b.queues)))
+}
+
+// work collects samples from its queue into a batch and flushes it when it is full, when the
+// flush interval has passed and when the queue is closed
+func (b *MetricsBatcher) work(queue <-chan models.SystemMetrics) {
+	defer b.wg.Done()
+
+	batch := make([]models.SystemMetrics, 0, b.BatchSize)
+	ticker := time.NewTicker(b.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case metrics, ok := <-queue:
+			if !ok {
+				b.flush(batch)
+				return
+			}
+			batch = append(batch, metrics)
+			if len(batch) >= b.BatchSize {
+				b.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			b.flush(batch)
+			batch = batch[:0]
+			if dropped := b.dropped.Swap(0); dropped > 0 {
+				b.Logger.Warnf("Dropped %d metrics samples because the queue was full", dropped)
+			}
+		}
+	}
+}
+
+// flush writes the batch in one transaction and then records the latest clock offset of each
+// device
+func (b *MetricsBatcher) flush(batch []models.SystemMetrics) {
+	if len(batch) == 0 {
+		return
+	}
+
+	rows := &models.MetricsBatch{System: make([]models.SystemMetrics, 0, len(batch))}
+	clocks := make(map[string]models.DeviceClock)
+	for _, metrics := range batch {
+		if metrics.HasSystemValues() {
+			rows.System = append(rows.System, metrics)
+		}
+		for processName, process := range metrics.Processes {
+			if process == nil {
+				continue
+			}
+			rows.Processes = append(rows.Processes, models.ProcessMetrics{
+				DeviceID:    metrics.DeviceID,
+				Timestamp:   metrics.Timestamp,
+				ProcessName: processName,
+				CPUUsage:    process.CPUUsage,
+				Memory:      process.Memory,
+				Flag:        metrics.Flag,
+			})
+		}
+		for mount, disk := range metrics.Disks {
+			if disk == nil || mount == "" {
+				continue
+			}
+			row := *disk
+			row.DeviceID, row.Timestamp, row.Mount, row.Flag = metrics.DeviceID, metrics.Timestamp, mount, metrics.Flag
+			rows.Disks = append(rows.Disks, row)
+		}
+		for name, iface := range metrics.Interfaces {
+			if iface == nil || name == "" {
+				continue
+			}
+			row := *iface
+			row.DeviceID, row.Timestamp, row.Interface, row.Flag = metrics.DeviceID, metrics.Timestamp, name, metrics.Flag
+			row.BootID, row.UptimeSeconds = metrics.BootID, metrics.UptimeSeconds
+			rows.Interfaces = append(rows.Interfaces, row)
+		}
+		for _, metric := range metrics.Metrics {
+			metric.DeviceID, metric.Timestamp, metric.Flag = metrics.DeviceID, metrics.Timestamp, metrics.Flag
+			metric.BootID, metric.UptimeSeconds = metrics.BootID, metrics.UptimeSeconds
+			rows.Custom = append(rows.Custom, metric)
+		}
+		if metrics.ClockSkewMS != nil && metrics.ReceivedAt.After(clocks[metrics.DeviceID].MeasuredAt) {
+			clocks[metrics.DeviceID] = models.DeviceClock{
+				DeviceID:   metrics.DeviceID,
+				OffsetMS:   *metrics.ClockSkewMS,
+				Skewed:     strings.Contains(metrics.Flag, constants.FLAG_CLOCK_SKEW),
+				MeasuredAt: metrics.ReceivedAt,
+			}
+		}
+	}
+
+	b.Rates.Derive(rows)
+
+	start := time.Now()
+	err := b.DBClient.InsertMetrics(rows)
+	fields := logrus.Fields{
+		"samples":    len(batch),
+		"processes":  len(rows.Processes),
+		"disks":      len(rows.Disks),
+		"interfaces": len(rows.Interfaces),
+		"metrics":    len(rows.Custom),
+		"latency_ms": time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		b.Logger.WithError(err).WithFields(fields).Warn("Error inserting metrics batch into DB, inserting its samples one by one")
+		if !b.insertSamples(rows) {
+			return
+		}
+	} else {
+		b.Logger.WithFields(fields).Info("Inserted metrics batch")
+	}
+
+	offsets := make([]models.DeviceClock, 0, len(clocks))
+	for _, clock := range clocks {
+		offsets = append(offsets, clock)
+	}
+	if err := b.DBClient.UpdateDeviceClocks(offsets); err != nil {
+		b.Logger.WithError(err).Error("Error updating device clock offsets")
+	}
+}
+
+// insertSamples inserts each sample of a batch that failed in a transaction of its own, so a
+// sample the database rejects only costs itself. It reports whether any sample was written.
+func (b *MetricsBatcher) insertSamples(rows *models.MetricsBatch) bool {
+	samples := rows.Samples()
+	dropped := 0
+	var lastErr error
+	for _, sample := range samples {
+		if err := b.DBClient.InsertMetrics(sample); err != nil {
+			dropped++
+			lastErr = err
+		}
+	}
+	if dropped > 0 {
+		b.Logger.WithError(lastErr).Errorf("Dropped %d of %d metrics samples that could not be inserted into DB", dropped, len(samples))
+	}
+	return dropped < len(samples)
+}
@@ -0,0 +1,237 @@
+package services
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/benmeehan/iot-metrics-service/internal/constants"
+	"github.com/benmeehan/iot-metrics-service/internal/database"
+	"github.com/benmeehan/iot-metrics-service/internal/models"
+	"github.com/sirupsen/logrus"
+)
+
+// counterPoint is a reading of a counter series
+type counterPoint struct {
+	At            time.Time
+	Value         float64
+	BootID        string // empty when the device sent none or the reading was loaded from the database
+	UptimeSeconds *int64 // seconds, nil when the device sent none or the reading was loaded from the database
+}
+
+// rebootedSince reports whether the device's boot ID changed or its uptime went down since
+// the last reading
+func (p counterPoint) rebootedSince(last counterPoint) bool {
+	if p.BootID != "" && last.BootID != "" && p.BootID != last.BootID {
+		return true
+	}
+	return p.UptimeSeconds != nil && last.UptimeSeconds != nil && *p.UptimeSeconds < *last.UptimeSeconds
+}
+
+// RateTracker derives per-second rates from cumulative counters: the interface counters and
+// custom metrics of kind counter. It keeps the last reading of every series in memory. The
+// first time a device is seen, its series are warmed up from the latest stored samples, so a
+// restart doesn't cost a sample's rate.
+//
+// No rate is derived for the first reading of a series, after a gap longer than MaxGap, when
+// the device rebooted or when the counter went down; the reading becomes the new baseline. A
+// reboot is told by the sample's boot_id or uptime_seconds, so a counter that restarted from
+// zero and already climbed past its last reading doesn't give a bogus rate. Devices that send
+// neither are only caught when the counter went down.
+type RateTracker struct {
+	DBClient database.DB
+	MaxGap   time.Duration // readings further apart don't get a rate
+	Logger   *logrus.Logger
+
+	mu        sync.Mutex
+	last      map[string]counterPoint // series key -> last reading
+	devices   map[string]time.Time    // device ID -> last reading, for devices that are warmed up
+	lastPrune time.Time
+}
+
+// NewRateTracker creates a new instance of RateTracker
+func NewRateTracker(dbClient database.DB, maxGap time.Duration, logger *logrus.Logger) *RateTracker {
+	if maxGap <= 0 {
+		maxGap = 10 * time.Minute
+	}
+	return &RateTracker{
+		DBClient:  dbClient,
+		MaxGap:    maxGap,
+		Logger:    logger,
+		last:      make(map[string]counterPoint),
+		devices:   make(map[string]time.Time),
+		lastPrune: time.Now(),
+	}
+}
+
+// Derive fills in the rates of the interface counters and custom counters in the batch. Rows
+// are handled in timestamp order; a reading older than the last one of its series is stored
+// without a rate and leaves the series as it is.
+func (r *RateTracker) Derive(batch *models.MetricsBatch) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.warmUp(batch)
+
+	sort.SliceStable(batch.Interfaces, func(i, j int) bool {
+		return batch.Interfaces[i].Timestamp.Before(batch.Interfaces[j].Timestamp)
+	})
+	for i := range batch.Interfaces {
+		iface := &batch.Interfaces[i]
+		r.devices[iface.DeviceID] = iface.Timestamp
+		for _, c := range interfaceCounters(iface) {
+			if *c.raw != nil {
+				point := counterPoint{At: iface.Timestamp, Value: float64(**c.raw), BootID: iface.BootID, UptimeSeconds: iface.UptimeSeconds}
+				*c.rate = r.rate(interfaceKey(iface.DeviceID, iface.Interface, c.name), point)
+			}
+		}
+	}
+
+	sort.SliceStable(batch.Custom, func(i, j int) bool {
+		return batch.Custom[i].Timestamp.Before(batch.Custom[j].Timestamp)
+	})
+	for i := range batch.Custom {
+		metric := &batch.Custom[i]
+		if metric.Kind != constants.METRIC_KIND_COUNTER {
+			continue
+		}
+		r.devices[metric.DeviceID] = metric.Timestamp
+		point := counterPoint{At: metric.Timestamp, Value: metric.Value, BootID: metric.BootID, UptimeSeconds: metric.UptimeSeconds}
+		metric.Rate = r.rate(metricKey(metric), point)
+	}
+
+	r.prune()
+}
+
+// rate records the reading and returns its rate against the previous one, nil if there is none
+func (r *RateTracker) rate(key string, point counterPoint) *float64 {
+	last, ok := r.last[key]
+	if ok && !point.At.After(last.At) {
+		return nil
+	}
+	r.last[key] = point
+
+	elapsed := point.At.Sub(last.At)
+	if !ok || elapsed > r.MaxGap || point.Value < last.Value || point.rebootedSince(last) {
+		return nil
+	}
+	rate := (point.Value - last.Value) / elapsed.Seconds()
+	return &rate
+}
+
+// warmUp loads the latest stored readings of the devices in the batch that haven't been seen
+// yet. Readings that are older than the ones in memory are ignored. A device whose readings
+// could not be loaded is tried again with its next batch.
+func (r *RateTracker) warmUp(batch *models.MetricsBatch) {
+	var deviceIDs []string
+	seen := make(map[string]bool)
+	add := func(deviceID string) {
+		if _, ok := r.devices[deviceID]; !ok && !seen[deviceID] {
+			seen[deviceID] = true
+			deviceIDs = append(deviceIDs, deviceID)
+		}
+	}
+	for _, iface := range batch.Interfaces {
+		add(iface.DeviceID)
+	}
+	for _, metric := range batch.Custom {
+		if metric.Kind == constants.METRIC_KIND_COUNTER {
+			add(metric.DeviceID)
+		}
+	}
+	if len(deviceIDs) == 0 {
+		return
+	}
+
+	since := time.Now().Add(-r.MaxGap)
+	interfaces, err := r.DBClient.LatestNetworkMetrics(deviceIDs, since)
+	if err != nil {
+		r.Logger.WithError(err).Errorf("Failed to load the latest interface counters of %d devices", len(deviceIDs))
+		return
+	}
+	counters, err := r.DBClient.LatestCounterMetrics(deviceIDs, since)
+	if err != nil {
+		r.Logger.WithError(err).Errorf("Failed to load the latest counter metrics of %d devices", len(deviceIDs))
+		return
+	}
+
+	for i := range interfaces {
+		iface := &interfaces[i]
+		for _, c := range interfaceCounters(iface) {
+			if *c.raw != nil {
+				r.restore(interfaceKey(iface.DeviceID, iface.Interface, c.name), iface.Timestamp, float64(**c.raw))
+			}
+		}
+	}
+	for i := range counters {
+		r.restore(metricKey(&counters[i]), counters[i].Timestamp, counters[i].Value)
+	}
+	for _, deviceID := range deviceIDs {
+		r.devices[deviceID] = since
+	}
+}
+
+// restore sets the last reading of a series unless a newer one is already known
+func (r *RateTracker) restore(key string, at time.Time, value float64) {
+	if last, ok := r.last[key]; ok && !at.After(last.At) {
+		return
+	}
+	r.last[key] = counterPoint{At: at, Value: value}
+}
+
+// prune forgets the readings older than MaxGap, which can't give a rate anymore, and the
+// devices that haven't sent a counter since. It runs at most once per MaxGap.
+func (r *RateTracker) prune() {
+	now := time.Now()
+	if now.Sub(r.lastPrune) < r.MaxGap {
+		return
+	}
+	r.lastPrune = now
+
+	cutoff := now.Add(-r.MaxGap)
+	for key, point := range r.last {
+		if point.At.Before(cutoff) {
+			delete(r.last, key)
+		}
+	}
+	for deviceID, at := range r.devices {
+		if at.Before(cutoff) {
+			delete(r.devices, deviceID)
+		}
+	}
+}
+
+// interfaceCounter pairs a raw interface counter with its rate
+type interfaceCounter struct {
+	name string
+	raw  **int64
+	rate **float64
+}
+
+// interfaceCounters lists the counters of an interface
+func interfaceCounters(iface *models.NetworkMetrics) []interfaceCounter {
+	return []interfaceCounter{
+		{"rx_bytes", &iface.RxBytes, &iface.RxBytesRate},
+		{"tx_bytes", &iface.TxBytes, &iface.TxBytesRate},
+		{"rx_packets", &iface.RxPackets, &iface.RxPacketsRate},
+		{"tx_packets", &iface.TxPackets, &iface.TxPacketsRate},
+		{"rx_errors", &iface.RxErrors, &iface.RxErrorsRate},
+		{"tx_errors", &iface.TxErrors, &iface.TxErrorsRate},
+	}
+}
+
+// interfaceKey identifies a counter of a device's interface
+func interfaceKey(deviceID, iface, counter string) string {
+	return deviceID + "\x00interface\x00" + iface + "\x00" + counter
+}
+
+// metricKey identifies a device's custom series by name and labels. Labels are marshalled with
+// sorted keys, so equal labels give equal keys.
+func metricKey(metric *models.Metric) string {
+	labels := []byte("{}")
+	if len(metric.Labels) > 0 {
+		labels, _ = json.Marshal(metric.Labels)
+	}
+	return metric.DeviceID + "\x00metric\x00" + metric.Name + "\x00" + string(labels)
+}
@@ -0,0 +1,103 @@
+package services
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRateTrackerRate(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	uptime := func(seconds int64) *int64 { return &seconds }
+	reading := func(offset time.Duration, value float64) counterPoint {
+		return counterPoint{At: start.Add(offset), Value: value}
+	}
+	booted := func(point counterPoint, bootID string, uptimeSeconds *int64) counterPoint {
+		point.BootID, point.UptimeSeconds = bootID, uptimeSeconds
+		return point
+	}
+
+	tests := []struct {
+		name     string
+		readings []counterPoint
+		want     []float64 // rate of each reading, -1 for none
+	}{
+		{
+			name:     "first reading",
+			readings: []counterPoint{reading(0, 100)},
+			want:     []float64{-1},
+		},
+		{
+			name:     "steady counter",
+			readings: []counterPoint{reading(0, 100), reading(10*time.Second, 150), reading(20*time.Second, 250)},
+			want:     []float64{-1, 5, 10},
+		},
+		{
+			name:     "gap longer than max gap",
+			readings: []counterPoint{reading(0, 100), reading(11*time.Minute, 200), reading(11*time.Minute+10*time.Second, 300)},
+			want:     []float64{-1, -1, 10},
+		},
+		{
+			name:     "counter went down",
+			readings: []counterPoint{reading(0, 100), reading(10*time.Second, 20), reading(20*time.Second, 70)},
+			want:     []float64{-1, -1, 5},
+		},
+		{
+			name: "reboot by boot ID",
+			readings: []counterPoint{
+				booted(reading(0, 100), "boot-1", nil),
+				booted(reading(10*time.Second, 150), "boot-2", nil),
+				booted(reading(20*time.Second, 200), "boot-2", nil),
+			},
+			want: []float64{-1, -1, 5},
+		},
+		{
+			name: "reboot by uptime",
+			readings: []counterPoint{
+				booted(reading(0, 100), "", uptime(3600)),
+				booted(reading(10*time.Second, 150), "", uptime(5)),
+				booted(reading(20*time.Second, 200), "", uptime(15)),
+			},
+			want: []float64{-1, -1, 5},
+		},
+		{
+			name: "restored reading without boot",
+			readings: []counterPoint{
+				reading(0, 100),
+				booted(reading(10*time.Second, 150), "boot-1", uptime(60)),
+			},
+			want: []float64{-1, 5},
+		},
+		{
+			name:     "out of order",
+			readings: []counterPoint{reading(0, 100), reading(20*time.Second, 200), reading(10*time.Second, 150), reading(30*time.Second, 300)},
+			want:     []float64{-1, 5, -1, 10},
+		},
+		{
+			name:     "same timestamp",
+			readings: []counterPoint{reading(0, 100), reading(0, 200)},
+			want:     []float64{-1, -1},
+		},
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := NewRateTracker(nil, 10*time.Minute, logger)
+			for i, point := range tt.readings {
+				got := tracker.rate("device\x00metric\x00counter\x00{}", point)
+				switch {
+				case tt.want[i] < 0 && got != nil:
+					t.Errorf("reading %d: got rate %v, want none", i, *got)
+				case tt.want[i] >= 0 && got == nil:
+					t.Errorf("reading %d: got no rate, want %v", i, tt.want[i])
+				case tt.want[i] >= 0 && *got != tt.want[i]:
+					t.Errorf("reading %d: got rate %v, want %v", i, *got, tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/benmeehan/iot-metrics-service/internal/constants"
+	"github.com/benmeehan/iot-metrics-service/internal/database"
+	"github.com/benmeehan/iot-metrics-service/internal/models"
+	"github.com/sirupsen/logrus"
+)
+
+// Tables that have rollups
+const (
+	systemMetricsTable  = "system_metrics"
+	processMetricsTable = "process_metrics"
+)
+
+// ErrRangeTooLarge is returned when even the coarsest rollup has too many buckets in the range
+var ErrRangeTooLarge = errors.New("range has too many buckets")
+
+// rollup is a continuous aggregate of a metrics table, named <table>_<Suffix>
+type rollup struct {
+	Suffix string
+	Bucket time.Duration
+}
+
+// rollups from the finest to the coarsest
+var rollups = []rollup{
+	{Suffix: constants.ROLLUP_1M, Bucket: time.Minute},
+	{Suffix: constants.ROLLUP_1H, Bucket: time.Hour},
+	{Suffix: constants.ROLLUP_1D, Bucket: 24 * time.Hour},
+}
+
+// RollupService reads system metrics and top processes from the rollups instead of the raw
+// samples. Each query is served from the coarsest rollup whose buckets are no larger than the
+// requested resolution, or a coarser one when that rollup would return more than MaxPoints
+// buckets or no longer holds the start of the range.
+type RollupService struct {
+	DBClient  database.DB
+	MaxPoints int                      // buckets a query may return
+	Retention map[string]time.Duration // how long each rollup is kept by view name, missing ones are kept forever
+	Logger    *logrus.Logger
+}
+
+// NewRollupService creates a new instance of RollupService
+func NewRollupService(dbClient database.DB, maxPoints int, retention map[string]time.Duration, logger *logrus.Logger) *RollupService {
+	if maxPoints <= 0 {
+		maxPoints = 1000
+	}
+	return &RollupService{
+		DBClient:  dbClient,
+		MaxPoints: maxPoints,
+		Retention: retention,
+		Logger:    logger,
+	}
+}
+
+// ApplyRetention sets the retention of every rollup, removing it from the rollups that are
+// kept forever
+func (s *RollupService) ApplyRetention() error {
+	for _, table := range []string{systemMetricsTable, processMetricsTable} {
+		for _, r := range rollups {
+			view := table + "_" + r.Suffix
+			if err := s.DBClient.ApplyRollupRetention(view, s.Retention[view]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Backfill materializes the rollups over the samples stored before they were created, which
+// their refresh policies don't reach back to. rawRetention is how long the samples of each
+// table are kept; older samples are gone, so their buckets are left as they are, and so are
+// buckets older than the rollup's own retention.
+func (s *RollupService) Backfill(rawRetention map[string]time.Duration) {
+	start := time.Now()
+	for _, table := range []string{systemMetricsTable, processMetricsTable} {
+		for _, r := range rollups {
+			view := table + "_" + r.Suffix
+			var since *time.Time
+			if retention := shorter(rawRetention[table], s.Retention[view]); retention > 0 {
+				from := start.Add(-retention)
+				since = &from
+			}
+			if err := s.DBClient.RefreshRollup(view, since); err != nil {
+				s.Logger.WithError(err).Errorf("Failed to backfill rollup %s", view)
+				return
+			}
+		}
+	}
+	s.Logger.Infof("Backfilled metrics rollups in %s", time.Since(start))
+}
+
+// SystemSeries returns the device's system metrics in [from, to) at the given resolution,
+// 0 for the finest one within MaxPoints
+func (s *RollupService) SystemSeries(deviceID string, from, to time.Time, resolution time.Duration) (*models.SystemSeries, error) {
+	view, r, from, to, err := s.pick(systemMetricsTable, from, to, resolution)
+	if err != nil {
+		return nil, err
+	}
+
+	buckets, err := s.DBClient.ListSystemRollups(view, deviceID, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", view, err)
+	}
+	if buckets == nil {
+		buckets = []models.SystemRollup{}
+	}
+	return &models.SystemSeries{
+		DeviceID:      deviceID,
+		From:          from,
+		To:            to,
+		Rollup:        view,
+		BucketSeconds: int64(r.Bucket.Seconds()),
+		Buckets:       buckets,
+	}, nil
+}
+
+// ProcessSeries returns the device's top processes by CPU or memory in each bucket of
+// [from, to), with the resolution chosen like in SystemSeries
+func (s *RollupService) ProcessSeries(deviceID string, from, to time.Time, resolution time.Duration, top int, by string) (*models.ProcessSeries, error) {
+	view, r, from, to, err := s.pick(processMetricsTable, from, to, resolution)
+	if err != nil {
+		return nil, err
+	}
+
+	processes, err := s.DBClient.ListTopProcesses(view, deviceID, from, to, top, by)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", view, err)
+	}
+
+	// Processes come ordered by bucket and rank
+	buckets := []models.ProcessBucket{}
+	for _, process := range processes {
+		if n := len(buckets); n == 0 || !buckets[n-1].Bucket.Equal(process.Bucket) {
+			buckets = append(buckets, models.ProcessBucket{Bucket: process.Bucket})
+		}
+		last := &buckets[len(buckets)-1]
+		last.Processes = append(last.Processes, process)
+	}
+	return &models.ProcessSeries{
+		DeviceID:      deviceID,
+		From:          from,
+		To:            to,
+		Rollup:        view,
+		BucketSeconds: int64(r.Bucket.Seconds()),
+		Top:           top,
+		By:            by,
+		Buckets:       buckets,
+	}, nil
+}
+
+// pick chooses the rollup of the table to read [from, to) from and aligns the range to its
+// buckets
+func (s *RollupService) pick(table string, from, to time.Time, resolution time.Duration) (string, rollup, time.Time, time.Time, error) {
+	i := 0
+	for i+1 < len(rollups) && rollups[i+1].Bucket <= resolution {
+		i++
+	}
+	for ; i+1 < len(rollups); i++ {
+		if s.points(rollups[i], from, to) <= s.MaxPoints && s.holds(table+"_"+rollups[i].Suffix, from) {
+			break
+		}
+	}
+
+	r := rollups[i]
+	if s.points(r, from, to) > s.MaxPoints {
+		return "", r, from, to, fmt.Errorf("%w: at most %d buckets of %s", ErrRangeTooLarge, s.MaxPoints, r.Bucket)
+	}
+	from, to = from.UTC().Truncate(r.Bucket), ceil(to.UTC(), r.Bucket)
+	return table + "_" + r.Suffix, r, from, to, nil
+}
+
+// points returns the number of the rollup's buckets in [from, to)
+func (s *RollupService) points(r rollup, from, to time.Time) int {
+	return int(ceil(to.UTC(), r.Bucket).Sub(from.UTC().Truncate(r.Bucket)) / r.Bucket)
+}
+
+// holds reports whether the rollup still holds the buckets from the given time on
+func (s *RollupService) holds(view string, from time.Time) bool {
+	retention := s.Retention[view]
+	return retention <= 0 || !from.Before(time.Now().Add(-retention))
+}
+
+// ceil rounds t up to a multiple of d
+func ceil(t time.Time, d time.Duration) time.Time {
+	truncated := t.Truncate(d)
+	if truncated.Equal(t) {
+		return t
+	}
+	return truncated.Add(d)
+}
+
+// shorter returns the shorter of two retentions, where 0 means forever
+func shorter(a, b time.Duration) time.Duration {
+	if a <= 0 || (b > 0 && b < a) {
+		return b
+	}
+	return a
+}
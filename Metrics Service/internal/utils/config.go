@@ -1,81 +1,127 @@
-package utils
-
-import (
-	"os"
-
-	"github.com/sirupsen/logrus"
-	"gopkg.in/yaml.v2"
-)
-
-// Config represents the structure of the configuration file.
-type Config struct {
-	MQTT struct {
-		Broker   string `yaml:"broker"`    // MQTT broker address
-		ClientID string `yaml:"client_id"` // MQTT client ID
-		QOS      int    `yaml:"QOS"`       // MQTT Quality of Service
-		TLS      struct {
-			CACert string `yaml:"ca_cert"`
-		} `yaml:"tls"` // Path to the CA certificate
-		Topic string `yaml:"topic"`
-	} `yaml:"mqtt"`
-
-	DB struct {
-		Host     string `yaml:"host"`     // Database host address
-		Port     int    `yaml:"port"`     // Database port
-		User     string `yaml:"user"`     // Database user
-		Password string `yaml:"password"` // Database password
-		Name     string `yaml:"dbname"`   // Database name
-		SSLMode  string `yaml:"sslmode"`  // SSL mode for the connection
-	} `yaml:"database"`
-
-	Kafka struct {
-		Topic            string   `yaml:"topic"`             // Kafka topic
-		Brokers          []string `yaml:"brokers"`           // List of Kafka brokers
-		ClientID         string   `yaml:"client_id"`         // Kafka client ID
-		SecurityProtocol string   `yaml:"security_protocol"` // Security protocol
-		GroupID          string   `yaml:"group_id"`          // Consumer Group ID
-		SSL              struct {
-			CACert string `yaml:"ca_cert"` // Path to the CA certificate
-			Cert   string `yaml:"cert"`    // Path to the client certificate
-			Key    string `yaml:"key"`     // Path to the client key
-		} `yaml:"ssl"`
-		SASL struct {
-			Mechanism string `yaml:"mechanism"` // SASL mechanism
-			Username  string `yaml:"username"`  // SASL username
-			Password  string `yaml:"password"`  // SASL password
-		} `yaml:"sasl"`
-	} `yaml:"kafka"`
-
-	Service struct {
-		Mode string `yaml:"mode"` // Direct MQTT or Queue mode
-	} `yaml:"service"`
-
-	Device struct {
-		SecretFile string `yaml:"secret_file"` // Device secret location
-	} `yaml:"device"`
-}
-
-// LoadConfig loads the YAML configuration from the specified file.
-// It returns a pointer to the Config struct and an error if loading fails.
-func LoadConfig(filename string, logger *logrus.Logger) (*Config, error) {
-	logger.Infof("Loading configuration from file: %s", filename)
-
-	file, err := os.Open(filename)
-	if err != nil {
-		logger.Errorf("Failed to open config file: %v", err)
-		return nil, err
-	}
-	defer file.Close()
-
-	// Decode the YAML file into the Config struct
-	var config Config
-	decoder := yaml.NewDecoder(file)
-	err = decoder.Decode(&config)
-	if err != nil {
-		logger.Errorf("Failed to decode config file: %v", err)
-		return nil, err
-	}
-
-	logger.Infof("Configuration loaded successfully from %s", filename)
-	return &config, nil
-}
+package utils
+
+import (
+	"os"
+	"time"
+
+	"github.com/benmeehan/iot-metrics-service/internal/models"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// Config represents the structure of the configuration file.
+type Config struct {
+	MQTT struct {
+		Broker   string `yaml:"broker"`    // MQTT broker address
+		ClientID string `yaml:"client_id"` // MQTT client ID
+		QOS      int    `yaml:"QOS"`       // MQTT Quality of Service
+		TLS      struct {
+			CACert string `yaml:"ca_cert"`
+		} `yaml:"tls"` // Path to the CA certificate
+		Topic             string `yaml:"topic"`
+		DeviceEventsTopic string `yaml:"device_events_topic"` // Device lifecycle events from the registration service
+	} `yaml:"mqtt"`
+
+	DB struct {
+		Host     string `yaml:"host"`     // Database host address
+		Port     int    `yaml:"port"`     // Database port
+		User     string `yaml:"user"`     // Database user
+		Password string `yaml:"password"` // Database password
+		Name     string `yaml:"dbname"`   // Database name
+		SSLMode  string `yaml:"sslmode"`  // SSL mode for the connection
+	} `yaml:"database"`
+
+	Kafka struct {
+		Topic             string   `yaml:"topic"`               // Kafka topic
+		DeviceEventsTopic string   `yaml:"device_events_topic"` // Kafka topic for device lifecycle events
+		Brokers           []string `yaml:"brokers"`             // List of Kafka brokers
+		ClientID          string   `yaml:"client_id"`           // Kafka client ID
+		SecurityProtocol  string   `yaml:"security_protocol"`   // Security protocol
+		GroupID           string   `yaml:"group_id"`            // Consumer Group ID
+		SSL               struct {
+			CACert string `yaml:"ca_cert"` // Path to the CA certificate
+			Cert   string `yaml:"cert"`    // Path to the client certificate
+			Key    string `yaml:"key"`     // Path to the client key
+		} `yaml:"ssl"`
+		SASL struct {
+			Mechanism string `yaml:"mechanism"` // SASL mechanism
+			Username  string `yaml:"username"`  // SASL username
+			Password  string `yaml:"password"`  // SASL password
+		} `yaml:"sasl"`
+	} `yaml:"kafka"`
+
+	Service struct {
+		Mode string `yaml:"mode"` // Direct MQTT or Queue mode
+	} `yaml:"service"`
+
+	Auth struct {
+		RequireToken   bool          `yaml:"require_token"`    // Drop data without a valid access token
+		PublicKeyFiles []string      `yaml:"public_key_files"` // Ed25519 keys the registration service signs tokens with
+		Issuer         string        `yaml:"issuer"`           // Expected token issuer
+		Leeway         time.Duration `yaml:"leeway"`           // Clock skew tolerated on token expiry
+	} `yaml:"auth"`
+
+	Ingest struct {
+		QueueSize      int           `yaml:"queue_size"`      // Samples buffered before callbacks block
+		Workers        int           `yaml:"workers"`         // Concurrent database writers
+		BatchSize      int           `yaml:"batch_size"`      // Samples per transaction, each with its processes
+		FlushInterval  time.Duration `yaml:"flush_interval"`  // Longest time a sample waits in a partial batch
+		EnqueueTimeout time.Duration `yaml:"enqueue_timeout"` // How long a full queue blocks before dropping, 0 never drops
+	} `yaml:"ingest"`
+
+	Rates struct {
+		MaxGap time.Duration `yaml:"max_gap"` // Counter readings further apart, or older at startup, get no rate
+	} `yaml:"rates"`
+
+	// Storage holds the chunking, compression and retention of each hypertable by table name
+	Storage map[string]models.StoragePolicy `yaml:"storage"`
+
+	Rollups struct {
+		MaxPoints int                      `yaml:"max_points"` // Buckets a query may return before a coarser rollup is used
+		Retention map[string]time.Duration `yaml:"retention"`  // How long each rollup is kept by view name, missing ones are kept forever
+	} `yaml:"rollups"`
+
+	API struct {
+		Address   string `yaml:"address"`    // Listen address of the metrics API
+		TokenFile string `yaml:"token_file"` // Bearer token required by the metrics API
+	} `yaml:"api"`
+
+	Clock struct {
+		MaxSkew       time.Duration `yaml:"max_skew"`       // Device timestamps further off are flagged clock_skew
+		CorrectSkewed bool          `yaml:"correct_skewed"` // Store skewed data at the receive time instead
+	} `yaml:"clock"`
+
+	Devices struct {
+		BlockedAction   string        `yaml:"blocked_action"`   // drop or flag data from suspended and decommissioned devices
+		RefreshInterval time.Duration `yaml:"refresh_interval"` // How often blocked devices are reloaded from the database
+	} `yaml:"devices"`
+
+	Device struct {
+		SecretFile string `yaml:"secret_file"` // Device secret location
+	} `yaml:"device"`
+}
+
+// LoadConfig loads the YAML configuration from the specified file.
+// It returns a pointer to the Config struct and an error if loading fails.
+func LoadConfig(filename string, logger *logrus.Logger) (*Config, error) {
+	logger.Infof("Loading configuration from file: %s", filename)
+
+	file, err := os.Open(filename)
+	if err != nil {
+		logger.Errorf("Failed to open config file: %v", err)
+		return nil, err
+	}
+	defer file.Close()
+
+	// Decode the YAML file into the Config struct
+	var config Config
+	decoder := yaml.NewDecoder(file)
+	err = decoder.Decode(&config)
+	if err != nil {
+		logger.Errorf("Failed to decode config file: %v", err)
+		return nil, err
+	}
+
+	logger.Infof("Configuration loaded successfully from %s", filename)
+	return &config, nil
+}
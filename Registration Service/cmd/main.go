@@ -1,90 +1,242 @@
-package main
-
-import (
-	"fmt"
-	"os"
-
-	"github.com/benmeehan/iot-registration-service/internal/constants"
-	"github.com/benmeehan/iot-registration-service/internal/database"
-	"github.com/benmeehan/iot-registration-service/internal/services"
-	"github.com/benmeehan/iot-registration-service/internal/utils"
-	"github.com/benmeehan/iot-registration-service/pkg/file"
-	"github.com/benmeehan/iot-registration-service/pkg/kafka"
-	"github.com/benmeehan/iot-registration-service/pkg/mqtt"
-	"github.com/google/uuid"
-
-	"github.com/sirupsen/logrus"
-)
-
-func main() {
-	// Set up structured logging with JSON output
-	var log = &logrus.Logger{
-		Out:       os.Stdout,
-		Formatter: new(logrus.JSONFormatter),
-		Hooks:     make(logrus.LevelHooks),
-		Level:     logrus.InfoLevel,
-	}
-
-	// Load configuration from file
-	config, err := utils.LoadConfig("config/config.yaml", log)
-	if err != nil {
-		log.WithError(err).Fatal("Failed to load configuration")
-	}
-
-	// Generate a unique MQTT Client ID by appending a UUID
-	config.MQTT.ClientID = config.MQTT.ClientID + "-" + uuid.New().String()
-	log.Infof("Using MQTT Client ID: %s", config.MQTT.ClientID)
-
-	// Initialize the shared MQTT connection
-	mqttClient := mqtt.NewMqttService(log)
-	err = mqttClient.Initialize(config.MQTT.Broker, config.MQTT.ClientID, config.MQTT.TLS.CACert)
-	if err != nil {
-		log.WithError(err).Fatal("Failed to initialize MQTT connection")
-	}
-
-	// Initialize the database connection
-	dBClient := database.NewDatabase(log)
-	connStr := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
-		config.DB.Host, config.DB.Port, config.DB.User, config.DB.Password, config.DB.Name, config.DB.SSLMode)
-
-	if err := dBClient.Connect(connStr); err != nil {
-		log.WithError(err).Fatal("Failed to initialize database connection")
-	}
-	defer dBClient.Close()
-
-	// Initialize file operations handler
-	fileClient := file.NewFileService(log)
-
-	secret, err := fileClient.ReadFile(config.Device.SecretFile)
-	if err != nil {
-		log.WithError(err).Fatal("Failed to read auth secret")
-	}
-
-	var kafkaClient *kafka.KafkaClient
-
-	// Initialize Kafka client only if the mode is queue
-	if config.Service.Mode == constants.QUEUE_MODE {
-		kafkaClient, err = kafka.NewKafkaClient(
-			config.Kafka.SecurityProtocol,
-			config.Kafka.SSL.CACert,
-			config.Kafka.SSL.Cert,
-			config.Kafka.SSL.Key,
-			config.Kafka.SASL.Mechanism,
-			config.Kafka.SASL.Username,
-			config.Kafka.SASL.Password,
-			config.Kafka.Brokers,
-			config.Kafka.GroupID,
-			log,
-		)
-		if err != nil {
-			log.WithError(err).Fatal("Failed to initialize Kafka Client")
-		}
-	}
-
-	registraionService := services.NewRegistrationService(config.Service.Mode, mqttClient, kafkaClient, dBClient, config.MQTT.Topics.Response, config.MQTT.Topics.Request, config.MQTT.QOS, secret, log)
-	registraionService.ListenForDeviceRegistration()
-
-	// Block the main thread to keep services running
-	log.Info("Registration service is running...")
-	select {}
-}
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/benmeehan/iot-registration-service/internal/api"
+	"github.com/benmeehan/iot-registration-service/internal/constants"
+	"github.com/benmeehan/iot-registration-service/internal/database"
+	"github.com/benmeehan/iot-registration-service/internal/services"
+	"github.com/benmeehan/iot-registration-service/internal/utils"
+	"github.com/benmeehan/iot-registration-service/pkg/ca"
+	"github.com/benmeehan/iot-registration-service/pkg/file"
+	"github.com/benmeehan/iot-registration-service/pkg/kafka"
+	"github.com/benmeehan/iot-registration-service/pkg/mqtt"
+	"github.com/benmeehan/iot-registration-service/pkg/token"
+	"github.com/google/uuid"
+
+	"github.com/sirupsen/logrus"
+)
+
+func main() {
+	// Set up structured logging with JSON output
+	var log = &logrus.Logger{
+		Out:       os.Stdout,
+		Formatter: new(logrus.JSONFormatter),
+		Hooks:     make(logrus.LevelHooks),
+		Level:     logrus.InfoLevel,
+	}
+
+	// Load configuration from file
+	config, err := utils.LoadConfig("config/config.yaml", log)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to load configuration")
+	}
+
+	connStr := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		config.DB.Host, config.DB.Port, config.DB.User, config.DB.Password, config.DB.Name, config.DB.SSLMode)
+
+	// "migrate up|down [steps]|status" manages the database schema and exits
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrate(connStr, os.Args[2:], log)
+		return
+	}
+
+	// In queue mode requests and responses go through Kafka and the connector, so the
+	// service doesn't connect to the broker at all
+	var mqttClient *mqtt.MqttService
+	if config.Service.Mode != constants.QUEUE_MODE {
+		// Generate a unique MQTT Client ID by appending a UUID
+		config.MQTT.ClientID = config.MQTT.ClientID + "-" + uuid.New().String()
+		log.Infof("Using MQTT Client ID: %s", config.MQTT.ClientID)
+
+		// Initialize the shared MQTT connection
+		mqttClient = mqtt.NewMqttService(log)
+		err = mqttClient.Initialize(config.MQTT.Broker, config.MQTT.ClientID, config.MQTT.TLS.CACert)
+		if err != nil {
+			log.WithError(err).Fatal("Failed to initialize MQTT connection")
+		}
+	}
+
+	// Initialize the database connection
+	dBClient := database.NewDatabase(log)
+	if err := dBClient.Connect(connStr); err != nil {
+		log.WithError(err).Fatal("Failed to initialize database connection")
+	}
+	defer dBClient.Close()
+
+	// Initialize file operations handler
+	fileClient := file.NewFileService(log)
+
+	// The shared secret is only needed when legacy PSK registration is enabled
+	var secret string
+	if config.Device.LegacyPSK {
+		secret, err = fileClient.ReadFile(config.Device.SecretFile)
+		if err != nil {
+			log.WithError(err).Fatal("Failed to read auth secret")
+		}
+	}
+
+	adminToken, err := fileClient.ReadFile(config.Admin.TokenFile)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to read admin token")
+	}
+
+	var kafkaClient *kafka.KafkaClient
+
+	// Initialize Kafka client only if the mode is queue
+	if config.Service.Mode == constants.QUEUE_MODE {
+		kafkaClient, err = kafka.NewKafkaClient(
+			config.Kafka.SecurityProtocol,
+			config.Kafka.SSL.CACert,
+			config.Kafka.SSL.Cert,
+			config.Kafka.SSL.Key,
+			config.Kafka.SASL.Mechanism,
+			config.Kafka.SASL.Username,
+			config.Kafka.SASL.Password,
+			config.Kafka.Brokers,
+			config.Kafka.GroupID,
+			log,
+		)
+		if err != nil {
+			log.WithError(err).Fatal("Failed to initialize Kafka Client")
+		}
+		defer kafkaClient.Close()
+	}
+
+	credentialService := services.NewCredentialService(dBClient, log)
+
+	// Load the device CA only when certificate issuance is enabled
+	var certificateService *services.CertificateService
+	if config.CA.Enabled {
+		authority, err := ca.LoadCertificateAuthority(config.CA.CertFile, config.CA.KeyFile, config.CA.Validity, log)
+		if err != nil {
+			log.WithError(err).Fatal("Failed to load device CA")
+		}
+		certificateService = services.NewCertificateService(authority, dBClient, config.CA.CRLValidity, log)
+	}
+
+	switch config.Registration.ReregistrationPolicy {
+	case constants.REREGISTRATION_POLICY_KEEP, constants.REREGISTRATION_POLICY_ROTATE, constants.REREGISTRATION_POLICY_REJECT:
+	default:
+		log.Fatalf("Unknown re-registration policy %q", config.Registration.ReregistrationPolicy)
+	}
+
+	approvalPolicy, err := services.NewApprovalPolicy(config.Approval.Mode, config.Approval.Rules.CIDRs, config.Approval.Rules.Batches, config.Approval.Rules.Fingerprints)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to load approval policy")
+	}
+
+	// Load the token signing key only when access tokens are enabled
+	var tokenService *services.TokenService
+	if config.Token.Enabled {
+		signer, err := token.LoadSigner(config.Token.KeyFile, config.Token.Issuer, config.Token.TTL)
+		if err != nil {
+			log.WithError(err).Fatal("Failed to load token signing key")
+		}
+		tokenRefreshTopic, tokenResponseTopic := config.MQTT.Topics.TokenRefresh, config.MQTT.Topics.TokenResponse
+		if config.Service.Mode == constants.QUEUE_MODE {
+			tokenRefreshTopic, tokenResponseTopic = config.Kafka.TokenRefreshTopic, config.Kafka.TokenResponseTopic
+		}
+		tokenService = services.NewTokenService(config.Service.Mode, mqttClient, kafkaClient, dBClient, signer, tokenResponseTopic, tokenRefreshTopic, config.MQTT.QOS, config.Token.RefreshGrace, log)
+		tokenService.ListenForTokenRefresh()
+	}
+
+	rateLimiter := services.NewRateLimiter(dBClient,
+		config.RateLimit.ClientRate, config.RateLimit.ClientBurst, config.RateLimit.GlobalRate, config.RateLimit.GlobalBurst,
+		config.RateLimit.LockoutThreshold, config.RateLimit.LockoutBase, config.RateLimit.LockoutMax, config.RateLimit.FailureWindow, log)
+
+	deviceEventsTopic := config.MQTT.Topics.DeviceEvents
+	if config.Service.Mode == constants.QUEUE_MODE {
+		deviceEventsTopic = config.Kafka.DeviceEventsTopic
+	}
+	deviceService := services.NewDeviceService(config.Service.Mode, mqttClient, kafkaClient, dBClient, credentialService, certificateService, deviceEventsTopic, config.MQTT.QOS, log)
+
+	responseTopic, requestTopic := config.MQTT.Topics.Response, config.MQTT.Topics.Request
+	if config.Service.Mode == constants.QUEUE_MODE {
+		responseTopic, requestTopic = config.Kafka.ResponseTopic, config.Kafka.Topic
+	}
+	registraionService := services.NewRegistrationService(config.Service.Mode, mqttClient, kafkaClient, dBClient, credentialService, certificateService, responseTopic, requestTopic, config.MQTT.QOS, secret, config.Device.LegacyPSK, config.Registration.ReregistrationPolicy, approvalPolicy, rateLimiter, tokenService, deviceService, log)
+	registraionService.ListenForDeviceRegistration()
+	registraionService.StartRecordCleanup(config.Registration.RequestRecordTTL)
+
+	// Keep device metadata up to date from agent reports. Updates are authenticated with the
+	// device's access token, so they are only accepted when tokens are enabled.
+	if tokenService != nil {
+		deviceInfoTopic := config.MQTT.Topics.DeviceInfo
+		if config.Service.Mode == constants.QUEUE_MODE {
+			deviceInfoTopic = config.Kafka.DeviceInfoTopic
+		}
+		deviceInfoService := services.NewDeviceInfoService(config.Service.Mode, mqttClient, kafkaClient, dBClient, tokenService.Verifier, deviceInfoTopic, config.MQTT.QOS, log)
+		deviceInfoService.ListenForDeviceInfo()
+	} else {
+		log.Warn("Access tokens are disabled, device info updates are not accepted")
+	}
+
+	// Start the admin API for managing credentials, certificates and devices
+	adminAPI := api.NewAdminAPI(credentialService, certificateService, registraionService, deviceService, strings.TrimSpace(adminToken), log)
+	adminAPI.Start(config.Admin.Address)
+
+	// Block the main thread to keep services running
+	log.Info("Registration service is running...")
+	select {}
+}
+
+// runMigrate runs the migrate subcommand: "up" applies the pending migrations, "down [steps]"
+// reverts the last one or the given number and "status" lists them all. The service applies
+// its pending migrations at startup as well.
+func runMigrate(connStr string, args []string, log *logrus.Logger) {
+	dBClient := database.NewDatabase(log)
+	if err := dBClient.Open(connStr); err != nil {
+		log.WithError(err).Fatal("Failed to initialize database connection")
+	}
+	defer dBClient.Close()
+
+	migrator, err := dBClient.NewMigrator()
+	if err != nil {
+		log.WithError(err).Fatal("Failed to load migrations")
+	}
+
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	switch command {
+	case "up":
+		applied, err := migrator.Up()
+		if err != nil {
+			log.WithError(err).Fatal("Failed to apply migrations")
+		}
+		log.Infof("Applied %d migrations", applied)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				log.Fatalf("Invalid number of migrations to revert: %s", args[1])
+			}
+		}
+		if err := migrator.Down(steps); err != nil {
+			log.WithError(err).Fatal("Failed to revert migrations")
+		}
+	case "status":
+		statuses, err := migrator.Status()
+		if err != nil {
+			log.WithError(err).Fatal("Failed to read migration status")
+		}
+		for _, status := range statuses {
+			applied := "pending"
+			if status.AppliedAt != nil {
+				applied = "applied " + status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%s\t%s\n", status.Version, status.Name, applied)
+		}
+	default:
+		log.Fatalf("Unknown migrate command %q, use up, down [steps] or status", command)
+	}
+}
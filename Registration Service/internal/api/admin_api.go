@@ -0,0 +1,336 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/benmeehan/iot-registration-service/internal/constants"
+	"github.com/benmeehan/iot-registration-service/internal/database"
+	"github.com/benmeehan/iot-registration-service/internal/services"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// AdminAPI exposes operator endpoints of the registration service over HTTP
+type AdminAPI struct {
+	Credentials   *services.CredentialService
+	Certificates  *services.CertificateService // nil when the device CA is disabled
+	Registrations *services.RegistrationService
+	Devices       *services.DeviceService
+	Token         string
+	Logger        *logrus.Logger
+}
+
+// NewAdminAPI creates a new instance of AdminAPI
+func NewAdminAPI(credentials *services.CredentialService, certificates *services.CertificateService, registrations *services.RegistrationService, devices *services.DeviceService, token string, logger *logrus.Logger) *AdminAPI {
+	return &AdminAPI{
+		Credentials:   credentials,
+		Certificates:  certificates,
+		Registrations: registrations,
+		Devices:       devices,
+		Token:         token,
+		Logger:        logger,
+	}
+}
+
+// Start serves the admin API on the given address in the background
+func (a *AdminAPI) Start(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("GET /credentials", a.authorize(a.listCredentials))
+	mux.Handle("POST /credentials", a.authorize(a.createCredential))
+	mux.Handle("GET /credentials/{id}", a.authorize(a.getCredential))
+	mux.Handle("POST /credentials/{id}/revoke", a.authorize(a.revokeCredential))
+	mux.Handle("DELETE /credentials/{id}", a.authorize(a.deleteCredential))
+	mux.Handle("GET /devices", a.authorize(a.listDevices))
+	mux.Handle("POST /devices/{id}/approve", a.authorize(a.approveDevice))
+	mux.Handle("POST /devices/{id}/reject", a.authorize(a.rejectDevice))
+	mux.Handle("POST /devices/{id}/suspend", a.authorize(a.suspendDevice))
+	mux.Handle("POST /devices/{id}/reactivate", a.authorize(a.reactivateDevice))
+	mux.Handle("DELETE /devices/{id}", a.authorize(a.decommissionDevice))
+
+	// Prometheus metrics are scraped without the admin token
+	mux.Handle("GET /metrics", promhttp.Handler())
+
+	if a.Certificates != nil {
+		// The CRL is public so brokers and services can fetch it without the admin token
+		mux.HandleFunc("GET /crl", a.getCRL)
+		mux.Handle("POST /devices/{id}/certificate/revoke", a.authorize(a.revokeDeviceCertificate))
+	}
+
+	go func() {
+		a.Logger.Infof("Admin API listening on %s", address)
+		if err := http.ListenAndServe(address, mux); err != nil {
+			a.Logger.WithError(err).Fatal("Admin API server stopped")
+		}
+	}()
+}
+
+// authorize rejects requests that don't carry the admin bearer token
+func (a *AdminAPI) authorize(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || a.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) != 1 {
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next(w, r)
+	})
+}
+
+func (a *AdminAPI) listCredentials(w http.ResponseWriter, r *http.Request) {
+	credentials, err := a.Credentials.ListCredentials()
+	if err != nil {
+		a.internalError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, credentials)
+}
+
+func (a *AdminAPI) createCredential(w http.ResponseWriter, r *http.Request) {
+	var req services.CreateCredentialRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	credential, secret, err := a.Credentials.CreateCredential(req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// The plaintext secret is only ever returned here
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"credential": credential,
+		"secret":     secret,
+	})
+}
+
+func (a *AdminAPI) getCredential(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	credential, err := a.Credentials.GetCredential(id)
+	if err != nil {
+		a.lookupError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, credential)
+}
+
+func (a *AdminAPI) revokeCredential(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	if err := a.Credentials.RevokeCredential(id); err != nil {
+		a.lookupError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *AdminAPI) deleteCredential(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	if err := a.Credentials.DeleteCredential(id); err != nil {
+		a.lookupError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *AdminAPI) getCRL(w http.ResponseWriter, r *http.Request) {
+	crl, err := a.Certificates.CRL()
+	if err != nil {
+		a.internalError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pkix-crl")
+	w.Write(crl)
+}
+
+func (a *AdminAPI) revokeDeviceCertificate(w http.ResponseWriter, r *http.Request) {
+	id, ok := deviceID(w, r)
+	if !ok {
+		return
+	}
+
+	// The body is optional and defaults to an unspecified reason
+	var req struct {
+		Reason int `json:"reason"`
+	}
+	if !decodeOptionalBody(w, r, &req) {
+		return
+	}
+
+	if err := a.Certificates.RevokeDeviceCertificate(id, req.Reason); err != nil {
+		a.lookupError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listDevices lists devices in a lifecycle state, pending ones by default
+func (a *AdminAPI) listDevices(w http.ResponseWriter, r *http.Request) {
+	state := r.URL.Query().Get("state")
+	if state == "" {
+		state = constants.DEVICE_STATE_PENDING
+	}
+	devices, err := a.Registrations.ListDevices(state)
+	if err != nil {
+		a.internalError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, devices)
+}
+
+func (a *AdminAPI) approveDevice(w http.ResponseWriter, r *http.Request) {
+	id, ok := deviceID(w, r)
+	if !ok {
+		return
+	}
+	if err := a.Registrations.ApproveDevice(id); err != nil {
+		a.lookupError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *AdminAPI) rejectDevice(w http.ResponseWriter, r *http.Request) {
+	id, ok := deviceID(w, r)
+	if !ok {
+		return
+	}
+
+	// The reason is passed on to the device
+	var req reasonRequest
+	if !decodeOptionalBody(w, r, &req) {
+		return
+	}
+
+	if err := a.Registrations.RejectDevice(id, req.Reason); err != nil {
+		a.lookupError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *AdminAPI) suspendDevice(w http.ResponseWriter, r *http.Request) {
+	id, ok := deviceID(w, r)
+	if !ok {
+		return
+	}
+	var req reasonRequest
+	if !decodeOptionalBody(w, r, &req) {
+		return
+	}
+
+	if err := a.Devices.SuspendDevice(id, req.Reason); err != nil {
+		a.lookupError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *AdminAPI) reactivateDevice(w http.ResponseWriter, r *http.Request) {
+	id, ok := deviceID(w, r)
+	if !ok {
+		return
+	}
+	if err := a.Devices.ReactivateDevice(id); err != nil {
+		a.lookupError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *AdminAPI) decommissionDevice(w http.ResponseWriter, r *http.Request) {
+	id, ok := deviceID(w, r)
+	if !ok {
+		return
+	}
+	var req reasonRequest
+	if !decodeOptionalBody(w, r, &req) {
+		return
+	}
+
+	if err := a.Devices.DecommissionDevice(id, req.Reason); err != nil {
+		a.lookupError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// reasonRequest is the optional body of device state changes
+type reasonRequest struct {
+	Reason string `json:"reason"`
+}
+
+// lookupError maps a missing record to 404, a state conflict to 409 and anything else to 500
+func (a *AdminAPI) lookupError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		writeError(w, http.StatusNotFound, "not found")
+	case errors.Is(err, database.ErrStateConflict):
+		writeError(w, http.StatusConflict, err.Error())
+	default:
+		a.internalError(w, err)
+	}
+}
+
+func (a *AdminAPI) internalError(w http.ResponseWriter, err error) {
+	a.Logger.WithError(err).Error("Admin API request failed")
+	writeError(w, http.StatusInternalServerError, "internal error")
+}
+
+// decodeOptionalBody decodes the JSON body into v if the request has one
+func decodeOptionalBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.ContentLength == 0 {
+		return true
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return false
+	}
+	return true
+}
+
+// deviceID validates the device UUID in the {id} path parameter
+func deviceID(w http.ResponseWriter, r *http.Request) (string, bool) {
+	id := r.PathValue("id")
+	if _, err := uuid.Parse(id); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid device id")
+		return "", false
+	}
+	return id, true
+}
+
+// pathID parses the numeric {id} path parameter
+func pathID(w http.ResponseWriter, r *http.Request) (uint, bool) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid id")
+		return 0, false
+	}
+	return uint(id), true
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -1,4 +1,62 @@
-package constants
-
-const QUEUE_MODE = "queue"
-const MQTT_MODE = "mqtt"
+package constants
+
+const QUEUE_MODE = "queue"
+const MQTT_MODE = "mqtt"
+
+// Provisioning credential types
+const CREDENTIAL_TYPE_DEVICE = "device"
+const CREDENTIAL_TYPE_BATCH = "batch"
+
+// RFC 5280 CRLReason codes used when revoking device certificates
+const CRL_REASON_UNSPECIFIED = 0
+const CRL_REASON_KEY_COMPROMISE = 1
+const CRL_REASON_SUPERSEDED = 4
+const CRL_REASON_CESSATION_OF_OPERATION = 5
+const CRL_REASON_CERTIFICATE_HOLD = 6
+
+// Version of the registration response envelope sent to devices
+const REGISTRATION_RESPONSE_VERSION = 1
+
+// Registration response statuses
+const RESPONSE_STATUS_SUCCESS = "success"
+const RESPONSE_STATUS_ERROR = "error"
+const RESPONSE_STATUS_PENDING = "pending" // waiting for approval, a follow-up response will be sent
+
+// Registration error codes reported to devices
+const ERROR_CODE_MALFORMED_REQUEST = "MALFORMED_REQUEST"
+const ERROR_CODE_INVALID_SECRET = "INVALID_SECRET"
+const ERROR_CODE_INVALID_CSR = "INVALID_CSR"
+const ERROR_CODE_CERTIFICATE_UNAVAILABLE = "CERTIFICATE_UNAVAILABLE"
+const ERROR_CODE_RATE_LIMITED = "RATE_LIMITED"
+const ERROR_CODE_INTERNAL = "INTERNAL"
+const ERROR_CODE_ALREADY_REGISTERED = "ALREADY_REGISTERED"
+const ERROR_CODE_REJECTED = "REJECTED"
+const ERROR_CODE_SUSPENDED = "DEVICE_SUSPENDED"
+const ERROR_CODE_INVALID_TOKEN = "INVALID_TOKEN"
+
+// Re-registration policies for devices whose hardware fingerprint is already known
+const REREGISTRATION_POLICY_KEEP = "keep"     // return the existing device ID and certificate
+const REREGISTRATION_POLICY_ROTATE = "rotate" // return the existing device ID and replace its certificate
+const REREGISTRATION_POLICY_REJECT = "reject" // refuse the request
+
+// Device lifecycle states
+const DEVICE_STATE_PENDING = "pending"
+const DEVICE_STATE_ACTIVE = "active"
+const DEVICE_STATE_SUSPENDED = "suspended"
+const DEVICE_STATE_DECOMMISSIONED = "decommissioned"
+const DEVICE_STATE_REJECTED = "rejected"
+
+// Device lifecycle events published on the device events topic
+const DEVICE_EVENT_VERSION = 1
+const DEVICE_EVENT_REGISTERED = "device.registered"
+const DEVICE_EVENT_SUSPENDED = "device.suspended"
+const DEVICE_EVENT_REACTIVATED = "device.reactivated"
+const DEVICE_EVENT_DECOMMISSIONED = "device.decommissioned"
+
+// Approval modes for newly registered devices
+const APPROVAL_MODE_AUTO = "auto"     // new devices are active immediately
+const APPROVAL_MODE_MANUAL = "manual" // new devices wait for an operator
+const APPROVAL_MODE_POLICY = "policy" // devices matching a rule are active, the rest wait for an operator
+
+// Name the registration service's migrations are recorded under in schema_migrations
+const MIGRATIONS_SERVICE = "registration"
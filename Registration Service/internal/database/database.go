@@ -1,70 +1,484 @@
-package database
-
-import (
-	"github.com/benmeehan/iot-registration-service/internal/models"
-	"github.com/sirupsen/logrus"
-	"gorm.io/driver/postgres"
-	"gorm.io/gorm"
-)
-
-// DB interface with new methods for GORM operations
-type DB interface {
-	Connect(connStr string) error
-	Close() error
-	GetConn() *gorm.DB
-	SaveDevice(device *models.Device) error
-}
-
-// Database holds the connection pool to the PostgreSQL database using GORM
-type Database struct {
-	Conn   *gorm.DB
-	Logger *logrus.Logger
-}
-
-// NewDatabase initializes a new Database instance
-func NewDatabase(logger *logrus.Logger) *Database {
-	return &Database{
-		Logger: logger,
-	}
-}
-
-// Connect establishes the database connection using GORM
-func (d *Database) Connect(connStr string) error {
-	var err error
-	d.Conn, err = gorm.Open(postgres.Open(connStr), &gorm.Config{})
-	if err != nil {
-		d.Logger.WithError(err).Fatal("Failed to open database connection")
-		return err
-	}
-
-	// Automatically create the devices table if it doesn't exist
-	if err := d.Conn.AutoMigrate(&models.Device{}); err != nil {
-		d.Logger.WithError(err).Fatal("Failed to auto-migrate database schema")
-		return err
-	}
-
-	d.Logger.Info("Database connection established")
-	return nil
-}
-
-// Close closes the database connection
-func (d *Database) Close() error {
-	// GORM handles connection pooling, so Close is not implemented like in sql.DB
-	d.Logger.Info("Database connection closed (handled by GORM)")
-	return nil
-}
-
-// GetConn returns the underlying GORM database connection
-func (d *Database) GetConn() *gorm.DB {
-	return d.Conn
-}
-
-// SaveDevice saves the device to the database
-func (d *Database) SaveDevice(device *models.Device) error {
-	if err := d.Conn.Create(device).Error; err != nil {
-		d.Logger.WithError(err).Error("Failed to save device")
-		return err
-	}
-	d.Logger.Infof("Device saved with ID: %s", device.ID)
-	return nil
-}
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/benmeehan/iot-registration-service/internal/constants"
+	"github.com/benmeehan/iot-registration-service/internal/models"
+	"github.com/benmeehan/iot-registration-service/pkg/migrate"
+	"github.com/sirupsen/logrus"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrCredentialExhausted is returned when a provisioning credential can no longer be used
+var ErrCredentialExhausted = errors.New("provisioning credential is revoked, expired or exhausted")
+
+// ErrStateConflict is returned when a device is not in the state a transition starts from
+var ErrStateConflict = errors.New("device is not in the expected state")
+
+// DB interface with new methods for GORM operations
+type DB interface {
+	Open(connStr string) error
+	Connect(connStr string) error
+	Migrate() error
+	NewMigrator() (*migrate.Migrator, error)
+	Close() error
+	GetConn() *gorm.DB
+	SaveDevice(device *models.Device) error
+	SaveDeviceWithCredential(device *models.Device, credentialID uint) error
+	SaveCredential(credential *models.ProvisioningCredential) error
+	GetCredential(id uint) (*models.ProvisioningCredential, error)
+	GetCredentialByKey(credentialType, key string) (*models.ProvisioningCredential, error)
+	ListCredentials() ([]models.ProvisioningCredential, error)
+	RevokeCredential(id uint) error
+	DeleteCredential(id uint) error
+	GetDevice(id string) (*models.Device, error)
+	RevokeCertificate(revocation *models.CertificateRevocation) error
+	ListCertificateRevocations() ([]models.CertificateRevocation, error)
+	GetDeviceByFingerprint(fingerprint string) (*models.Device, error)
+	UpdateDeviceCertificate(device *models.Device) error
+	ClaimRegistrationRequest(clientID, requestID string) (bool, *models.RegistrationRecord, error)
+	CompleteRegistrationRequest(clientID, requestID, response string) error
+	ReleaseRegistrationRequest(clientID, requestID string) error
+	DeleteRegistrationRecordsBefore(cutoff time.Time) (int64, error)
+	UpdateDeviceMetadata(device *models.Device) error
+	UpdateDeviceInfo(deviceID string, changes map[string]interface{}) error
+	ListDevicesByState(state string) ([]models.Device, error)
+	TransitionDevice(device *models.Device, fromState string, columns ...string) error
+	DecommissionDevice(device *models.Device, fromState string) error
+	ReleaseCertificateHold(serialNumber string) error
+	TakeRateLimitToken(key string, rate, burst float64) (bool, error)
+	GetRegistrationLockout(key string) (*time.Time, error)
+	RecordRegistrationFailure(key string, window time.Duration) (int, error)
+	LockRegistration(key string, until time.Time) error
+	ClearRegistrationFailures(key string) error
+	DeleteRateLimitStateBefore(cutoff time.Time) error
+}
+
+// Database holds the connection pool to the PostgreSQL database using GORM
+type Database struct {
+	Conn   *gorm.DB
+	Logger *logrus.Logger
+}
+
+// NewDatabase initializes a new Database instance
+func NewDatabase(logger *logrus.Logger) *Database {
+	return &Database{
+		Logger: logger,
+	}
+}
+
+// Open establishes the database connection using GORM without touching the schema
+func (d *Database) Open(connStr string) error {
+	var err error
+	// TranslateError maps unique violations to gorm.ErrDuplicatedKey
+	d.Conn, err = gorm.Open(postgres.Open(connStr), &gorm.Config{TranslateError: true})
+	if err != nil {
+		d.Logger.WithError(err).Fatal("Failed to open database connection")
+		return err
+	}
+	return nil
+}
+
+// Connect establishes the database connection and applies the pending schema migrations
+func (d *Database) Connect(connStr string) error {
+	if err := d.Open(connStr); err != nil {
+		return err
+	}
+	if err := d.Migrate(); err != nil {
+		d.Logger.WithError(err).Fatal("Failed to migrate database schema")
+		return err
+	}
+
+	d.Logger.Info("Database connection established")
+	return nil
+}
+
+// Close closes the database connection
+func (d *Database) Close() error {
+	// GORM handles connection pooling, so Close is not implemented like in sql.DB
+	d.Logger.Info("Database connection closed (handled by GORM)")
+	return nil
+}
+
+// GetConn returns the underlying GORM database connection
+func (d *Database) GetConn() *gorm.DB {
+	return d.Conn
+}
+
+// SaveDevice saves the device to the database
+func (d *Database) SaveDevice(device *models.Device) error {
+	if err := d.Conn.Create(device).Error; err != nil {
+		d.Logger.WithError(err).Error("Failed to save device")
+		return err
+	}
+	d.Logger.Infof("Device saved with ID: %s", device.ID)
+	return nil
+}
+
+// SaveDeviceWithCredential consumes one registration from the credential and saves
+// the device in the same transaction, so a failed insert does not use up the credential
+func (d *Database) SaveDeviceWithCredential(device *models.Device, credentialID uint) error {
+	err := d.Conn.Transaction(func(tx *gorm.DB) error {
+		result := tx.Exec(`
+			UPDATE provisioning_credentials
+			SET registration_count = registration_count + 1, last_used_at = now(), updated_at = now()
+			WHERE id = ?
+			  AND revoked_at IS NULL
+			  AND (expires_at IS NULL OR expires_at > now())
+			  AND (NOT single_use OR registration_count = 0)
+			  AND (max_registrations = 0 OR registration_count < max_registrations)`, credentialID)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrCredentialExhausted
+		}
+
+		device.ProvisioningCredentialID = &credentialID
+		return tx.Create(device).Error
+	})
+	if err != nil {
+		d.Logger.WithError(err).Error("Failed to save device")
+		return err
+	}
+	d.Logger.Infof("Device saved with ID: %s", device.ID)
+	return nil
+}
+
+// SaveCredential inserts or updates a provisioning credential
+func (d *Database) SaveCredential(credential *models.ProvisioningCredential) error {
+	if err := d.Conn.Save(credential).Error; err != nil {
+		d.Logger.WithError(err).Error("Failed to save provisioning credential")
+		return err
+	}
+	return nil
+}
+
+// GetCredential fetches a provisioning credential by its ID
+func (d *Database) GetCredential(id uint) (*models.ProvisioningCredential, error) {
+	var credential models.ProvisioningCredential
+	if err := d.Conn.First(&credential, id).Error; err != nil {
+		return nil, err
+	}
+	return &credential, nil
+}
+
+// GetCredentialByKey fetches a provisioning credential by its type and key
+func (d *Database) GetCredentialByKey(credentialType, key string) (*models.ProvisioningCredential, error) {
+	var credential models.ProvisioningCredential
+	err := d.Conn.Where("type = ? AND key = ?", credentialType, key).First(&credential).Error
+	if err != nil {
+		return nil, err
+	}
+	return &credential, nil
+}
+
+// ListCredentials returns all provisioning credentials ordered by ID
+func (d *Database) ListCredentials() ([]models.ProvisioningCredential, error) {
+	var credentials []models.ProvisioningCredential
+	if err := d.Conn.Order("id").Find(&credentials).Error; err != nil {
+		return nil, err
+	}
+	return credentials, nil
+}
+
+// RevokeCredential marks a provisioning credential as revoked
+func (d *Database) RevokeCredential(id uint) error {
+	result := d.Conn.Model(&models.ProvisioningCredential{}).
+		Where("id = ? AND revoked_at IS NULL", id).
+		Update("revoked_at", gorm.Expr("now()"))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// DeleteCredential removes a provisioning credential
+func (d *Database) DeleteCredential(id uint) error {
+	result := d.Conn.Delete(&models.ProvisioningCredential{}, id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// GetDevice fetches a device by its ID
+func (d *Database) GetDevice(id string) (*models.Device, error) {
+	var device models.Device
+	if err := d.Conn.Where("id = ?", id).First(&device).Error; err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+// RevokeCertificate records a certificate revocation, ignoring serials that are already revoked
+func (d *Database) RevokeCertificate(revocation *models.CertificateRevocation) error {
+	err := d.Conn.Clauses(clause.OnConflict{DoNothing: true}).Create(revocation).Error
+	if err != nil {
+		d.Logger.WithError(err).Error("Failed to revoke certificate")
+		return err
+	}
+	d.Logger.Infof("Revoked certificate %s of device %s", revocation.SerialNumber, revocation.DeviceID)
+	return nil
+}
+
+// ListCertificateRevocations returns revocations of certificates that have not expired yet
+func (d *Database) ListCertificateRevocations() ([]models.CertificateRevocation, error) {
+	var revocations []models.CertificateRevocation
+	if err := d.Conn.Where("expires_at > now()").Order("revoked_at").Find(&revocations).Error; err != nil {
+		return nil, err
+	}
+	return revocations, nil
+}
+
+// GetDeviceByFingerprint fetches a device by its hardware fingerprint
+func (d *Database) GetDeviceByFingerprint(fingerprint string) (*models.Device, error) {
+	var device models.Device
+	if err := d.Conn.Where("hardware_fingerprint = ?", fingerprint).First(&device).Error; err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+// UpdateDeviceCertificate stores the device's current certificate
+func (d *Database) UpdateDeviceCertificate(device *models.Device) error {
+	err := d.Conn.Model(device).Select("certificate", "certificate_serial", "certificate_expires_at").Updates(device).Error
+	if err != nil {
+		d.Logger.WithError(err).Error("Failed to update device certificate")
+		return err
+	}
+	return nil
+}
+
+// ClaimRegistrationRequest records that the request is being processed. It returns false and
+// the existing record when the same request was seen before.
+func (d *Database) ClaimRegistrationRequest(clientID, requestID string) (bool, *models.RegistrationRecord, error) {
+	record := &models.RegistrationRecord{ClientID: clientID, RequestID: requestID}
+	result := d.Conn.Clauses(clause.OnConflict{DoNothing: true}).Create(record)
+	if result.Error != nil {
+		return false, nil, result.Error
+	}
+	if result.RowsAffected == 1 {
+		return true, nil, nil
+	}
+
+	var existing models.RegistrationRecord
+	err := d.Conn.Where("client_id = ? AND request_id = ?", clientID, requestID).First(&existing).Error
+	if err != nil {
+		return false, nil, err
+	}
+	return false, &existing, nil
+}
+
+// CompleteRegistrationRequest stores the response sent for a claimed request
+func (d *Database) CompleteRegistrationRequest(clientID, requestID, response string) error {
+	return d.Conn.Model(&models.RegistrationRecord{}).
+		Where("client_id = ? AND request_id = ?", clientID, requestID).
+		Update("response", response).Error
+}
+
+// ReleaseRegistrationRequest drops a claim so the request can be retried
+func (d *Database) ReleaseRegistrationRequest(clientID, requestID string) error {
+	return d.Conn.Where("client_id = ? AND request_id = ?", clientID, requestID).
+		Delete(&models.RegistrationRecord{}).Error
+}
+
+// DeleteRegistrationRecordsBefore removes request records created before the cutoff
+func (d *Database) DeleteRegistrationRecordsBefore(cutoff time.Time) (int64, error) {
+	result := d.Conn.Where("created_at < ?", cutoff).Delete(&models.RegistrationRecord{})
+	return result.RowsAffected, result.Error
+}
+
+// UpdateDeviceMetadata stores the device's hardware and software metadata
+func (d *Database) UpdateDeviceMetadata(device *models.Device) error {
+	err := d.Conn.Model(device).
+		Select("hardware_model", "firmware_version", "agent_version", "os", "hostname", "labels", "tags").
+		Updates(device).Error
+	if err != nil {
+		d.Logger.WithError(err).Error("Failed to update device metadata")
+		return err
+	}
+	return nil
+}
+
+// UpdateDeviceInfo applies column changes reported by the device. Decommissioned devices
+// are not updated and yield gorm.ErrRecordNotFound like unknown ones.
+func (d *Database) UpdateDeviceInfo(deviceID string, changes map[string]interface{}) error {
+	result := d.Conn.Model(&models.Device{}).
+		Where("id = ? AND state <> ?", deviceID, constants.DEVICE_STATE_DECOMMISSIONED).
+		Updates(changes)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// ListDevicesByState returns the devices in the given lifecycle state, oldest first
+func (d *Database) ListDevicesByState(state string) ([]models.Device, error) {
+	conn := d.Conn
+	if state == constants.DEVICE_STATE_DECOMMISSIONED {
+		// Decommissioned devices are soft deleted
+		conn = conn.Unscoped()
+	}
+
+	var devices []models.Device
+	if err := conn.Where("state = ?", state).Order("created_at").Find(&devices).Error; err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+// TransitionDevice saves the device's state and the given columns, provided the device is
+// still in fromState. It returns ErrStateConflict when another change got there first.
+func (d *Database) TransitionDevice(device *models.Device, fromState string, columns ...string) error {
+	if err := transitionDevice(d.Conn, device, fromState, columns...); err != nil {
+		return err
+	}
+	d.Logger.Infof("Device %s moved from %s to %s", device.ID, fromState, device.State)
+	return nil
+}
+
+// DecommissionDevice saves the decommissioned state and soft deletes the device. The hardware
+// fingerprint is released so the same hardware can be registered again as a new device.
+func (d *Database) DecommissionDevice(device *models.Device, fromState string) error {
+	device.HardwareFingerprint = nil
+	err := d.Conn.Transaction(func(tx *gorm.DB) error {
+		if err := transitionDevice(tx, device, fromState, "state_reason", "hardware_fingerprint"); err != nil {
+			return err
+		}
+		return tx.Delete(device).Error
+	})
+	if err != nil {
+		if !errors.Is(err, ErrStateConflict) {
+			d.Logger.WithError(err).Error("Failed to decommission device")
+		}
+		return err
+	}
+	d.Logger.Infof("Decommissioned device %s", device.ID)
+	return nil
+}
+
+// transitionDevice runs the conditional state update of TransitionDevice on the given connection
+func transitionDevice(conn *gorm.DB, device *models.Device, fromState string, columns ...string) error {
+	result := conn.Model(device).
+		Where("state = ?", fromState).
+		Select(append([]string{"state"}, columns...)).
+		Updates(device)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrStateConflict
+	}
+	return nil
+}
+
+// ReleaseCertificateHold removes a certificateHold entry from the revocation list. Certificates
+// revoked for any other reason stay revoked.
+func (d *Database) ReleaseCertificateHold(serialNumber string) error {
+	err := d.Conn.
+		Where("serial_number = ? AND reason = ?", serialNumber, constants.CRL_REASON_CERTIFICATE_HOLD).
+		Delete(&models.CertificateRevocation{}).Error
+	if err != nil {
+		d.Logger.WithError(err).Error("Failed to release certificate hold")
+		return err
+	}
+	return nil
+}
+
+// TakeRateLimitToken refills the bucket at rate tokens per second up to burst and takes one
+// token from it. It reports false when the bucket is empty. The refill and take happen in a
+// single statement so concurrent replicas can't both take the last token.
+func (d *Database) TakeRateLimitToken(key string, rate, burst float64) (bool, error) {
+	var tokens []float64
+	err := d.Conn.Raw(`
+		INSERT INTO rate_limit_buckets (key, tokens, updated_at)
+		VALUES (@key, CAST(@burst AS double precision) - 1, now())
+		ON CONFLICT (key) DO UPDATE SET
+			tokens = LEAST(CAST(@burst AS double precision), rate_limit_buckets.tokens +
+				EXTRACT(EPOCH FROM now() - rate_limit_buckets.updated_at)::double precision * CAST(@rate AS double precision)) - 1,
+			updated_at = now()
+		WHERE LEAST(CAST(@burst AS double precision), rate_limit_buckets.tokens +
+			EXTRACT(EPOCH FROM now() - rate_limit_buckets.updated_at)::double precision * CAST(@rate AS double precision)) >= 1
+		RETURNING tokens`,
+		sql.Named("key", key), sql.Named("rate", rate), sql.Named("burst", burst)).
+		Scan(&tokens).Error
+	if err != nil {
+		d.Logger.WithError(err).Error("Failed to take rate limit token")
+		return false, err
+	}
+	return len(tokens) > 0, nil
+}
+
+// GetRegistrationLockout returns when the lockout of the key ends, or nil if it isn't locked out
+func (d *Database) GetRegistrationLockout(key string) (*time.Time, error) {
+	var lockout models.RegistrationLockout
+	err := d.Conn.Where("key = ? AND locked_until > now()", key).Take(&lockout).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return lockout.LockedUntil, nil
+}
+
+// RecordRegistrationFailure counts an invalid secret for the lockout key and returns the number
+// of consecutive failures. The count starts over when the last failure is older than window.
+func (d *Database) RecordRegistrationFailure(key string, window time.Duration) (int, error) {
+	var failures []int
+	err := d.Conn.Raw(`
+		INSERT INTO registration_lockouts (key, failures, last_failure_at) VALUES (@key, 1, now())
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN registration_lockouts.last_failure_at < now() - make_interval(secs => @window)
+				THEN 1 ELSE registration_lockouts.failures + 1 END,
+			last_failure_at = now()
+		RETURNING failures`,
+		sql.Named("key", key), sql.Named("window", window.Seconds())).
+		Scan(&failures).Error
+	if err != nil {
+		d.Logger.WithError(err).Error("Failed to record registration failure")
+		return 0, err
+	}
+	if len(failures) == 0 {
+		return 0, fmt.Errorf("no failure count returned for %s", key)
+	}
+	return failures[0], nil
+}
+
+// LockRegistration locks the key out of registration until the given time
+func (d *Database) LockRegistration(key string, until time.Time) error {
+	return d.Conn.Model(&models.RegistrationLockout{}).
+		Where("key = ?", key).
+		Update("locked_until", until).Error
+}
+
+// ClearRegistrationFailures forgets the failures of a lockout key after it authenticated
+func (d *Database) ClearRegistrationFailures(key string) error {
+	return d.Conn.Where("key = ?", key).Delete(&models.RegistrationLockout{}).Error
+}
+
+// DeleteRateLimitStateBefore removes buckets and lockouts that haven't been touched since cutoff
+func (d *Database) DeleteRateLimitStateBefore(cutoff time.Time) error {
+	if err := d.Conn.Where("updated_at < ?", cutoff).Delete(&models.RateLimitBucket{}).Error; err != nil {
+		return err
+	}
+	return d.Conn.
+		Where("last_failure_at < ? AND (locked_until IS NULL OR locked_until < now())", cutoff).
+		Delete(&models.RegistrationLockout{}).Error
+}
@@ -0,0 +1,32 @@
+-- Databases set up before migrations already have the table, possibly without the later columns
+CREATE TABLE IF NOT EXISTS devices (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    created_at TIMESTAMPTZ,
+    updated_at TIMESTAMPTZ,
+    deleted_at TIMESTAMPTZ
+);
+
+ALTER TABLE devices
+    ADD COLUMN IF NOT EXISTS state TEXT NOT NULL DEFAULT 'active',
+    ADD COLUMN IF NOT EXISTS state_reason TEXT,
+    ADD COLUMN IF NOT EXISTS client_id TEXT,
+    ADD COLUMN IF NOT EXISTS pending_csr TEXT,
+    ADD COLUMN IF NOT EXISTS hardware_model TEXT,
+    ADD COLUMN IF NOT EXISTS firmware_version TEXT,
+    ADD COLUMN IF NOT EXISTS agent_version TEXT,
+    ADD COLUMN IF NOT EXISTS os TEXT,
+    ADD COLUMN IF NOT EXISTS hostname TEXT,
+    ADD COLUMN IF NOT EXISTS labels JSONB NOT NULL DEFAULT '{}',
+    ADD COLUMN IF NOT EXISTS tags JSONB NOT NULL DEFAULT '[]',
+    ADD COLUMN IF NOT EXISTS provisioning_credential_id BIGINT,
+    ADD COLUMN IF NOT EXISTS hardware_fingerprint TEXT,
+    ADD COLUMN IF NOT EXISTS certificate TEXT,
+    ADD COLUMN IF NOT EXISTS certificate_serial TEXT,
+    ADD COLUMN IF NOT EXISTS certificate_expires_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS idx_devices_deleted_at ON devices (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_devices_state ON devices (state);
+CREATE INDEX IF NOT EXISTS idx_devices_client_id ON devices (client_id);
+CREATE INDEX IF NOT EXISTS idx_devices_provisioning_credential_id ON devices (provisioning_credential_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_devices_hardware_fingerprint ON devices (hardware_fingerprint);
+CREATE INDEX IF NOT EXISTS idx_devices_certificate_serial ON devices (certificate_serial);
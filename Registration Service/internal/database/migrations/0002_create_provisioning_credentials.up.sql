@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS provisioning_credentials (
+    id BIGSERIAL PRIMARY KEY,
+    type TEXT NOT NULL,
+    key TEXT NOT NULL,
+    secret_hash TEXT NOT NULL,
+    description TEXT,
+    expires_at TIMESTAMPTZ,
+    single_use BOOLEAN,
+    max_registrations BIGINT,
+    registration_count BIGINT NOT NULL DEFAULT 0,
+    last_used_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ,
+    updated_at TIMESTAMPTZ
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_credential_type_key ON provisioning_credentials (type, key);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS certificate_revocations (
+    serial_number TEXT PRIMARY KEY,
+    device_id UUID NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    reason BIGINT,
+    revoked_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_certificate_revocations_device_id ON certificate_revocations (device_id);
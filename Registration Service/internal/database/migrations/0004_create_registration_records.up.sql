@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS registration_records (
+    client_id TEXT NOT NULL,
+    request_id TEXT NOT NULL,
+    response TEXT,
+    created_at TIMESTAMPTZ,
+    PRIMARY KEY (client_id, request_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_registration_records_created_at ON registration_records (created_at);
@@ -0,0 +1 @@
+ALTER TABLE registration_lockouts RENAME COLUMN key TO client_id;
@@ -0,0 +1,3 @@
+-- Lockouts are kept per client ID and per batch key, each under a prefixed key. Rows of the
+-- old unprefixed client IDs are never matched again and age out with the cleanup.
+ALTER TABLE registration_lockouts RENAME COLUMN client_id TO key;
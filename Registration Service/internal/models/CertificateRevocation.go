@@ -0,0 +1,14 @@
+package models
+
+import (
+	"time"
+)
+
+// CertificateRevocation records a revoked device certificate so it can be published in the CRL
+type CertificateRevocation struct {
+	SerialNumber string    `json:"serial_number" gorm:"primaryKey"`
+	DeviceID     string    `json:"device_id" gorm:"type:uuid;index;not null"`
+	ExpiresAt    time.Time `json:"expires_at" gorm:"not null"`
+	Reason       int       `json:"reason"` // RFC 5280 CRLReason code
+	RevokedAt    time.Time `json:"revoked_at" gorm:"not null"`
+}
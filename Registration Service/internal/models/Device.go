@@ -1,19 +1,174 @@
-package models
-
-import (
-	"gorm.io/gorm"
-)
-
-// Device represents a device registered in the system
-type Device struct {
-	gorm.Model        // Embedding gorm.Model to include CreatedAt, UpdatedAt, DeletedAt
-	ID         string `gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
-	// Additional fields can be added here in the future
-}
-
-// NewDevice creates a new Device instance with a generated UUID
-func NewDevice(deviceID string) *Device {
-	return &Device{
-		ID: deviceID,
-	}
-}
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/benmeehan/iot-registration-service/internal/constants"
+	"gorm.io/gorm"
+)
+
+// Limits on the free-form device metadata
+const (
+	maxLabels         = 64
+	maxTags           = 64
+	maxLabelKeyLength = 63
+	maxValueLength    = 255
+)
+
+// Device represents a device registered in the system
+type Device struct {
+	ID        string `gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// DeletedAt is set when the device is decommissioned, which hides it from normal queries
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+
+	// State is the lifecycle state, one of the DEVICE_STATE constants
+	State string `gorm:"not null;default:active;index"`
+	// StateReason is the operator's reason for the last suspension or decommission
+	StateReason string
+
+	// ClientID the device registered with, used to address follow-up responses
+	ClientID string `gorm:"index"`
+	// PendingCSR is signed once a pending device is approved
+	PendingCSR string `gorm:"type:text"`
+
+	// Hardware and software reported by the device
+	HardwareModel   string
+	FirmwareVersion string
+	AgentVersion    string
+	OS              string `gorm:"column:os"`
+	Hostname        string
+	Labels          Labels `gorm:"type:jsonb;not null;default:'{}'"`
+	Tags            Tags   `gorm:"type:jsonb;not null;default:'[]'"`
+
+	// ProvisioningCredentialID is the credential used to register the device,
+	// nil when the device registered with the legacy shared secret
+	ProvisioningCredentialID *uint `gorm:"index"`
+
+	// HardwareFingerprint identifies the hardware across re-registrations, see HardwareIdentity
+	HardwareFingerprint *string `gorm:"uniqueIndex"`
+
+	// Current client certificate issued by the device CA, if any
+	Certificate          string `gorm:"type:text"`
+	CertificateSerial    string `gorm:"index"`
+	CertificateExpiresAt *time.Time
+}
+
+// NewDevice creates a new Device instance with a generated UUID
+func NewDevice(deviceID string) *Device {
+	return &Device{
+		ID:     deviceID,
+		State:  constants.DEVICE_STATE_ACTIVE,
+		Labels: Labels{},
+		Tags:   Tags{},
+	}
+}
+
+// DeviceMetadata describes the device's hardware and software. It is sent with the
+// registration request and can be updated later on the device info topic.
+type DeviceMetadata struct {
+	HardwareModel   string `json:"hardware_model,omitempty"`
+	FirmwareVersion string `json:"firmware_version,omitempty"`
+	AgentVersion    string `json:"agent_version,omitempty"`
+	OS              string `json:"os,omitempty"`
+	Hostname        string `json:"hostname,omitempty"`
+	Labels          Labels `json:"labels,omitempty"`
+	Tags            Tags   `json:"tags,omitempty"`
+}
+
+// Apply copies the metadata onto the device
+func (m *DeviceMetadata) Apply(device *Device) {
+	device.HardwareModel = m.HardwareModel
+	device.FirmwareVersion = m.FirmwareVersion
+	device.AgentVersion = m.AgentVersion
+	device.OS = m.OS
+	device.Hostname = m.Hostname
+	if m.Labels != nil {
+		device.Labels = m.Labels
+	}
+	if m.Tags != nil {
+		device.Tags = m.Tags
+	}
+}
+
+// Validate checks the metadata against the size limits
+func (m *DeviceMetadata) Validate() error {
+	for _, value := range []string{m.HardwareModel, m.FirmwareVersion, m.AgentVersion, m.OS, m.Hostname} {
+		if len(value) > maxValueLength {
+			return fmt.Errorf("metadata values must be at most %d characters", maxValueLength)
+		}
+	}
+	return validateLabelsAndTags(m.Labels, m.Tags)
+}
+
+// DeviceInfoUpdate is published by the agent on the device info topic to update the mutable
+// device fields. Fields that are left out are not changed.
+type DeviceInfoUpdate struct {
+	DeviceID        string  `json:"device_id"`
+	Token           string  `json:"token"` // access token of the device, see pkg/token
+	FirmwareVersion *string `json:"firmware_version,omitempty"`
+	AgentVersion    *string `json:"agent_version,omitempty"`
+	OS              *string `json:"os,omitempty"`
+	Hostname        *string `json:"hostname,omitempty"`
+	Labels          Labels  `json:"labels,omitempty"` // replaces all labels when present
+	Tags            Tags    `json:"tags,omitempty"`   // replaces all tags when present
+}
+
+// Changes returns the column updates described by the message
+func (u *DeviceInfoUpdate) Changes() map[string]interface{} {
+	changes := map[string]interface{}{}
+	if u.FirmwareVersion != nil {
+		changes["firmware_version"] = *u.FirmwareVersion
+	}
+	if u.AgentVersion != nil {
+		changes["agent_version"] = *u.AgentVersion
+	}
+	if u.OS != nil {
+		changes["os"] = *u.OS
+	}
+	if u.Hostname != nil {
+		changes["hostname"] = *u.Hostname
+	}
+	if u.Labels != nil {
+		changes["labels"] = u.Labels
+	}
+	if u.Tags != nil {
+		changes["tags"] = u.Tags
+	}
+	return changes
+}
+
+// Validate checks the update against the size limits
+func (u *DeviceInfoUpdate) Validate() error {
+	if u.DeviceID == "" {
+		return fmt.Errorf("device ID not found in the device info update")
+	}
+	for _, value := range []*string{u.FirmwareVersion, u.AgentVersion, u.OS, u.Hostname} {
+		if value != nil && len(*value) > maxValueLength {
+			return fmt.Errorf("metadata values must be at most %d characters", maxValueLength)
+		}
+	}
+	return validateLabelsAndTags(u.Labels, u.Tags)
+}
+
+func validateLabelsAndTags(labels Labels, tags Tags) error {
+	if len(labels) > maxLabels {
+		return fmt.Errorf("at most %d labels are allowed", maxLabels)
+	}
+	for key, value := range labels {
+		if key == "" || len(key) > maxLabelKeyLength || len(value) > maxValueLength {
+			return fmt.Errorf("label keys must be 1-%d characters and values at most %d", maxLabelKeyLength, maxValueLength)
+		}
+	}
+	if len(tags) > maxTags {
+		return fmt.Errorf("at most %d tags are allowed", maxTags)
+	}
+	for _, tag := range tags {
+		if tag == "" || len(tag) > maxLabelKeyLength {
+			return fmt.Errorf("tags must be 1-%d characters", maxLabelKeyLength)
+		}
+	}
+	return nil
+}
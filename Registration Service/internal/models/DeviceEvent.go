@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// DeviceEvent announces a lifecycle change of a device to other services and to the device itself
+type DeviceEvent struct {
+	Version   int       `json:"version"`
+	DeviceID  string    `json:"device_id"`
+	Event     string    `json:"event"` // one of the DEVICE_EVENT constants
+	State     string    `json:"state"` // state the device is in after the event
+	Reason    string    `json:"reason,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
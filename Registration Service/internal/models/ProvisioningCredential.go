@@ -0,0 +1,36 @@
+package models
+
+import (
+	"time"
+)
+
+// ProvisioningCredential is a secret a device (or a whole manufacturing batch)
+// presents when registering. Only a bcrypt hash of the secret is stored.
+type ProvisioningCredential struct {
+	ID                uint       `json:"id" gorm:"primaryKey"`
+	Type              string     `json:"type" gorm:"not null;uniqueIndex:idx_credential_type_key"` // device or batch
+	Key               string     `json:"key" gorm:"not null;uniqueIndex:idx_credential_type_key"`  // client_id or batch key
+	SecretHash        string     `json:"-" gorm:"not null"`
+	Description       string     `json:"description,omitempty"`
+	ExpiresAt         *time.Time `json:"expires_at,omitempty"`
+	SingleUse         bool       `json:"single_use"`
+	MaxRegistrations  int        `json:"max_registrations"` // 0 means unlimited
+	RegistrationCount int        `json:"registration_count" gorm:"not null;default:0"`
+	LastUsedAt        *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt         *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+}
+
+// IsExpired reports whether the credential is past its expiry time
+func (c *ProvisioningCredential) IsExpired(now time.Time) bool {
+	return c.ExpiresAt != nil && !now.Before(*c.ExpiresAt)
+}
+
+// IsExhausted reports whether the credential has no registrations left
+func (c *ProvisioningCredential) IsExhausted() bool {
+	if c.SingleUse && c.RegistrationCount > 0 {
+		return true
+	}
+	return c.MaxRegistrations > 0 && c.RegistrationCount >= c.MaxRegistrations
+}
@@ -0,0 +1,21 @@
+package models
+
+import (
+	"time"
+)
+
+// RateLimitBucket is a token bucket shared by all registration service replicas
+type RateLimitBucket struct {
+	Key       string    `gorm:"primaryKey"`
+	Tokens    float64   `gorm:"type:double precision;not null"`
+	UpdatedAt time.Time `gorm:"not null;index"`
+}
+
+// RegistrationLockout counts consecutive invalid secrets for a client ID or batch key and locks
+// it out once there are too many
+type RegistrationLockout struct {
+	Key           string `gorm:"primaryKey"` // client:<client ID> or batch:<batch key>
+	Failures      int    `gorm:"not null"`
+	LockedUntil   *time.Time
+	LastFailureAt time.Time `gorm:"not null;index"`
+}
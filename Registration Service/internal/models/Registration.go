@@ -0,0 +1,75 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// RegistrationRequest is the payload a device publishes on the registration request topic
+type RegistrationRequest struct {
+	// RequestID correlates the response with the request. Generated by the service when empty.
+	RequestID string `json:"request_id,omitempty"`
+	// ClientID identifies the device until it has a device ID. Responses are published on
+	// <response topic>/<client_id>, so it must not contain '/', '+' or '#'.
+	ClientID string `json:"client_id"`
+	// DeviceSecret is the provisioning secret of the device or its batch
+	DeviceSecret string `json:"device_secret"`
+	// BatchKey selects a batch credential instead of the per-device credential
+	BatchKey string `json:"batch_key,omitempty"`
+	// CSR is an optional PEM encoded certificate request for a client certificate
+	CSR string `json:"csr,omitempty"`
+	// HardwareID is a stable identity of the hardware. Requests with a known identity get the
+	// existing device ID back instead of a new one.
+	HardwareID *HardwareIdentity `json:"hardware_id,omitempty"`
+	// Metadata describes the device's hardware and software
+	Metadata *DeviceMetadata `json:"metadata,omitempty"`
+}
+
+// HardwareIdentity holds stable hardware identifiers reported by the device. At least one
+// of them must be set for the identity to be usable.
+type HardwareIdentity struct {
+	Serial    string `json:"serial,omitempty"`
+	MAC       string `json:"mac,omitempty"`
+	TPMEKHash string `json:"tpm_ek_hash,omitempty"` // hash of the TPM endorsement key
+}
+
+// Fingerprint returns a hex SHA-256 over the normalized identifiers, or an empty string when
+// no identifier is set. MAC addresses are compared without separators and case.
+func (h *HardwareIdentity) Fingerprint() string {
+	if h == nil {
+		return ""
+	}
+	serial := strings.TrimSpace(h.Serial)
+	mac := strings.ToLower(strings.NewReplacer(":", "", "-", "", ".", "").Replace(strings.TrimSpace(h.MAC)))
+	ekHash := strings.ToLower(strings.TrimSpace(h.TPMEKHash))
+	if serial == "" && mac == "" && ekHash == "" {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte("serial=" + serial + "\nmac=" + mac + "\ntpm_ek_hash=" + ekHash))
+	return hex.EncodeToString(sum[:])
+}
+
+// RegistrationResponse is the versioned envelope published back to the device for
+// every registration request, whether it succeeded or not
+type RegistrationResponse struct {
+	Version   int    `json:"version"`
+	RequestID string `json:"request_id,omitempty"`
+	Status    string `json:"status"`               // success, pending or error
+	ErrorCode string `json:"error_code,omitempty"` // set when status is error
+	Message   string `json:"message,omitempty"`    // human readable detail for errors
+	// RetryAfter is the number of seconds to wait before retrying a RATE_LIMITED request
+	RetryAfter int `json:"retry_after,omitempty"`
+
+	DeviceID      string `json:"device_id,omitempty"`
+	Reregistered  bool   `json:"reregistered,omitempty"`   // the hardware was already registered
+	Certificate   string `json:"certificate,omitempty"`    // PEM client certificate, when a CSR was sent
+	CACertificate string `json:"ca_certificate,omitempty"` // PEM certificate of the issuing CA
+
+	// Short-lived token the device presents to other services, see pkg/token. It is not stored
+	// with the response, a replayed response gets a new one.
+	AccessToken          string     `json:"access_token,omitempty"`
+	AccessTokenExpiresAt *time.Time `json:"access_token_expires_at,omitempty"`
+}
@@ -0,0 +1,15 @@
+package models
+
+import (
+	"time"
+)
+
+// RegistrationRecord remembers the outcome of a registration request so that a redelivered or
+// retried request with the same request ID gets the same response instead of a new device.
+// Response is empty while the request is still being processed.
+type RegistrationRecord struct {
+	ClientID  string    `gorm:"primaryKey"`
+	RequestID string    `gorm:"primaryKey"`
+	Response  string    `gorm:"type:text"`
+	CreatedAt time.Time `gorm:"index"`
+}
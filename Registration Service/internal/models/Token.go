@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// TokenRefreshRequest asks for a new access token in exchange for the current one
+type TokenRefreshRequest struct {
+	RequestID string `json:"request_id,omitempty"`
+	DeviceID  string `json:"device_id"`
+	Token     string `json:"token"` // current token, may have expired within the refresh grace period
+}
+
+// TokenRefreshResponse is published on the token response topic of the device
+type TokenRefreshResponse struct {
+	Version   int    `json:"version"`
+	RequestID string `json:"request_id,omitempty"`
+	Status    string `json:"status"`               // success or error
+	ErrorCode string `json:"error_code,omitempty"` // set when status is error
+	Message   string `json:"message,omitempty"`
+
+	AccessToken          string     `json:"access_token,omitempty"`
+	AccessTokenExpiresAt *time.Time `json:"access_token_expires_at,omitempty"`
+}
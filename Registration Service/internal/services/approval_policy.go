@@ -0,0 +1,67 @@
+package services
+
+import (
+	"fmt"
+
+	"github.com/benmeehan/iot-registration-service/internal/constants"
+	"github.com/benmeehan/iot-registration-service/internal/models"
+)
+
+// ApprovalPolicy decides whether a newly registered device is active right away or has to
+// wait in the pending state for an operator. Rules only match data the device can't choose
+// freely: the batch credential the operator issued and allowlisted hardware fingerprints.
+type ApprovalPolicy struct {
+	Mode         string
+	Batches      map[string]bool // keys of batch credentials
+	Fingerprints map[string]bool
+}
+
+// NewApprovalPolicy parses the auto-approval rules. Rules are only consulted in policy mode.
+// CIDR rules are rejected: requests reach the service through the broker, or the connector in
+// queue mode, and neither passes on the address a device connected from, so they would never
+// match.
+func NewApprovalPolicy(mode string, cidrs, batches, fingerprints []string) (*ApprovalPolicy, error) {
+	switch mode {
+	case constants.APPROVAL_MODE_AUTO, constants.APPROVAL_MODE_MANUAL, constants.APPROVAL_MODE_POLICY:
+	default:
+		return nil, fmt.Errorf("unknown approval mode %q", mode)
+	}
+
+	policy := &ApprovalPolicy{
+		Mode:         mode,
+		Batches:      make(map[string]bool),
+		Fingerprints: make(map[string]bool),
+	}
+	if len(cidrs) > 0 {
+		return nil, fmt.Errorf("approval.rules.cidrs is not supported: the origin IP of a registration request is not known, approve by batch or fingerprint instead")
+	}
+	for _, batch := range batches {
+		policy.Batches[batch] = true
+	}
+	for _, fingerprint := range fingerprints {
+		policy.Fingerprints[fingerprint] = true
+	}
+	return policy, nil
+}
+
+// InitialState returns the lifecycle state a new device starts in
+func (p *ApprovalPolicy) InitialState(request *models.RegistrationRequest, credential *models.ProvisioningCredential, fingerprint string) string {
+	switch p.Mode {
+	case constants.APPROVAL_MODE_AUTO:
+		return constants.DEVICE_STATE_ACTIVE
+	case constants.APPROVAL_MODE_POLICY:
+		if p.matches(request, credential, fingerprint) {
+			return constants.DEVICE_STATE_ACTIVE
+		}
+	}
+	return constants.DEVICE_STATE_PENDING
+}
+
+// matches reports whether any auto-approval rule applies to the request
+func (p *ApprovalPolicy) matches(request *models.RegistrationRequest, credential *models.ProvisioningCredential, fingerprint string) bool {
+	if fingerprint != "" && p.Fingerprints[fingerprint] {
+		return true
+	}
+
+	return credential != nil && credential.Type == constants.CREDENTIAL_TYPE_BATCH && p.Batches[credential.Key]
+}
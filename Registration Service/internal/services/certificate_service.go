@@ -0,0 +1,151 @@
+package services
+
+import (
+	"crypto/x509"
+	"fmt"
+	"time"
+
+	"github.com/benmeehan/iot-registration-service/internal/constants"
+	"github.com/benmeehan/iot-registration-service/internal/database"
+	"github.com/benmeehan/iot-registration-service/internal/models"
+	"github.com/benmeehan/iot-registration-service/pkg/ca"
+	"github.com/sirupsen/logrus"
+)
+
+// CertificateService issues and revokes device client certificates using the built-in CA
+type CertificateService struct {
+	CA          *ca.CertificateAuthority
+	DBClient    database.DB
+	CRLValidity time.Duration
+	Logger      *logrus.Logger
+}
+
+// NewCertificateService creates a new instance of CertificateService
+func NewCertificateService(authority *ca.CertificateAuthority, dbClient database.DB, crlValidity time.Duration, logger *logrus.Logger) *CertificateService {
+	if crlValidity <= 0 {
+		crlValidity = 24 * time.Hour
+	}
+	return &CertificateService{
+		CA:          authority,
+		DBClient:    dbClient,
+		CRLValidity: crlValidity,
+		Logger:      logger,
+	}
+}
+
+// IssueCertificate signs the device CSR with the device ID as common name and
+// records the serial on the device. The device still has to be saved by the caller.
+func (cs *CertificateService) IssueCertificate(device *models.Device, csrPEM string) (string, error) {
+	cert, certPEM, err := cs.CA.SignCSR([]byte(csrPEM), device.ID)
+	if err != nil {
+		return "", err
+	}
+
+	device.Certificate = string(certPEM)
+	device.CertificateSerial = ca.SerialString(cert.SerialNumber)
+	device.CertificateExpiresAt = &cert.NotAfter
+
+	cs.Logger.Infof("Issued certificate %s for device %s", device.CertificateSerial, device.ID)
+	return string(certPEM), nil
+}
+
+// CheckCSR validates a certificate request that will be signed later
+func (cs *CertificateService) CheckCSR(csrPEM string) error {
+	_, err := ca.ParseCSR([]byte(csrPEM))
+	return err
+}
+
+// KeyChanged reports whether the CSR is for a different key than the device's current
+// certificate, as after the device was reflashed
+func (cs *CertificateService) KeyChanged(device *models.Device, csrPEM string) (bool, error) {
+	same, err := ca.SameKey([]byte(csrPEM), []byte(device.Certificate))
+	return !same, err
+}
+
+// SupersedeCertificate stores the certificate newly issued to an existing device and
+// revokes the one it replaces
+func (cs *CertificateService) SupersedeCertificate(device *models.Device, previousSerial string, previousExpiry *time.Time) error {
+	if err := cs.DBClient.UpdateDeviceCertificate(device); err != nil {
+		return err
+	}
+	if previousSerial == "" || previousExpiry == nil {
+		return nil
+	}
+
+	err := cs.DBClient.RevokeCertificate(&models.CertificateRevocation{
+		SerialNumber: previousSerial,
+		DeviceID:     device.ID,
+		ExpiresAt:    *previousExpiry,
+		Reason:       constants.CRL_REASON_SUPERSEDED,
+		RevokedAt:    time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to revoke superseded certificate: %w", err)
+	}
+	return nil
+}
+
+// CACertificate returns the PEM encoded CA certificate devices should trust
+func (cs *CertificateService) CACertificate() string {
+	return string(cs.CA.CertificatePEM)
+}
+
+// RevokeDeviceCertificate adds the device's current certificate to the revocation list
+func (cs *CertificateService) RevokeDeviceCertificate(deviceID string, reason int) error {
+	device, err := cs.DBClient.GetDevice(deviceID)
+	if err != nil {
+		return err
+	}
+	if device.CertificateSerial == "" || device.CertificateExpiresAt == nil {
+		return fmt.Errorf("device %s has no certificate", deviceID)
+	}
+	return cs.RevokeCertificate(device, reason)
+}
+
+// RevokeCertificate adds the certificate of a device that was already loaded to the
+// revocation list. Devices without a certificate are left alone.
+func (cs *CertificateService) RevokeCertificate(device *models.Device, reason int) error {
+	if device.CertificateSerial == "" || device.CertificateExpiresAt == nil {
+		return nil
+	}
+
+	return cs.DBClient.RevokeCertificate(&models.CertificateRevocation{
+		SerialNumber: device.CertificateSerial,
+		DeviceID:     device.ID,
+		ExpiresAt:    *device.CertificateExpiresAt,
+		Reason:       reason,
+		RevokedAt:    time.Now(),
+	})
+}
+
+// ReleaseCertificateHold takes a certificate that was put on hold off the revocation list
+func (cs *CertificateService) ReleaseCertificateHold(device *models.Device) error {
+	if device.CertificateSerial == "" {
+		return nil
+	}
+	return cs.DBClient.ReleaseCertificateHold(device.CertificateSerial)
+}
+
+// CRL returns the current DER encoded certificate revocation list
+func (cs *CertificateService) CRL() ([]byte, error) {
+	revocations, err := cs.DBClient.ListCertificateRevocations()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load revocations: %w", err)
+	}
+
+	entries := make([]x509.RevocationListEntry, 0, len(revocations))
+	for _, revocation := range revocations {
+		serial, err := ca.ParseSerial(revocation.SerialNumber)
+		if err != nil {
+			cs.Logger.WithError(err).Warn("Skipping malformed revocation entry")
+			continue
+		}
+		entries = append(entries, x509.RevocationListEntry{
+			SerialNumber:   serial,
+			RevocationTime: revocation.RevokedAt,
+			ReasonCode:     revocation.Reason,
+		})
+	}
+
+	return cs.CA.CreateCRL(entries, cs.CRLValidity)
+}
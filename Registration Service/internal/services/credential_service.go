@@ -0,0 +1,149 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/benmeehan/iot-registration-service/internal/constants"
+	"github.com/benmeehan/iot-registration-service/internal/database"
+	"github.com/benmeehan/iot-registration-service/internal/models"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// ErrCredentialNotFound is returned when no credential matches the lookup key
+var ErrCredentialNotFound = errors.New("provisioning credential not found")
+
+// ErrInvalidCredential is returned when the secret does not match or the credential can't be used
+var ErrInvalidCredential = errors.New("invalid provisioning credential")
+
+// CreateCredentialRequest holds the parameters for issuing a new provisioning credential
+type CreateCredentialRequest struct {
+	Type             string     `json:"type"`             // device or batch
+	Key              string     `json:"key"`              // client_id or batch key
+	Secret           string     `json:"secret,omitempty"` // generated when empty
+	Description      string     `json:"description,omitempty"`
+	ExpiresAt        *time.Time `json:"expires_at,omitempty"`
+	SingleUse        bool       `json:"single_use"`
+	MaxRegistrations int        `json:"max_registrations"`
+}
+
+// CredentialService manages per-device and per-batch provisioning credentials
+type CredentialService struct {
+	DBClient database.DB
+	Logger   *logrus.Logger
+}
+
+// NewCredentialService creates a new instance of CredentialService
+func NewCredentialService(dbClient database.DB, logger *logrus.Logger) *CredentialService {
+	return &CredentialService{
+		DBClient: dbClient,
+		Logger:   logger,
+	}
+}
+
+// CreateCredential stores a new credential and returns it along with the plaintext secret,
+// which is never persisted and can't be recovered afterwards
+func (cs *CredentialService) CreateCredential(req CreateCredentialRequest) (*models.ProvisioningCredential, string, error) {
+	if req.Type != constants.CREDENTIAL_TYPE_DEVICE && req.Type != constants.CREDENTIAL_TYPE_BATCH {
+		return nil, "", fmt.Errorf("credential type must be %q or %q", constants.CREDENTIAL_TYPE_DEVICE, constants.CREDENTIAL_TYPE_BATCH)
+	}
+	if req.Key == "" {
+		return nil, "", fmt.Errorf("credential key is required")
+	}
+	if req.MaxRegistrations < 0 {
+		return nil, "", fmt.Errorf("max_registrations can't be negative")
+	}
+
+	secret := req.Secret
+	if secret == "" {
+		var err error
+		if secret, err = generateSecret(); err != nil {
+			return nil, "", fmt.Errorf("failed to generate secret: %w", err)
+		}
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to hash secret: %w", err)
+	}
+
+	credential := &models.ProvisioningCredential{
+		Type:             req.Type,
+		Key:              req.Key,
+		SecretHash:       string(hash),
+		Description:      req.Description,
+		ExpiresAt:        req.ExpiresAt,
+		SingleUse:        req.SingleUse,
+		MaxRegistrations: req.MaxRegistrations,
+	}
+	if err := cs.DBClient.SaveCredential(credential); err != nil {
+		return nil, "", err
+	}
+
+	cs.Logger.Infof("Created %s provisioning credential %d for key %s", credential.Type, credential.ID, credential.Key)
+	return credential, secret, nil
+}
+
+// Authenticate looks up the credential by type and key and checks the secret against it.
+// It returns ErrCredentialNotFound when no such credential exists. Usage limits are not
+// checked here since re-registering an already known device doesn't consume the credential.
+func (cs *CredentialService) Authenticate(credentialType, key, secret string) (*models.ProvisioningCredential, error) {
+	credential, err := cs.DBClient.GetCredentialByKey(credentialType, key)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrCredentialNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up provisioning credential: %w", err)
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(credential.SecretHash), []byte(secret)) != nil {
+		return nil, ErrInvalidCredential
+	}
+	if credential.RevokedAt != nil || credential.IsExpired(time.Now()) {
+		return nil, ErrInvalidCredential
+	}
+
+	return credential, nil
+}
+
+// ListCredentials returns all provisioning credentials
+func (cs *CredentialService) ListCredentials() ([]models.ProvisioningCredential, error) {
+	return cs.DBClient.ListCredentials()
+}
+
+// GetCredential returns a single provisioning credential
+func (cs *CredentialService) GetCredential(id uint) (*models.ProvisioningCredential, error) {
+	return cs.DBClient.GetCredential(id)
+}
+
+// RevokeCredential prevents any further registrations with the credential
+func (cs *CredentialService) RevokeCredential(id uint) error {
+	if err := cs.DBClient.RevokeCredential(id); err != nil {
+		return err
+	}
+	cs.Logger.Infof("Revoked provisioning credential %d", id)
+	return nil
+}
+
+// DeleteCredential removes the credential entirely
+func (cs *CredentialService) DeleteCredential(id uint) error {
+	if err := cs.DBClient.DeleteCredential(id); err != nil {
+		return err
+	}
+	cs.Logger.Infof("Deleted provisioning credential %d", id)
+	return nil
+}
+
+// generateSecret returns a random URL-safe secret
+func generateSecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,107 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/benmeehan/iot-registration-service/internal/constants"
+	"github.com/benmeehan/iot-registration-service/internal/database"
+	"github.com/benmeehan/iot-registration-service/internal/models"
+	"github.com/benmeehan/iot-registration-service/pkg/kafka"
+	"github.com/benmeehan/iot-registration-service/pkg/mqtt"
+	"github.com/benmeehan/iot-registration-service/pkg/token"
+	KAFKA "github.com/confluentinc/confluent-kafka-go/kafka"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// DeviceInfoService applies metadata updates that agents publish after registration. Updates
+// must carry the device's access token, as labels and tags drive approval and presence.
+type DeviceInfoService struct {
+	MqttClient  mqtt.MQTTClient
+	KafkaClient *kafka.KafkaClient
+	DBClient    database.DB
+	Tokens      *token.Verifier
+	SubTopic    string
+	QOS         int
+	Logger      *logrus.Logger
+	Mode        string
+}
+
+// NewDeviceInfoService creates a new instance of DeviceInfoService
+func NewDeviceInfoService(mode string, mqttClient mqtt.MQTTClient, kafkaClient *kafka.KafkaClient, dbClient database.DB, tokens *token.Verifier, subTopic string, qos int, logger *logrus.Logger) *DeviceInfoService {
+	return &DeviceInfoService{
+		MqttClient:  mqttClient,
+		KafkaClient: kafkaClient,
+		DBClient:    dbClient,
+		Tokens:      tokens,
+		SubTopic:    subTopic,
+		QOS:         qos,
+		Logger:      logger,
+		Mode:        mode,
+	}
+}
+
+// ListenForDeviceInfo subscribes to the device info topic on the configured messaging system
+func (ds *DeviceInfoService) ListenForDeviceInfo() {
+	switch ds.Mode {
+	case constants.QUEUE_MODE:
+		if err := ds.KafkaClient.Subscribe(ds.SubTopic, ds.handleKafkaMessage); err != nil {
+			ds.Logger.WithError(err).Fatal("Failed to consume from device info topic")
+		}
+	default:
+		token := ds.MqttClient.Subscribe(ds.SubTopic, byte(ds.QOS), ds.handleMessage)
+		token.Wait()
+		if err := token.Error(); err != nil {
+			ds.Logger.WithError(err).Fatal("Failed to subscribe to device info topic")
+		}
+		ds.Logger.Infof("Subscribed to topic: %s", ds.SubTopic)
+	}
+}
+
+func (ds *DeviceInfoService) handleMessage(client MQTT.Client, msg MQTT.Message) {
+	ds.processDeviceInfo(msg.Payload())
+}
+
+func (ds *DeviceInfoService) handleKafkaMessage(msg *KAFKA.Message) {
+	ds.processDeviceInfo(kafka.UnwrapPayload(msg.Value))
+}
+
+// processDeviceInfo validates the update and stores the changed fields
+func (ds *DeviceInfoService) processDeviceInfo(payload []byte) {
+	var update models.DeviceInfoUpdate
+	if err := json.Unmarshal(payload, &update); err != nil {
+		ds.Logger.WithError(err).Error("Failed to decode device info update")
+		return
+	}
+	if err := update.Validate(); err != nil {
+		ds.Logger.WithError(err).WithField("device_id", update.DeviceID).Error("Invalid device info update")
+		return
+	}
+	if _, err := uuid.Parse(update.DeviceID); err != nil {
+		ds.Logger.WithField("device_id", update.DeviceID).Error("Device info update has an invalid device ID")
+		return
+	}
+	if err := ds.Tokens.VerifyDevice(update.Token, update.DeviceID); err != nil {
+		ds.Logger.WithError(err).WithField("device_id", update.DeviceID).Warn("Dropped device info update with an invalid access token")
+		return
+	}
+
+	changes := update.Changes()
+	if len(changes) == 0 {
+		return
+	}
+
+	err := ds.DBClient.UpdateDeviceInfo(update.DeviceID, changes)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		ds.Logger.WithField("device_id", update.DeviceID).Warn("Device info update for unknown or decommissioned device")
+		return
+	}
+	if err != nil {
+		ds.Logger.WithError(err).WithField("device_id", update.DeviceID).Error("Failed to update device info")
+		return
+	}
+	ds.Logger.Infof("Updated device info for device: %s", update.DeviceID)
+}
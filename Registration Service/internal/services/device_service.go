@@ -0,0 +1,162 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/benmeehan/iot-registration-service/internal/constants"
+	"github.com/benmeehan/iot-registration-service/internal/database"
+	"github.com/benmeehan/iot-registration-service/internal/models"
+	"github.com/benmeehan/iot-registration-service/pkg/kafka"
+	"github.com/benmeehan/iot-registration-service/pkg/mqtt"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// DeviceService suspends, reactivates and decommissions registered devices and announces
+// each change on the device events topic
+type DeviceService struct {
+	Publisher    *Publisher
+	DBClient     database.DB
+	Credentials  *CredentialService
+	Certificates *CertificateService // nil when the device CA is disabled
+	EventTopic   string
+	Logger       *logrus.Logger
+}
+
+// NewDeviceService creates a new instance of DeviceService
+func NewDeviceService(mode string, mqttClient mqtt.MQTTClient, kafkaClient *kafka.KafkaClient, dbClient database.DB, credentials *CredentialService, certificates *CertificateService, eventTopic string, qos int, logger *logrus.Logger) *DeviceService {
+	return &DeviceService{
+		Publisher:    NewPublisher(mode, mqttClient, kafkaClient, qos, logger),
+		DBClient:     dbClient,
+		Credentials:  credentials,
+		Certificates: certificates,
+		EventTopic:   eventTopic,
+		Logger:       logger,
+	}
+}
+
+// SuspendDevice blocks an active device until it is reactivated. Its certificate is put on hold.
+func (ds *DeviceService) SuspendDevice(deviceID, reason string) error {
+	device, err := ds.DBClient.GetDevice(deviceID)
+	if err != nil {
+		return err
+	}
+
+	device.State = constants.DEVICE_STATE_SUSPENDED
+	device.StateReason = reason
+	if err := ds.DBClient.TransitionDevice(device, constants.DEVICE_STATE_ACTIVE, "state_reason"); err != nil {
+		return err
+	}
+
+	if ds.Certificates != nil {
+		if err := ds.Certificates.RevokeCertificate(device, constants.CRL_REASON_CERTIFICATE_HOLD); err != nil {
+			return fmt.Errorf("device suspended but its certificate could not be put on hold: %w", err)
+		}
+	}
+
+	ds.PublishEvent(device, constants.DEVICE_EVENT_SUSPENDED)
+	return nil
+}
+
+// ReactivateDevice lifts a suspension and releases the hold on the device's certificate
+func (ds *DeviceService) ReactivateDevice(deviceID string) error {
+	device, err := ds.DBClient.GetDevice(deviceID)
+	if err != nil {
+		return err
+	}
+
+	device.State = constants.DEVICE_STATE_ACTIVE
+	device.StateReason = ""
+	if err := ds.DBClient.TransitionDevice(device, constants.DEVICE_STATE_SUSPENDED, "state_reason"); err != nil {
+		return err
+	}
+
+	if ds.Certificates != nil {
+		if err := ds.Certificates.ReleaseCertificateHold(device); err != nil {
+			return fmt.Errorf("device reactivated but its certificate is still on hold: %w", err)
+		}
+	}
+
+	ds.PublishEvent(device, constants.DEVICE_EVENT_REACTIVATED)
+	return nil
+}
+
+// DecommissionDevice permanently retires a device. Its certificate is revoked, a per-device
+// provisioning credential is revoked so it can't register again, and the device is soft deleted.
+func (ds *DeviceService) DecommissionDevice(deviceID, reason string) error {
+	device, err := ds.DBClient.GetDevice(deviceID)
+	if err != nil {
+		return err
+	}
+
+	previousState := device.State
+	device.State = constants.DEVICE_STATE_DECOMMISSIONED
+	device.StateReason = reason
+	if err := ds.DBClient.DecommissionDevice(device, previousState); err != nil {
+		return err
+	}
+
+	if ds.Certificates != nil {
+		// A held certificate is revoked for good, so the hold entry makes way for the final reason
+		if err := ds.Certificates.ReleaseCertificateHold(device); err != nil {
+			return fmt.Errorf("device decommissioned but its certificate could not be revoked: %w", err)
+		}
+		if err := ds.Certificates.RevokeCertificate(device, constants.CRL_REASON_CESSATION_OF_OPERATION); err != nil {
+			return fmt.Errorf("device decommissioned but its certificate could not be revoked: %w", err)
+		}
+	}
+
+	if err := ds.revokeDeviceCredential(device); err != nil {
+		return fmt.Errorf("device decommissioned but its provisioning credential could not be revoked: %w", err)
+	}
+
+	ds.PublishEvent(device, constants.DEVICE_EVENT_DECOMMISSIONED)
+	return nil
+}
+
+// revokeDeviceCredential revokes the credential the device registered with if it belongs to
+// this device alone. Batch credentials are shared and stay usable.
+func (ds *DeviceService) revokeDeviceCredential(device *models.Device) error {
+	if device.ProvisioningCredentialID == nil {
+		return nil
+	}
+
+	credential, err := ds.Credentials.GetCredential(*device.ProvisioningCredentialID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if credential.Type != constants.CREDENTIAL_TYPE_DEVICE || credential.RevokedAt != nil {
+		return nil
+	}
+	return ds.Credentials.RevokeCredential(credential.ID)
+}
+
+// PublishEvent announces a lifecycle change on <EventTopic>/<device ID>, or keyed by device ID
+// in queue mode. The message is retained so the agent learns its state when it reconnects.
+// The change itself is already saved, so a failed publish is only logged.
+func (ds *DeviceService) PublishEvent(device *models.Device, event string) {
+	payload, err := json.Marshal(models.DeviceEvent{
+		Version:   constants.DEVICE_EVENT_VERSION,
+		DeviceID:  device.ID,
+		Event:     event,
+		State:     device.State,
+		Reason:    device.StateReason,
+		Timestamp: time.Now().UTC(),
+	})
+	if err != nil {
+		ds.Logger.WithError(err).Error("Failed to marshal device event")
+		return
+	}
+
+	if err := ds.Publisher.Publish(ds.EventTopic, device.ID, true, payload); err != nil {
+		ds.Logger.WithError(err).Errorf("Failed to publish %s event for device %s", event, device.ID)
+		return
+	}
+	ds.Logger.Infof("Published %s event for device %s", event, device.ID)
+}
@@ -0,0 +1,51 @@
+package services
+
+import (
+	"fmt"
+
+	"github.com/benmeehan/iot-registration-service/internal/constants"
+	"github.com/benmeehan/iot-registration-service/pkg/kafka"
+	"github.com/benmeehan/iot-registration-service/pkg/mqtt"
+	"github.com/sirupsen/logrus"
+)
+
+// Publisher sends messages addressed to a device or client. In MQTT mode the message goes
+// to <topic>/<key>. In queue mode it goes to the Kafka topic with the key as message key,
+// and the connector's reverse mapping delivers it to the same MQTT topic.
+type Publisher struct {
+	MqttClient  mqtt.MQTTClient
+	KafkaClient *kafka.KafkaClient
+	QOS         int
+	Logger      *logrus.Logger
+	Mode        string
+}
+
+// NewPublisher creates a new instance of Publisher
+func NewPublisher(mode string, mqttClient mqtt.MQTTClient, kafkaClient *kafka.KafkaClient, qos int, logger *logrus.Logger) *Publisher {
+	return &Publisher{
+		MqttClient:  mqttClient,
+		KafkaClient: kafkaClient,
+		QOS:         qos,
+		Logger:      logger,
+		Mode:        mode,
+	}
+}
+
+// Publish sends the payload and waits until the broker has it. Retained only applies to MQTT;
+// in queue mode it is up to the connector's mapping.
+func (p *Publisher) Publish(topic, key string, retained bool, payload []byte) error {
+	switch p.Mode {
+	case constants.QUEUE_MODE:
+		if err := p.KafkaClient.PublishMessage(topic, key, payload); err != nil {
+			return fmt.Errorf("failed to publish to Kafka topic %s: %w", topic, err)
+		}
+	default:
+		mqttTopic := fmt.Sprintf("%s/%s", topic, key)
+		token := p.MqttClient.Publish(mqttTopic, byte(p.QOS), retained, payload)
+		token.Wait()
+		if err := token.Error(); err != nil {
+			return fmt.Errorf("failed to publish to topic %s: %w", mqttTopic, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/benmeehan/iot-registration-service/internal/constants"
+	"github.com/benmeehan/iot-registration-service/internal/database"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+// Reasons a registration attempt is rejected, used as the metric label
+const (
+	rejectReasonClientRate    = "client_rate_limit"
+	rejectReasonGlobalRate    = "global_rate_limit"
+	rejectReasonLockedOut     = "locked_out"
+	rejectReasonInvalidSecret = "invalid_secret"
+)
+
+var (
+	rejectedAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "registration_rejected_attempts_total",
+		Help: "Registration attempts rejected by rate limiting, lockout or an invalid secret.",
+	}, []string{"reason"})
+
+	lockouts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "registration_lockouts_total",
+		Help: "Client IDs locked out after repeated invalid secrets.",
+	})
+)
+
+// RateLimiter limits registration attempts per client ID and overall, and locks client IDs
+// and batch keys out with an exponentially growing delay after repeated invalid secrets, so
+// guessing a batch secret under changing client IDs is locked out too. Its state lives in the
+// database so every replica on the shared subscription enforces the same limits.
+type RateLimiter struct {
+	DBClient database.DB
+
+	ClientRate  float64 // tokens per second for each client ID, 0 disables the limit
+	ClientBurst float64
+	GlobalRate  float64 // tokens per second for all client IDs together, 0 disables the limit
+	GlobalBurst float64
+
+	LockoutThreshold int           // consecutive invalid secrets before the first lockout, 0 disables lockouts
+	LockoutBase      time.Duration // length of the first lockout, doubled for every further failure
+	LockoutMax       time.Duration // 0 doesn't cap the lockout
+	FailureWindow    time.Duration // failures further apart than this start a new count
+
+	Logger *logrus.Logger
+}
+
+// NewRateLimiter creates a new instance of RateLimiter
+func NewRateLimiter(dbClient database.DB, clientRate, clientBurst, globalRate, globalBurst float64, lockoutThreshold int, lockoutBase, lockoutMax, failureWindow time.Duration, logger *logrus.Logger) *RateLimiter {
+	if lockoutBase <= 0 {
+		lockoutBase = time.Minute
+	}
+	if failureWindow <= 0 {
+		failureWindow = time.Hour
+	}
+	return &RateLimiter{
+		DBClient:         dbClient,
+		ClientRate:       clientRate,
+		ClientBurst:      math.Max(clientBurst, 1),
+		GlobalRate:       globalRate,
+		GlobalBurst:      math.Max(globalBurst, 1),
+		LockoutThreshold: lockoutThreshold,
+		LockoutBase:      lockoutBase,
+		LockoutMax:       lockoutMax,
+		FailureWindow:    failureWindow,
+		Logger:           logger,
+	}
+}
+
+// Allow checks the lockouts and takes a token from the client's and the global bucket.
+// It returns a RATE_LIMITED registration error when the attempt has to be refused.
+func (rl *RateLimiter) Allow(clientID, batchKey string) error {
+	if rl.LockoutThreshold > 0 {
+		for _, key := range lockoutKeys(clientID, batchKey) {
+			lockedUntil, err := rl.DBClient.GetRegistrationLockout(key)
+			if err != nil {
+				return internalError(fmt.Errorf("failed to check lockout: %w", err))
+			}
+			if lockedUntil != nil {
+				rejectedAttempts.WithLabelValues(rejectReasonLockedOut).Inc()
+				return rateLimitedError("too many invalid secrets, client is locked out", time.Until(*lockedUntil))
+			}
+		}
+	}
+
+	if rl.ClientRate > 0 {
+		ok, err := rl.DBClient.TakeRateLimitToken("client:"+clientID, rl.ClientRate, rl.ClientBurst)
+		if err != nil {
+			return internalError(err)
+		}
+		if !ok {
+			rejectedAttempts.WithLabelValues(rejectReasonClientRate).Inc()
+			return rateLimitedError("too many registration attempts for this client", refillTime(rl.ClientRate))
+		}
+	}
+
+	if rl.GlobalRate > 0 {
+		ok, err := rl.DBClient.TakeRateLimitToken("global", rl.GlobalRate, rl.GlobalBurst)
+		if err != nil {
+			return internalError(err)
+		}
+		if !ok {
+			rejectedAttempts.WithLabelValues(rejectReasonGlobalRate).Inc()
+			return rateLimitedError("registration service is busy", refillTime(rl.GlobalRate))
+		}
+	}
+	return nil
+}
+
+// RecordFailure counts an invalid secret for the client ID and batch key and locks each of
+// them out once the threshold is reached
+func (rl *RateLimiter) RecordFailure(clientID, batchKey string) {
+	rejectedAttempts.WithLabelValues(rejectReasonInvalidSecret).Inc()
+	if rl.LockoutThreshold <= 0 {
+		return
+	}
+
+	for _, key := range lockoutKeys(clientID, batchKey) {
+		failures, err := rl.DBClient.RecordRegistrationFailure(key, rl.FailureWindow)
+		if err != nil {
+			rl.Logger.WithError(err).Error("Failed to record invalid secret")
+			continue
+		}
+		if failures < rl.LockoutThreshold {
+			continue
+		}
+
+		duration := rl.lockoutDuration(failures)
+		if err := rl.DBClient.LockRegistration(key, time.Now().Add(duration)); err != nil {
+			rl.Logger.WithError(err).Error("Failed to lock out client")
+			continue
+		}
+		lockouts.Inc()
+		rl.Logger.Warnf("Locked out %s for %s after %d invalid secrets", key, duration, failures)
+	}
+}
+
+// RecordSuccess clears the failure counts after the client authenticated
+func (rl *RateLimiter) RecordSuccess(clientID, batchKey string) {
+	if rl.LockoutThreshold <= 0 {
+		return
+	}
+	for _, key := range lockoutKeys(clientID, batchKey) {
+		if err := rl.DBClient.ClearRegistrationFailures(key); err != nil {
+			rl.Logger.WithError(err).Error("Failed to clear registration failures")
+		}
+	}
+}
+
+// lockoutDuration doubles the base lockout for every failure past the threshold, up to
+// LockoutMax when it is set. Without a cap it stops doubling before it would overflow.
+func (rl *RateLimiter) lockoutDuration(failures int) time.Duration {
+	limit := rl.LockoutMax
+	if limit <= 0 {
+		limit = math.MaxInt64 / 2
+	}
+	duration := rl.LockoutBase
+	for i := rl.LockoutThreshold; i < failures && duration < limit; i++ {
+		duration *= 2
+	}
+	if rl.LockoutMax > 0 && duration > rl.LockoutMax {
+		duration = rl.LockoutMax
+	}
+	return duration
+}
+
+// lockoutKeys returns the keys failures are counted under: the client ID and, when the
+// request names one, the batch key
+func lockoutKeys(clientID, batchKey string) []string {
+	keys := []string{"client:" + clientID}
+	if batchKey != "" {
+		keys = append(keys, "batch:"+batchKey)
+	}
+	return keys
+}
+
+// refillTime returns how long it takes to refill one token at the given rate
+func refillTime(rate float64) time.Duration {
+	return time.Duration(float64(time.Second) / rate)
+}
+
+// rateLimitedError creates a RATE_LIMITED error telling the device when to retry
+func rateLimitedError(message string, retryAfter time.Duration) *RegistrationError {
+	err := newRegistrationError(constants.ERROR_CODE_RATE_LIMITED, message, nil)
+	err.RetryAfter = retryAfter
+	return err
+}
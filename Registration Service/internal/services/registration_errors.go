@@ -0,0 +1,38 @@
+package services
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/benmeehan/iot-registration-service/internal/constants"
+)
+
+// RegistrationError is a failed registration whose code and message are reported back to the device.
+// The wrapped error carries internal detail that is only logged.
+type RegistrationError struct {
+	Code       string
+	Message    string
+	Err        error
+	RetryAfter time.Duration // set for RATE_LIMITED errors
+}
+
+func (e *RegistrationError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s: %v", e.Code, e.Message, e.Err)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func (e *RegistrationError) Unwrap() error {
+	return e.Err
+}
+
+// newRegistrationError creates a RegistrationError with the given code
+func newRegistrationError(code, message string, err error) *RegistrationError {
+	return &RegistrationError{Code: code, Message: message, Err: err}
+}
+
+// internalError wraps an unexpected failure without exposing its details to the device
+func internalError(err error) *RegistrationError {
+	return newRegistrationError(constants.ERROR_CODE_INTERNAL, "internal error", err)
+}
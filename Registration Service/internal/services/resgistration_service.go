@@ -1,174 +1,639 @@
-package services
-
-import (
-	"encoding/json"
-	"fmt"
-
-	"github.com/benmeehan/iot-registration-service/internal/constants"
-	"github.com/benmeehan/iot-registration-service/internal/database"
-	"github.com/benmeehan/iot-registration-service/internal/models"
-	"github.com/benmeehan/iot-registration-service/pkg/kafka"
-	"github.com/benmeehan/iot-registration-service/pkg/mqtt"
-	KAFKA "github.com/confluentinc/confluent-kafka-go/kafka"
-	MQTT "github.com/eclipse/paho.mqtt.golang"
-	"github.com/google/uuid"
-	"github.com/sirupsen/logrus"
-)
-
-// RegistrationService manages the device registration process on the cloud side
-type RegistrationService struct {
-	MqttClient  mqtt.MQTTClient
-	KafkaClient *kafka.KafkaClient
-	DBClient    database.DB
-	PubTopic    string
-	SubTopic    string
-	QOS         int
-	Secret      string
-	Logger      *logrus.Logger
-	Mode        string
-}
-
-// NewRegistrationService creates a new instance of RegistrationService
-func NewRegistrationService(mode string, mqttClient mqtt.MQTTClient, kafkaClient *kafka.KafkaClient, dbClient database.DB, pubTopic, subTopic string, qos int, secret string, logger *logrus.Logger) *RegistrationService {
-	return &RegistrationService{
-		MqttClient:  mqttClient,
-		KafkaClient: kafkaClient,
-		DBClient:    dbClient,
-		PubTopic:    pubTopic,
-		SubTopic:    subTopic,
-		QOS:         qos,
-		Secret:      secret,
-		Logger:      logger,
-		Mode:        mode,
-	}
-}
-
-// ListenForDeviceRegistration subscribes to the appropriate messaging system based on the mode
-func (rs *RegistrationService) ListenForDeviceRegistration() {
-	switch rs.Mode {
-	case constants.QUEUE_MODE:
-		rs.listenForDeviceRegistrationKafka()
-	default:
-		rs.listenForDeviceRegistrationMQTT()
-	}
-}
-
-// listenForDeviceRegistrationMQTT subscribes to the registration topic via MQTT
-func (rs *RegistrationService) listenForDeviceRegistrationMQTT() {
-	token := rs.MqttClient.Subscribe(rs.SubTopic, byte(rs.QOS), rs.handleRegistrationRequest)
-	token.Wait()
-	if err := token.Error(); err != nil {
-		rs.Logger.WithError(err).Fatal("Failed to subscribe to registration topic")
-	}
-}
-
-// listenForDeviceRegistrationKafka consumes messages from the Kafka topic
-func (rs *RegistrationService) listenForDeviceRegistrationKafka() {
-	// Assume KafkaClient has a method to consume messages from a topic
-	go func() {
-		err := rs.KafkaClient.Subscribe(rs.SubTopic, rs.handleRegistrationRequestKafka)
-		if err != nil {
-			rs.Logger.WithError(err).Fatal("Failed to consume from Kafka topic")
-		}
-	}()
-}
-
-// handleRegistrationRequest processes incoming device registration requests via MQTT
-func (rs *RegistrationService) handleRegistrationRequest(client MQTT.Client, msg MQTT.Message) {
-	rs.processRegistrationRequest(msg.Payload())
-}
-
-// handleRegistrationRequestKafka processes incoming device registration requests via Kafka
-func (rs *RegistrationService) handleRegistrationRequestKafka(message *KAFKA.Message) {
-	payload := message.Value
-	rs.processRegistrationRequest(payload)
-}
-
-// processRegistrationRequest is the shared logic for processing registration requests
-func (rs *RegistrationService) processRegistrationRequest(payload []byte) {
-	var request map[string]string
-	if err := json.Unmarshal(payload, &request); err != nil {
-		rs.Logger.WithError(err).Error("Error parsing registration request")
-		return
-	}
-
-	clientID, deviceSecret, err := extractFields(request)
-	if err != nil {
-		rs.Logger.WithError(err).Error("Failed to extract fields from registration request")
-		return
-	}
-
-	deviceID, err := rs.registerDevice(clientID, deviceSecret)
-	if err != nil {
-		rs.Logger.WithError(err).Error("Failed to register device")
-		return
-	}
-
-	if err := rs.sendRegistrationResponse(clientID, deviceID); err != nil {
-		rs.Logger.WithError(err).Error("Failed to send registration response")
-	}
-}
-
-// extractFields retrieves client ID and device secret from the payload
-func extractFields(payload map[string]string) (string, string, error) {
-	clientID, exists := payload["client_id"]
-	if !exists {
-		return "", "", fmt.Errorf("client ID not found in the registration request")
-	}
-
-	deviceSecret, exists := payload["device_secret"]
-	if !exists {
-		return "", "", fmt.Errorf("device secret not found in the registration request")
-	}
-
-	return clientID, deviceSecret, nil
-}
-
-// registerDevice stores the device information in the database
-func (rs *RegistrationService) registerDevice(clientID, deviceSecret string) (string, error) {
-	// Compare the provided device secret with the stored secret
-	if deviceSecret != rs.Secret {
-		return "", fmt.Errorf("invalid device secret provided for client: %s", clientID)
-	}
-
-	// Generate a new device ID
-	deviceID, err := generateDeviceID()
-	if err != nil {
-		return "", err
-	}
-
-	device := models.NewDevice(deviceID)
-	if err := rs.DBClient.SaveDevice(device); err != nil {
-		return "", err
-	}
-
-	return deviceID, nil
-}
-
-// using uuid v7 as it is time sortable
-func generateDeviceID() (string, error) {
-	id, err := uuid.NewV7()
-	if err != nil {
-		return "", err
-	}
-	return id.String(), nil
-}
-
-// sendRegistrationResponse publishes the registration response back to the device
-func (rs *RegistrationService) sendRegistrationResponse(clientID, deviceID string) error {
-	response := map[string]string{"device_id": deviceID}
-	responseBytes, err := json.Marshal(response)
-	if err != nil {
-		return fmt.Errorf("failed to marshal response: %w", err)
-	}
-
-	responseTopic := fmt.Sprintf("%s/%s", rs.PubTopic, clientID)
-	token := rs.MqttClient.Publish(responseTopic, byte(rs.QOS), false, responseBytes)
-	token.Wait()
-	if err := token.Error(); err != nil {
-		return fmt.Errorf("failed to publish registration response: %w", err)
-	}
-
-	rs.Logger.Infof("Device %s registered successfully with ID: %s", clientID, deviceID)
-	return nil
-}
+package services
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/benmeehan/iot-registration-service/internal/constants"
+	"github.com/benmeehan/iot-registration-service/internal/database"
+	"github.com/benmeehan/iot-registration-service/internal/models"
+	"github.com/benmeehan/iot-registration-service/pkg/kafka"
+	"github.com/benmeehan/iot-registration-service/pkg/mqtt"
+	KAFKA "github.com/confluentinc/confluent-kafka-go/kafka"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// RegistrationService manages the device registration process on the cloud side
+type RegistrationService struct {
+	MqttClient   mqtt.MQTTClient
+	KafkaClient  *kafka.KafkaClient
+	DBClient     database.DB
+	Credentials  *CredentialService
+	Certificates *CertificateService // nil when the device CA is disabled
+	PubTopic     string
+	SubTopic     string
+	QOS          int
+	Secret       string // Shared secret, only checked when LegacyPSK is enabled
+	LegacyPSK    bool
+	// ReregistrationPolicy decides what happens when a known hardware fingerprint registers again
+	ReregistrationPolicy string
+	// Approvals decides which new devices have to wait for an operator
+	Approvals *ApprovalPolicy
+	// RateLimiter throttles attempts and locks out client IDs guessing secrets
+	RateLimiter *RateLimiter
+	// Tokens issues access tokens to registered devices, nil when tokens are disabled
+	Tokens *TokenService
+	// Devices announces newly registered devices on the device events topic
+	Devices *DeviceService
+	// Publisher sends responses over MQTT, or through Kafka in queue mode
+	Publisher *Publisher
+	Logger    *logrus.Logger
+	Mode      string
+}
+
+// NewRegistrationService creates a new instance of RegistrationService
+func NewRegistrationService(mode string, mqttClient mqtt.MQTTClient, kafkaClient *kafka.KafkaClient, dbClient database.DB, credentials *CredentialService, certificates *CertificateService, pubTopic, subTopic string, qos int, secret string, legacyPSK bool, reregistrationPolicy string, approvals *ApprovalPolicy, rateLimiter *RateLimiter, tokens *TokenService, devices *DeviceService, logger *logrus.Logger) *RegistrationService {
+	return &RegistrationService{
+		MqttClient:           mqttClient,
+		KafkaClient:          kafkaClient,
+		DBClient:             dbClient,
+		Credentials:          credentials,
+		Certificates:         certificates,
+		PubTopic:             pubTopic,
+		SubTopic:             subTopic,
+		QOS:                  qos,
+		Secret:               secret,
+		LegacyPSK:            legacyPSK,
+		ReregistrationPolicy: reregistrationPolicy,
+		Approvals:            approvals,
+		RateLimiter:          rateLimiter,
+		Tokens:               tokens,
+		Devices:              devices,
+		Publisher:            NewPublisher(mode, mqttClient, kafkaClient, qos, logger),
+		Logger:               logger,
+		Mode:                 mode,
+	}
+}
+
+// ListenForDeviceRegistration subscribes to the appropriate messaging system based on the mode
+func (rs *RegistrationService) ListenForDeviceRegistration() {
+	switch rs.Mode {
+	case constants.QUEUE_MODE:
+		rs.listenForDeviceRegistrationKafka()
+	default:
+		rs.listenForDeviceRegistrationMQTT()
+	}
+}
+
+// listenForDeviceRegistrationMQTT subscribes to the registration topic via MQTT
+func (rs *RegistrationService) listenForDeviceRegistrationMQTT() {
+	token := rs.MqttClient.Subscribe(rs.SubTopic, byte(rs.QOS), rs.handleRegistrationRequest)
+	token.Wait()
+	if err := token.Error(); err != nil {
+		rs.Logger.WithError(err).Fatal("Failed to subscribe to registration topic")
+	}
+}
+
+// listenForDeviceRegistrationKafka consumes messages from the Kafka topic
+func (rs *RegistrationService) listenForDeviceRegistrationKafka() {
+	// Assume KafkaClient has a method to consume messages from a topic
+	go func() {
+		err := rs.KafkaClient.Subscribe(rs.SubTopic, rs.handleRegistrationRequestKafka)
+		if err != nil {
+			rs.Logger.WithError(err).Fatal("Failed to consume from Kafka topic")
+		}
+	}()
+}
+
+// handleRegistrationRequest processes incoming device registration requests via MQTT
+func (rs *RegistrationService) handleRegistrationRequest(client MQTT.Client, msg MQTT.Message) {
+	rs.processRegistrationRequest(msg.Payload())
+}
+
+// handleRegistrationRequestKafka processes incoming device registration requests via Kafka
+func (rs *RegistrationService) handleRegistrationRequestKafka(message *KAFKA.Message) {
+	rs.processRegistrationRequest(kafka.UnwrapPayload(message.Value))
+}
+
+// processRegistrationRequest is the shared logic for processing registration requests.
+// Every request that names a usable client ID gets a response, including failures.
+func (rs *RegistrationService) processRegistrationRequest(payload []byte) {
+	request, err := parseRegistrationRequest(payload)
+	if err != nil {
+		rs.Logger.WithError(err).Error("Error parsing registration request")
+		if request != nil && validClientID(request.ClientID) {
+			rs.sendRegistrationResponse(request, errorResponse(err))
+		}
+		return
+	}
+
+	// Requests that carry their own request ID are processed at most once, so redelivered
+	// and retried messages get the original response instead of registering again
+	deduplicate := request.RequestID != ""
+	withRequestID(request)
+	if deduplicate {
+		claimed, record, err := rs.DBClient.ClaimRegistrationRequest(request.ClientID, request.RequestID)
+		if err != nil {
+			rs.Logger.WithError(err).Error("Failed to record registration request")
+			rs.sendRegistrationResponse(request, errorResponse(internalError(err)))
+			return
+		}
+		if !claimed {
+			rs.replayRegistrationResponse(request, record)
+			return
+		}
+	}
+
+	response, err := rs.registerDevice(request)
+	if err != nil {
+		rs.Logger.WithError(err).WithField("request_id", request.RequestID).Error("Failed to register device")
+		response = errorResponse(err)
+	}
+
+	if deduplicate {
+		rs.recordRegistrationResponse(request, response)
+	}
+	rs.attachAccessToken(response)
+
+	if rs.sendRegistrationResponse(request, response) && err == nil {
+		rs.Logger.Infof("Device %s registered with ID %s, status %s", request.ClientID, response.DeviceID, response.Status)
+	}
+}
+
+// replayRegistrationResponse answers a duplicate request with the stored response. Duplicates
+// of requests that are still being processed are dropped, the original will be answered.
+func (rs *RegistrationService) replayRegistrationResponse(request *models.RegistrationRequest, record *models.RegistrationRecord) {
+	if record.Response == "" {
+		rs.Logger.Infof("Ignoring duplicate registration request %s from %s still in progress", request.RequestID, request.ClientID)
+		return
+	}
+
+	rs.Logger.Infof("Replaying response for duplicate registration request %s from %s", request.RequestID, request.ClientID)
+	payload := []byte(record.Response)
+
+	// Tokens aren't stored, so a replayed success gets a fresh one while the device is still active
+	var response models.RegistrationResponse
+	if rs.Tokens != nil && json.Unmarshal(payload, &response) == nil && response.Status == constants.RESPONSE_STATUS_SUCCESS {
+		device, err := rs.DBClient.GetDevice(response.DeviceID)
+		if err == nil && device.State == constants.DEVICE_STATE_ACTIVE {
+			rs.attachAccessToken(&response)
+			if withToken, err := json.Marshal(&response); err == nil {
+				payload = withToken
+			}
+		}
+	}
+
+	if err := rs.publishResponse(request.ClientID, payload); err != nil {
+		rs.Logger.WithError(err).Error("Failed to replay registration response")
+	}
+}
+
+// attachAccessToken adds an access token to successful responses when tokens are enabled.
+// The device is still registered without one if signing fails and can refresh later.
+func (rs *RegistrationService) attachAccessToken(response *models.RegistrationResponse) {
+	if rs.Tokens == nil || response.DeviceID == "" || response.ErrorCode != "" ||
+		response.Status == constants.RESPONSE_STATUS_PENDING {
+		return
+	}
+
+	accessToken, expiresAt, err := rs.Tokens.IssueToken(response.DeviceID)
+	if err != nil {
+		rs.Logger.WithError(err).Errorf("Failed to issue access token for device %s", response.DeviceID)
+		return
+	}
+	response.AccessToken = accessToken
+	response.AccessTokenExpiresAt = expiresAt
+}
+
+// recordRegistrationResponse stores the response for a claimed request. Internal errors are
+// not stored so that the device's retry is processed again.
+func (rs *RegistrationService) recordRegistrationResponse(request *models.RegistrationRequest, response *models.RegistrationResponse) {
+	var err error
+	// Internal and rate limit errors are transient, so a retry with the same request ID is processed again
+	if response.ErrorCode == constants.ERROR_CODE_INTERNAL || response.ErrorCode == constants.ERROR_CODE_RATE_LIMITED {
+		err = rs.DBClient.ReleaseRegistrationRequest(request.ClientID, request.RequestID)
+	} else {
+		var responseBytes []byte
+		if responseBytes, err = json.Marshal(prepareResponse(request, response)); err == nil {
+			err = rs.DBClient.CompleteRegistrationRequest(request.ClientID, request.RequestID, string(responseBytes))
+		}
+	}
+	if err != nil {
+		rs.Logger.WithError(err).Error("Failed to record registration response")
+	}
+}
+
+// StartRecordCleanup periodically deletes registration request records and rate limiter
+// state older than the TTL
+func (rs *RegistrationService) StartRecordCleanup(ttl time.Duration) {
+	if ttl <= 0 {
+		ttl = 24 * time.Hour
+	}
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for ; ; <-ticker.C {
+			deleted, err := rs.DBClient.DeleteRegistrationRecordsBefore(time.Now().Add(-ttl))
+			if err != nil {
+				rs.Logger.WithError(err).Error("Failed to clean up registration request records")
+			} else if deleted > 0 {
+				rs.Logger.Infof("Deleted %d expired registration request records", deleted)
+			}
+			if err := rs.DBClient.DeleteRateLimitStateBefore(time.Now().Add(-ttl)); err != nil {
+				rs.Logger.WithError(err).Error("Failed to clean up rate limiter state")
+			}
+		}
+	}()
+}
+
+// parseRegistrationRequest decodes and validates the payload. When the payload is invalid but
+// still names a client ID, the partially decoded request is returned along with the error so
+// the device can be told what went wrong.
+func parseRegistrationRequest(payload []byte) (*models.RegistrationRequest, error) {
+	var request models.RegistrationRequest
+	if err := json.Unmarshal(payload, &request); err != nil {
+		// Salvage the addressing fields from payloads with unexpected value types
+		var fields map[string]interface{}
+		if json.Unmarshal(payload, &fields) != nil {
+			return nil, newRegistrationError(constants.ERROR_CODE_MALFORMED_REQUEST, "request is not valid JSON", err)
+		}
+		request.ClientID, _ = fields["client_id"].(string)
+		request.RequestID, _ = fields["request_id"].(string)
+		return withRequestID(&request), newRegistrationError(constants.ERROR_CODE_MALFORMED_REQUEST, "request fields have invalid types", err)
+	}
+
+	if err := extractFields(&request); err != nil {
+		return &request, newRegistrationError(constants.ERROR_CODE_MALFORMED_REQUEST, err.Error(), nil)
+	}
+	return &request, nil
+}
+
+// extractFields checks that the required fields are present in the request
+func extractFields(request *models.RegistrationRequest) error {
+	if request.ClientID == "" {
+		return fmt.Errorf("client ID not found in the registration request")
+	}
+	if !validClientID(request.ClientID) {
+		return fmt.Errorf("client ID must not contain '/', '+' or '#'")
+	}
+	if request.DeviceSecret == "" {
+		return fmt.Errorf("device secret not found in the registration request")
+	}
+	if request.HardwareID != nil && request.HardwareID.Fingerprint() == "" {
+		return fmt.Errorf("hardware ID must contain a serial, MAC or TPM EK hash")
+	}
+	if request.Metadata != nil {
+		if err := request.Metadata.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validClientID reports whether the client ID can be used as a single MQTT topic level
+func validClientID(clientID string) bool {
+	return clientID != "" && !strings.ContainsAny(clientID, "/+#")
+}
+
+// withRequestID assigns a request ID when the device didn't send one
+func withRequestID(request *models.RegistrationRequest) *models.RegistrationRequest {
+	if request.RequestID == "" {
+		request.RequestID = uuid.New().String()
+	}
+	return request
+}
+
+// registerDevice authenticates the request, stores the device in the database and, when a CSR
+// is provided, issues a client certificate for it. Hardware that is already registered gets its
+// existing device ID back. Failures are returned as *RegistrationError.
+func (rs *RegistrationService) registerDevice(request *models.RegistrationRequest) (*models.RegistrationResponse, error) {
+	if err := rs.RateLimiter.Allow(request.ClientID, request.BatchKey); err != nil {
+		return nil, err
+	}
+
+	credential, err := rs.authenticate(request.ClientID, request.BatchKey, request.DeviceSecret)
+	if err != nil {
+		var regErr *RegistrationError
+		if errors.As(err, &regErr) && regErr.Code == constants.ERROR_CODE_INVALID_SECRET {
+			rs.RateLimiter.RecordFailure(request.ClientID, request.BatchKey)
+		}
+		return nil, err
+	}
+	rs.RateLimiter.RecordSuccess(request.ClientID, request.BatchKey)
+
+	fingerprint := request.HardwareID.Fingerprint()
+	if fingerprint != "" {
+		existing, err := rs.DBClient.GetDeviceByFingerprint(fingerprint)
+		if err == nil {
+			return rs.reregisterDevice(existing, credential, request)
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, internalError(err)
+		}
+	}
+
+	if credential != nil && credential.IsExhausted() {
+		return nil, newRegistrationError(constants.ERROR_CODE_INVALID_SECRET, "invalid device secret",
+			fmt.Errorf("provisioning credential %d has no registrations left", credential.ID))
+	}
+
+	if request.CSR != "" && rs.Certificates == nil {
+		return nil, newRegistrationError(constants.ERROR_CODE_CERTIFICATE_UNAVAILABLE, "certificate issuance is not enabled", nil)
+	}
+
+	// Generate a new device ID
+	deviceID, err := generateDeviceID()
+	if err != nil {
+		return nil, internalError(err)
+	}
+
+	device := models.NewDevice(deviceID)
+	device.ClientID = request.ClientID
+	device.State = rs.Approvals.InitialState(request, credential, fingerprint)
+	if fingerprint != "" {
+		device.HardwareFingerprint = &fingerprint
+	}
+	if request.Metadata != nil {
+		request.Metadata.Apply(device)
+	}
+	response := &models.RegistrationResponse{DeviceID: deviceID}
+
+	if device.State == constants.DEVICE_STATE_PENDING {
+		// The CSR is signed once the device is approved
+		if request.CSR != "" {
+			if err := rs.Certificates.CheckCSR(request.CSR); err != nil {
+				return nil, newRegistrationError(constants.ERROR_CODE_INVALID_CSR, "certificate request was rejected", err)
+			}
+			device.PendingCSR = request.CSR
+		}
+		pendingResponse(response)
+	} else if request.CSR != "" {
+		// Sign before saving so a bad CSR doesn't leave a device behind
+		if response.Certificate, err = rs.Certificates.IssueCertificate(device, request.CSR); err != nil {
+			return nil, newRegistrationError(constants.ERROR_CODE_INVALID_CSR, "certificate request was rejected", err)
+		}
+		response.CACertificate = rs.Certificates.CACertificate()
+	}
+
+	if credential != nil {
+		err = rs.DBClient.SaveDeviceWithCredential(device, credential.ID)
+	} else {
+		err = rs.DBClient.SaveDevice(device)
+	}
+	if errors.Is(err, database.ErrCredentialExhausted) {
+		// Another registration used up the credential after it was checked
+		return nil, newRegistrationError(constants.ERROR_CODE_INVALID_SECRET, "invalid device secret", err)
+	}
+	if errors.Is(err, gorm.ErrDuplicatedKey) && fingerprint != "" {
+		// A concurrent request registered the same hardware first
+		if existing, lookupErr := rs.DBClient.GetDeviceByFingerprint(fingerprint); lookupErr == nil {
+			return rs.reregisterDevice(existing, credential, request)
+		}
+	}
+	if err != nil {
+		return nil, internalError(err)
+	}
+
+	rs.Devices.PublishEvent(device, constants.DEVICE_EVENT_REGISTERED)
+	return response, nil
+}
+
+// reregisterDevice answers a registration from hardware that already has a device ID,
+// applying the configured re-registration policy
+func (rs *RegistrationService) reregisterDevice(device *models.Device, credential *models.ProvisioningCredential, request *models.RegistrationRequest) (*models.RegistrationResponse, error) {
+	// Only the credential that registered the hardware may register it again
+	if !sameCredential(device.ProvisioningCredentialID, credential) {
+		return nil, newRegistrationError(constants.ERROR_CODE_INVALID_SECRET, "invalid device secret",
+			fmt.Errorf("device %s was registered with a different credential", device.ID))
+	}
+
+	switch device.State {
+	case constants.DEVICE_STATE_REJECTED:
+		return nil, newRegistrationError(constants.ERROR_CODE_REJECTED, "device registration was rejected", nil)
+	case constants.DEVICE_STATE_SUSPENDED:
+		return nil, newRegistrationError(constants.ERROR_CODE_SUSPENDED, "device is suspended", nil)
+	case constants.DEVICE_STATE_PENDING:
+		// Still waiting for an operator; the follow-up goes out when the device is approved
+		return pendingResponse(&models.RegistrationResponse{DeviceID: device.ID, Reregistered: true}), nil
+	}
+
+	if rs.ReregistrationPolicy == constants.REREGISTRATION_POLICY_REJECT {
+		return nil, newRegistrationError(constants.ERROR_CODE_ALREADY_REGISTERED, "device is already registered", nil)
+	}
+
+	response := &models.RegistrationResponse{DeviceID: device.ID, Reregistered: true}
+
+	// The device may have been reflashed since it first registered
+	if request.Metadata != nil {
+		request.Metadata.Apply(device)
+		if err := rs.DBClient.UpdateDeviceMetadata(device); err != nil {
+			return nil, internalError(err)
+		}
+	}
+
+	// Keep hands back the current certificate; a new one is only issued when there is none yet,
+	// the CSR is for a new key or the policy is to rotate
+	rotate := request.CSR != "" && (device.Certificate == "" || rs.ReregistrationPolicy == constants.REREGISTRATION_POLICY_ROTATE)
+	if rotate && rs.Certificates == nil {
+		return nil, newRegistrationError(constants.ERROR_CODE_CERTIFICATE_UNAVAILABLE, "certificate issuance is not enabled", nil)
+	}
+	if !rotate && request.CSR != "" && rs.Certificates != nil {
+		changed, err := rs.Certificates.KeyChanged(device, request.CSR)
+		if err != nil {
+			return nil, newRegistrationError(constants.ERROR_CODE_INVALID_CSR, "certificate request was rejected", err)
+		}
+		rotate = changed
+	}
+	if rotate {
+
+		previousSerial, previousExpiry := device.CertificateSerial, device.CertificateExpiresAt
+		if _, err := rs.Certificates.IssueCertificate(device, request.CSR); err != nil {
+			return nil, newRegistrationError(constants.ERROR_CODE_INVALID_CSR, "certificate request was rejected", err)
+		}
+		if err := rs.Certificates.SupersedeCertificate(device, previousSerial, previousExpiry); err != nil {
+			return nil, internalError(err)
+		}
+	}
+
+	if device.Certificate != "" && rs.Certificates != nil {
+		response.Certificate = device.Certificate
+		response.CACertificate = rs.Certificates.CACertificate()
+	}
+
+	rs.Logger.Infof("Hardware of client %s is already registered as device %s", request.ClientID, device.ID)
+	return response, nil
+}
+
+// pendingResponse marks the response as waiting for approval
+func pendingResponse(response *models.RegistrationResponse) *models.RegistrationResponse {
+	response.Status = constants.RESPONSE_STATUS_PENDING
+	response.Message = "registration is awaiting approval"
+	return response
+}
+
+// ListDevices returns the devices in the given lifecycle state
+func (rs *RegistrationService) ListDevices(state string) ([]models.Device, error) {
+	return rs.DBClient.ListDevicesByState(state)
+}
+
+// ApproveDevice activates a pending device, signs the CSR it registered with and sends the
+// device a follow-up response with its certificate
+func (rs *RegistrationService) ApproveDevice(deviceID string) error {
+	device, err := rs.DBClient.GetDevice(deviceID)
+	if err != nil {
+		return err
+	}
+	if device.State != constants.DEVICE_STATE_PENDING {
+		return database.ErrStateConflict
+	}
+
+	response := &models.RegistrationResponse{DeviceID: device.ID}
+	if device.PendingCSR != "" && rs.Certificates != nil {
+		// The CSR was checked at registration, so this only fails if the CA changed since.
+		// The device is approved anyway and can send a new CSR by registering again.
+		if response.Certificate, err = rs.Certificates.IssueCertificate(device, device.PendingCSR); err != nil {
+			rs.Logger.WithError(err).Warnf("Approving device %s without a certificate", device.ID)
+		} else {
+			response.CACertificate = rs.Certificates.CACertificate()
+		}
+	}
+
+	device.State = constants.DEVICE_STATE_ACTIVE
+	device.PendingCSR = ""
+	err = rs.DBClient.TransitionDevice(device, constants.DEVICE_STATE_PENDING,
+		"pending_csr", "certificate", "certificate_serial", "certificate_expires_at")
+	if err != nil {
+		return err
+	}
+
+	rs.attachAccessToken(response)
+	rs.sendFollowUpResponse(device, response)
+	return nil
+}
+
+// RejectDevice rejects a pending device and tells the device why
+func (rs *RegistrationService) RejectDevice(deviceID, reason string) error {
+	device, err := rs.DBClient.GetDevice(deviceID)
+	if err != nil {
+		return err
+	}
+
+	device.State = constants.DEVICE_STATE_REJECTED
+	device.PendingCSR = ""
+	if err := rs.DBClient.TransitionDevice(device, constants.DEVICE_STATE_PENDING, "pending_csr"); err != nil {
+		return err
+	}
+
+	if reason == "" {
+		reason = "device registration was rejected"
+	}
+	rs.sendFollowUpResponse(device, &models.RegistrationResponse{
+		DeviceID:  device.ID,
+		Status:    constants.RESPONSE_STATUS_ERROR,
+		ErrorCode: constants.ERROR_CODE_REJECTED,
+		Message:   reason,
+	})
+	return nil
+}
+
+// sendFollowUpResponse publishes the outcome of an approval decision on the response topic
+// of the client ID the device registered with
+func (rs *RegistrationService) sendFollowUpResponse(device *models.Device, response *models.RegistrationResponse) {
+	if device.ClientID == "" {
+		rs.Logger.Warnf("Device %s has no client ID, can't send follow-up response", device.ID)
+		return
+	}
+	rs.sendRegistrationResponse(&models.RegistrationRequest{ClientID: device.ClientID}, response)
+}
+
+// sameCredential reports whether the credential is the one the device was registered with
+func sameCredential(deviceCredentialID *uint, credential *models.ProvisioningCredential) bool {
+	if deviceCredentialID == nil || credential == nil {
+		return deviceCredentialID == nil && credential == nil
+	}
+	return *deviceCredentialID == credential.ID
+}
+
+// authenticate checks the device secret against the batch credential when a batch key is given,
+// otherwise against the per-device credential for the client ID. If the client has no credential
+// and legacy mode is enabled, the shared secret is accepted and a nil credential is returned.
+func (rs *RegistrationService) authenticate(clientID, batchKey, deviceSecret string) (*models.ProvisioningCredential, error) {
+	credentialType, key := constants.CREDENTIAL_TYPE_DEVICE, clientID
+	if batchKey != "" {
+		credentialType, key = constants.CREDENTIAL_TYPE_BATCH, batchKey
+	}
+
+	invalid := newRegistrationError(constants.ERROR_CODE_INVALID_SECRET, "invalid device secret",
+		fmt.Errorf("invalid device secret provided for client: %s", clientID))
+
+	credential, err := rs.Credentials.Authenticate(credentialType, key, deviceSecret)
+	switch {
+	case err == nil:
+		return credential, nil
+	case errors.Is(err, ErrCredentialNotFound) && batchKey == "" && rs.LegacyPSK:
+		if subtle.ConstantTimeCompare([]byte(deviceSecret), []byte(rs.Secret)) == 1 {
+			return nil, nil
+		}
+		return nil, invalid
+	case errors.Is(err, ErrCredentialNotFound), errors.Is(err, ErrInvalidCredential):
+		return nil, invalid
+	default:
+		return nil, internalError(err)
+	}
+}
+
+// using uuid v7 as it is time sortable
+func generateDeviceID() (string, error) {
+	id, err := uuid.NewV7()
+	if err != nil {
+		return "", err
+	}
+	return id.String(), nil
+}
+
+// errorResponse builds the response for a failed registration
+func errorResponse(err error) *models.RegistrationResponse {
+	var regErr *RegistrationError
+	if !errors.As(err, &regErr) {
+		regErr = internalError(err)
+	}
+
+	return &models.RegistrationResponse{
+		Status:     constants.RESPONSE_STATUS_ERROR,
+		ErrorCode:  regErr.Code,
+		Message:    regErr.Message,
+		RetryAfter: int(math.Ceil(regErr.RetryAfter.Seconds())),
+	}
+}
+
+// prepareResponse fills in the envelope fields. The status defaults to success.
+func prepareResponse(request *models.RegistrationRequest, response *models.RegistrationResponse) *models.RegistrationResponse {
+	response.Version = constants.REGISTRATION_RESPONSE_VERSION
+	response.RequestID = request.RequestID
+	if response.Status == "" {
+		response.Status = constants.RESPONSE_STATUS_SUCCESS
+	}
+	return response
+}
+
+// sendRegistrationResponse publishes the registration response back to the device
+// and reports whether it was sent
+func (rs *RegistrationService) sendRegistrationResponse(request *models.RegistrationRequest, response *models.RegistrationResponse) bool {
+	responseBytes, err := json.Marshal(prepareResponse(request, response))
+	if err != nil {
+		rs.Logger.WithError(err).Error("Failed to marshal registration response")
+		return false
+	}
+
+	if err := rs.publishResponse(request.ClientID, responseBytes); err != nil {
+		rs.Logger.WithError(err).Error("Failed to send registration response")
+		return false
+	}
+	return true
+}
+
+// publishResponse publishes a serialized response on the client's response topic
+func (rs *RegistrationService) publishResponse(clientID string, payload []byte) error {
+	if err := rs.Publisher.Publish(rs.PubTopic, clientID, false, payload); err != nil {
+		return fmt.Errorf("failed to publish registration response: %w", err)
+	}
+	return nil
+}
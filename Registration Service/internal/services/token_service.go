@@ -0,0 +1,166 @@
+package services
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/benmeehan/iot-registration-service/internal/constants"
+	"github.com/benmeehan/iot-registration-service/internal/database"
+	"github.com/benmeehan/iot-registration-service/internal/models"
+	"github.com/benmeehan/iot-registration-service/pkg/kafka"
+	"github.com/benmeehan/iot-registration-service/pkg/mqtt"
+	"github.com/benmeehan/iot-registration-service/pkg/token"
+	KAFKA "github.com/confluentinc/confluent-kafka-go/kafka"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// TokenService issues device access tokens and refreshes them on request
+type TokenService struct {
+	MqttClient   mqtt.MQTTClient
+	Publisher    *Publisher
+	KafkaClient  *kafka.KafkaClient
+	DBClient     database.DB
+	Signer       *token.Signer
+	Verifier     *token.Verifier
+	PubTopic     string
+	SubTopic     string
+	QOS          int
+	RefreshGrace time.Duration // how long after expiry a token can still be refreshed
+	Logger       *logrus.Logger
+	Mode         string
+}
+
+// NewTokenService creates a new instance of TokenService
+func NewTokenService(mode string, mqttClient mqtt.MQTTClient, kafkaClient *kafka.KafkaClient, dbClient database.DB, signer *token.Signer, pubTopic, subTopic string, qos int, refreshGrace time.Duration, logger *logrus.Logger) *TokenService {
+	return &TokenService{
+		MqttClient:   mqttClient,
+		Publisher:    NewPublisher(mode, mqttClient, kafkaClient, qos, logger),
+		KafkaClient:  kafkaClient,
+		DBClient:     dbClient,
+		Signer:       signer,
+		Verifier:     token.NewVerifier([]ed25519.PublicKey{signer.PublicKey()}, signer.Issuer, 0),
+		PubTopic:     pubTopic,
+		SubTopic:     subTopic,
+		QOS:          qos,
+		RefreshGrace: refreshGrace,
+		Logger:       logger,
+		Mode:         mode,
+	}
+}
+
+// IssueToken signs a new access token for the device
+func (ts *TokenService) IssueToken(deviceID string) (string, *time.Time, error) {
+	accessToken, expiresAt, err := ts.Signer.Sign(deviceID)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to sign access token: %w", err)
+	}
+	return accessToken, &expiresAt, nil
+}
+
+// ListenForTokenRefresh subscribes to the token refresh topic on the configured messaging system
+func (ts *TokenService) ListenForTokenRefresh() {
+	switch ts.Mode {
+	case constants.QUEUE_MODE:
+		if err := ts.KafkaClient.Subscribe(ts.SubTopic, ts.handleKafkaMessage); err != nil {
+			ts.Logger.WithError(err).Fatal("Failed to consume from token refresh topic")
+		}
+	default:
+		subscription := ts.MqttClient.Subscribe(ts.SubTopic, byte(ts.QOS), ts.handleMessage)
+		subscription.Wait()
+		if err := subscription.Error(); err != nil {
+			ts.Logger.WithError(err).Fatal("Failed to subscribe to token refresh topic")
+		}
+		ts.Logger.Infof("Subscribed to topic: %s", ts.SubTopic)
+	}
+}
+
+func (ts *TokenService) handleMessage(client MQTT.Client, msg MQTT.Message) {
+	ts.processRefreshRequest(msg.Payload())
+}
+
+func (ts *TokenService) handleKafkaMessage(msg *KAFKA.Message) {
+	ts.processRefreshRequest(kafka.UnwrapPayload(msg.Value))
+}
+
+// processRefreshRequest exchanges the device's current token for a new one. Every request that
+// names a valid device ID gets a response.
+func (ts *TokenService) processRefreshRequest(payload []byte) {
+	var request models.TokenRefreshRequest
+	if err := json.Unmarshal(payload, &request); err != nil {
+		ts.Logger.WithError(err).Error("Failed to decode token refresh request")
+		return
+	}
+	if !validClientID(request.DeviceID) {
+		ts.Logger.WithField("device_id", request.DeviceID).Error("Token refresh request has an invalid device ID")
+		return
+	}
+
+	response, err := ts.refresh(&request)
+	if err != nil {
+		ts.Logger.WithError(err).WithField("device_id", request.DeviceID).Error("Failed to refresh access token")
+		regErr := errorResponse(err)
+		response = &models.TokenRefreshResponse{
+			Status:    regErr.Status,
+			ErrorCode: regErr.ErrorCode,
+			Message:   regErr.Message,
+		}
+	}
+	ts.sendRefreshResponse(&request, response)
+}
+
+// refresh checks the presented token and that the device may still have one
+func (ts *TokenService) refresh(request *models.TokenRefreshRequest) (*models.TokenRefreshResponse, error) {
+	claims, err := ts.Verifier.Verify(request.Token)
+	if errors.Is(err, token.ErrExpired) && time.Since(time.Unix(claims.ExpiresAt, 0)) <= ts.RefreshGrace {
+		err = nil
+	}
+	if err == nil && claims.Subject != request.DeviceID {
+		err = token.ErrWrongSubject
+	}
+	if err != nil {
+		return nil, newRegistrationError(constants.ERROR_CODE_INVALID_TOKEN, "access token can't be refreshed, register again", err)
+	}
+
+	device, err := ts.DBClient.GetDevice(request.DeviceID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, newRegistrationError(constants.ERROR_CODE_INVALID_TOKEN, "device is not registered", err)
+	}
+	if err != nil {
+		return nil, internalError(err)
+	}
+	if device.State != constants.DEVICE_STATE_ACTIVE {
+		return nil, newRegistrationError(constants.ERROR_CODE_SUSPENDED, fmt.Sprintf("device is %s", device.State), nil)
+	}
+
+	accessToken, expiresAt, err := ts.IssueToken(device.ID)
+	if err != nil {
+		return nil, internalError(err)
+	}
+	ts.Logger.Infof("Refreshed access token of device %s", device.ID)
+	return &models.TokenRefreshResponse{AccessToken: accessToken, AccessTokenExpiresAt: expiresAt}, nil
+}
+
+// sendRefreshResponse publishes the response on <PubTopic>/<device ID>, or keyed by device ID
+// in queue mode
+func (ts *TokenService) sendRefreshResponse(request *models.TokenRefreshRequest, response *models.TokenRefreshResponse) {
+	response.Version = constants.REGISTRATION_RESPONSE_VERSION
+	response.RequestID = request.RequestID
+	if response.Status == "" {
+		response.Status = constants.RESPONSE_STATUS_SUCCESS
+	}
+
+	payload, err := json.Marshal(response)
+	if err != nil {
+		ts.Logger.WithError(err).Error("Failed to marshal token refresh response")
+		return
+	}
+
+	if err := ts.Publisher.Publish(ts.PubTopic, request.DeviceID, false, payload); err != nil {
+		ts.Logger.WithError(err).Error("Failed to send token refresh response")
+	}
+}
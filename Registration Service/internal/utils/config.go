@@ -1,84 +1,141 @@
-package utils
-
-import (
-	"os"
-
-	"github.com/sirupsen/logrus"
-	"gopkg.in/yaml.v2"
-)
-
-// Config represents the structure of the configuration file.
-type Config struct {
-	MQTT struct {
-		Broker   string `yaml:"broker"`    // MQTT broker address
-		ClientID string `yaml:"client_id"` // MQTT client ID
-		QOS      int    `yaml:"QOS"`       // MQTT Quality of Service
-		TLS      struct {
-			CACert string `yaml:"ca_cert"`
-		} `yaml:"tls"` // Path to the CA certificate
-		Topics struct {
-			Request  string `yaml:"request"`
-			Response string `yaml:"response"`
-		} `yaml:"topics"`
-	} `yaml:"mqtt"`
-
-	DB struct {
-		Host     string `yaml:"host"`     // Database host address
-		Port     int    `yaml:"port"`     // Database port
-		User     string `yaml:"user"`     // Database user
-		Password string `yaml:"password"` // Database password
-		Name     string `yaml:"dbname"`   // Database name
-		SSLMode  string `yaml:"sslmode"`  // SSL mode for the connection
-	} `yaml:"database"`
-
-	Device struct {
-		SecretFile string `yaml:"secret_file"` // Device secret location
-	} `yaml:"device"`
-
-	Kafka struct {
-		Topic            string   `yaml:"topic"`             // Kafka topic
-		Brokers          []string `yaml:"brokers"`           // List of Kafka brokers
-		ClientID         string   `yaml:"client_id"`         // Kafka client ID
-		SecurityProtocol string   `yaml:"security_protocol"` // Security protocol
-		GroupID          string   `yaml:"group_id"`          // Consumer Group ID
-		SSL              struct {
-			CACert string `yaml:"ca_cert"` // Path to the CA certificate
-			Cert   string `yaml:"cert"`    // Path to the client certificate
-			Key    string `yaml:"key"`     // Path to the client key
-		} `yaml:"ssl"`
-		SASL struct {
-			Mechanism string `yaml:"mechanism"` // SASL mechanism
-			Username  string `yaml:"username"`  // SASL username
-			Password  string `yaml:"password"`  // SASL password
-		} `yaml:"sasl"`
-	} `yaml:"kafka"`
-
-	Service struct {
-		Mode string `yaml:"mode"` // Direct MQTT or Queue mode
-	} `yaml:"service"`
-}
-
-// LoadConfig loads the YAML configuration from the specified file.
-// It returns a pointer to the Config struct and an error if loading fails.
-func LoadConfig(filename string, logger *logrus.Logger) (*Config, error) {
-	logger.Infof("Loading configuration from file: %s", filename)
-
-	file, err := os.Open(filename)
-	if err != nil {
-		logger.Errorf("Failed to open config file: %v", err)
-		return nil, err
-	}
-	defer file.Close()
-
-	// Decode the YAML file into the Config struct
-	var config Config
-	decoder := yaml.NewDecoder(file)
-	err = decoder.Decode(&config)
-	if err != nil {
-		logger.Errorf("Failed to decode config file: %v", err)
-		return nil, err
-	}
-
-	logger.Infof("Configuration loaded successfully from %s", filename)
-	return &config, nil
-}
+package utils
+
+import (
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// Config represents the structure of the configuration file.
+type Config struct {
+	MQTT struct {
+		Broker   string `yaml:"broker"`    // MQTT broker address
+		ClientID string `yaml:"client_id"` // MQTT client ID
+		QOS      int    `yaml:"QOS"`       // MQTT Quality of Service
+		TLS      struct {
+			CACert string `yaml:"ca_cert"`
+		} `yaml:"tls"` // Path to the CA certificate
+		Topics struct {
+			Request       string `yaml:"request"`
+			Response      string `yaml:"response"`
+			DeviceInfo    string `yaml:"device_info"`    // Metadata updates published by agents
+			DeviceEvents  string `yaml:"device_events"`  // Lifecycle events, published per device
+			TokenRefresh  string `yaml:"token_refresh"`  // Access token refresh requests
+			TokenResponse string `yaml:"token_response"` // Refresh responses, published per device
+		} `yaml:"topics"`
+	} `yaml:"mqtt"`
+
+	DB struct {
+		Host     string `yaml:"host"`     // Database host address
+		Port     int    `yaml:"port"`     // Database port
+		User     string `yaml:"user"`     // Database user
+		Password string `yaml:"password"` // Database password
+		Name     string `yaml:"dbname"`   // Database name
+		SSLMode  string `yaml:"sslmode"`  // SSL mode for the connection
+	} `yaml:"database"`
+
+	Device struct {
+		SecretFile string `yaml:"secret_file"` // Device secret location
+		LegacyPSK  bool   `yaml:"legacy_psk"`  // Accept the shared secret for clients without a credential
+	} `yaml:"device"`
+
+	Registration struct {
+		ReregistrationPolicy string        `yaml:"reregistration_policy"` // keep, rotate or reject
+		RequestRecordTTL     time.Duration `yaml:"request_record_ttl"`    // How long request IDs are remembered
+	} `yaml:"registration"`
+
+	RateLimit struct {
+		ClientRate       float64       `yaml:"client_rate"`       // Attempts per second per client ID, 0 disables the limit
+		ClientBurst      float64       `yaml:"client_burst"`      // Attempts a client ID can make at once
+		GlobalRate       float64       `yaml:"global_rate"`       // Attempts per second over all client IDs, 0 disables the limit
+		GlobalBurst      float64       `yaml:"global_burst"`      // Attempts all client IDs can make at once
+		LockoutThreshold int           `yaml:"lockout_threshold"` // Invalid secrets before a client ID is locked out, 0 disables lockouts
+		LockoutBase      time.Duration `yaml:"lockout_base"`      // First lockout, doubled for every further invalid secret
+		LockoutMax       time.Duration `yaml:"lockout_max"`       // Longest lockout
+		FailureWindow    time.Duration `yaml:"failure_window"`    // Invalid secrets further apart than this are not counted together
+	} `yaml:"rate_limit"`
+
+	Approval struct {
+		Mode  string `yaml:"mode"` // auto, manual or policy
+		Rules struct {
+			CIDRs        []string `yaml:"cidrs"`        // Not supported, the service fails to start when set: no origin IP reaches it
+			Batches      []string `yaml:"batches"`      // Keys of batch credentials whose devices are approved automatically
+			Fingerprints []string `yaml:"fingerprints"` // Hardware fingerprints that are approved automatically
+		} `yaml:"rules"`
+	} `yaml:"approval"`
+
+	CA struct {
+		Enabled     bool          `yaml:"enabled"`      // Issue client certificates for device CSRs
+		CertFile    string        `yaml:"cert_file"`    // CA certificate location
+		KeyFile     string        `yaml:"key_file"`     // CA private key location
+		Validity    time.Duration `yaml:"validity"`     // Lifetime of issued device certificates
+		CRLValidity time.Duration `yaml:"crl_validity"` // How long a published CRL stays valid
+	} `yaml:"ca"`
+
+	Token struct {
+		Enabled      bool          `yaml:"enabled"`       // Issue access tokens to registered devices
+		KeyFile      string        `yaml:"key_file"`      // Ed25519 signing key location (PKCS#8 PEM)
+		Issuer       string        `yaml:"issuer"`        // iss claim checked by the verifying services
+		TTL          time.Duration `yaml:"ttl"`           // Lifetime of an access token
+		RefreshGrace time.Duration `yaml:"refresh_grace"` // How long an expired token can still be refreshed
+	} `yaml:"token"`
+
+	Admin struct {
+		Address   string `yaml:"address"`    // Admin API listen address
+		TokenFile string `yaml:"token_file"` // Admin API bearer token location
+	} `yaml:"admin"`
+
+	Kafka struct {
+		Topic              string   `yaml:"topic"`                // Kafka topic
+		DeviceInfoTopic    string   `yaml:"device_info_topic"`    // Kafka topic for device info updates
+		TokenRefreshTopic  string   `yaml:"token_refresh_topic"`  // Kafka topic for token refresh requests
+		ResponseTopic      string   `yaml:"response_topic"`       // Kafka topic for registration responses, keyed by client ID
+		TokenResponseTopic string   `yaml:"token_response_topic"` // Kafka topic for token refresh responses, keyed by device ID
+		DeviceEventsTopic  string   `yaml:"device_events_topic"`  // Kafka topic for device lifecycle events, keyed by device ID
+		Brokers            []string `yaml:"brokers"`              // List of Kafka brokers
+		ClientID           string   `yaml:"client_id"`            // Kafka client ID
+		SecurityProtocol   string   `yaml:"security_protocol"`    // Security protocol
+		GroupID            string   `yaml:"group_id"`             // Consumer Group ID
+		SSL                struct {
+			CACert string `yaml:"ca_cert"` // Path to the CA certificate
+			Cert   string `yaml:"cert"`    // Path to the client certificate
+			Key    string `yaml:"key"`     // Path to the client key
+		} `yaml:"ssl"`
+		SASL struct {
+			Mechanism string `yaml:"mechanism"` // SASL mechanism
+			Username  string `yaml:"username"`  // SASL username
+			Password  string `yaml:"password"`  // SASL password
+		} `yaml:"sasl"`
+	} `yaml:"kafka"`
+
+	Service struct {
+		Mode string `yaml:"mode"` // Direct MQTT or Queue mode
+	} `yaml:"service"`
+}
+
+// LoadConfig loads the YAML configuration from the specified file.
+// It returns a pointer to the Config struct and an error if loading fails.
+func LoadConfig(filename string, logger *logrus.Logger) (*Config, error) {
+	logger.Infof("Loading configuration from file: %s", filename)
+
+	file, err := os.Open(filename)
+	if err != nil {
+		logger.Errorf("Failed to open config file: %v", err)
+		return nil, err
+	}
+	defer file.Close()
+
+	// Decode the YAML file into the Config struct
+	var config Config
+	decoder := yaml.NewDecoder(file)
+	err = decoder.Decode(&config)
+	if err != nil {
+		logger.Errorf("Failed to decode config file: %v", err)
+		return nil, err
+	}
+
+	logger.Infof("Configuration loaded successfully from %s", filename)
+	return &config, nil
+}
@@ -0,0 +1,237 @@
+package ca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// CertificateAuthority signs device client certificates and revocation lists
+type CertificateAuthority struct {
+	Certificate    *x509.Certificate
+	CertificatePEM []byte
+	Signer         crypto.Signer
+	Validity       time.Duration
+	Logger         *logrus.Logger
+}
+
+// LoadCertificateAuthority reads the PEM encoded CA certificate and private key from disk
+func LoadCertificateAuthority(certPath, keyPath string, validity time.Duration, logger *logrus.Logger) (*CertificateAuthority, error) {
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA certificate: %w", err)
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no PEM certificate found in %s", certPath)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CA certificate: %w", err)
+	}
+	if !cert.IsCA {
+		return nil, fmt.Errorf("certificate in %s is not a CA certificate", certPath)
+	}
+	// Revocation lists can only be signed by certificates with the cRLSign usage
+	if cert.KeyUsage&x509.KeyUsageCRLSign == 0 {
+		return nil, fmt.Errorf("CA certificate in %s lacks the cRLSign key usage", certPath)
+	}
+
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA key: %w", err)
+	}
+	signer, err := parsePrivateKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if !publicKeysEqual(cert.PublicKey, signer.Public()) {
+		return nil, errors.New("CA private key does not match the CA certificate")
+	}
+
+	if validity <= 0 {
+		return nil, errors.New("certificate validity must be positive")
+	}
+
+	logger.Infof("Loaded device CA %s", cert.Subject.CommonName)
+	return &CertificateAuthority{
+		Certificate:    cert,
+		CertificatePEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}),
+		Signer:         signer,
+		Validity:       validity,
+		Logger:         logger,
+	}, nil
+}
+
+// ParseCSR decodes a PEM encoded certificate request and checks its signature and key type
+func ParseCSR(csrPEM []byte) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, errors.New("no PEM certificate request found")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate request: %w", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid certificate request signature: %w", err)
+	}
+
+	switch key := csr.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if key.N.BitLen() < 2048 {
+			return nil, errors.New("RSA keys must be at least 2048 bits")
+		}
+	case *ecdsa.PublicKey, ed25519.PublicKey:
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", key)
+	}
+	return csr, nil
+}
+
+// SignCSR verifies the PEM encoded certificate request and issues a client certificate
+// with the given common name. The CSR subject is ignored apart from its public key.
+func (c *CertificateAuthority) SignCSR(csrPEM []byte, commonName string) (*x509.Certificate, []byte, error) {
+	csr, err := ParseCSR(csrPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyUsage := x509.KeyUsageDigitalSignature
+	if _, ok := csr.PublicKey.(*rsa.PublicKey); ok {
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    now.Add(-5 * time.Minute), // tolerate small clock differences on the device
+		NotAfter:     now.Add(c.Validity),
+		KeyUsage:     keyUsage,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, c.Certificate, csr.PublicKey, c.Signer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to sign certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+// CreateCRL signs a DER encoded certificate revocation list valid for the given duration
+func (c *CertificateAuthority) CreateCRL(entries []x509.RevocationListEntry, validity time.Duration) ([]byte, error) {
+	now := time.Now()
+	template := &x509.RevocationList{
+		RevokedCertificateEntries: entries,
+		// Time based CRL numbers are monotonic across restarts and replicas
+		Number:     big.NewInt(now.UnixNano()),
+		ThisUpdate: now,
+		NextUpdate: now.Add(validity),
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, template, c.Certificate, c.Signer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create revocation list: %w", err)
+	}
+	return der, nil
+}
+
+// SerialString formats a certificate serial number the way it is stored in the database
+func SerialString(serial *big.Int) string {
+	return fmt.Sprintf("%x", serial)
+}
+
+// ParseSerial parses a serial number produced by SerialString
+func ParseSerial(serial string) (*big.Int, error) {
+	n, ok := new(big.Int).SetString(serial, 16)
+	if !ok {
+		return nil, fmt.Errorf("invalid certificate serial %q", serial)
+	}
+	return n, nil
+}
+
+// randomSerial returns a random positive 128-bit serial number
+func randomSerial() (*big.Int, error) {
+	limit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serial, err := rand.Int(rand.Reader, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+	return serial.Add(serial, big.NewInt(1)), nil
+}
+
+// parsePrivateKey accepts PKCS#8, SEC 1 (EC) and PKCS#1 (RSA) PEM keys
+func parsePrivateKey(keyPEM []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("no PEM private key found")
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported private key type %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CA key: %w", err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("CA key of type %T can't sign", key)
+	}
+	return signer, nil
+}
+
+// SameKey reports whether the PEM encoded certificate request and certificate carry the same
+// public key
+func SameKey(csrPEM, certPEM []byte) (bool, error) {
+	csr, err := ParseCSR(csrPEM)
+	if err != nil {
+		return false, err
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return false, errors.New("no PEM certificate found")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	return publicKeysEqual(csr.PublicKey, cert.PublicKey), nil
+}
+
+func publicKeysEqual(a, b crypto.PublicKey) bool {
+	key, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && key.Equal(b)
+}
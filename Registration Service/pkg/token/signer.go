@@ -0,0 +1,85 @@
+package token
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Signer issues short-lived device access tokens
+type Signer struct {
+	Key    ed25519.PrivateKey
+	KeyID  string
+	Issuer string
+	TTL    time.Duration
+}
+
+// LoadSigner reads a PEM encoded PKCS#8 Ed25519 private key from disk
+func LoadSigner(keyPath, issuer string, ttl time.Duration) (*Signer, error) {
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token signing key: %w", err)
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("no PEM private key found in %s", keyPath)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse token signing key: %w", err)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("token signing key in %s is not an Ed25519 key", keyPath)
+	}
+
+	if ttl <= 0 {
+		ttl = time.Hour
+	}
+	return &Signer{
+		Key:    key,
+		KeyID:  KeyID(key.Public().(ed25519.PublicKey)),
+		Issuer: issuer,
+		TTL:    ttl,
+	}, nil
+}
+
+// Sign issues a token for the device and returns it with its expiry
+func (s *Signer) Sign(deviceID string) (string, time.Time, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to generate token ID: %w", err)
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(s.TTL)
+	headerJSON, err := json.Marshal(header{Algorithm: Algorithm, Type: "JWT", KeyID: s.KeyID})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	claimsJSON, err := json.Marshal(Claims{
+		Issuer:    s.Issuer,
+		Subject:   deviceID,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expiresAt.Unix(),
+		ID:        hex.EncodeToString(jti),
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	signingInput := encoding.EncodeToString(headerJSON) + "." + encoding.EncodeToString(claimsJSON)
+	signature := ed25519.Sign(s.Key, []byte(signingInput))
+	return signingInput + "." + encoding.EncodeToString(signature), expiresAt, nil
+}
+
+// PublicKey returns the verification key for the signer's tokens
+func (s *Signer) PublicKey() ed25519.PublicKey {
+	return s.Key.Public().(ed25519.PublicKey)
+}
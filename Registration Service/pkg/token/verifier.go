@@ -0,0 +1,132 @@
+package token
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Verifier checks device access tokens issued by the registration service
+type Verifier struct {
+	Keys   map[string]ed25519.PublicKey // by key ID
+	Issuer string                       // required issuer, empty accepts any
+	Leeway time.Duration                // clock skew tolerated on the expiry
+}
+
+// NewVerifier creates a verifier trusting the given public keys
+func NewVerifier(keys []ed25519.PublicKey, issuer string, leeway time.Duration) *Verifier {
+	v := &Verifier{Keys: make(map[string]ed25519.PublicKey), Issuer: issuer, Leeway: leeway}
+	for _, key := range keys {
+		v.Keys[KeyID(key)] = key
+	}
+	return v
+}
+
+// LoadVerifier reads PEM encoded Ed25519 public keys from the given files. Listing more than
+// one key allows the signing key to be rotated without rejecting tokens that are still valid.
+func LoadVerifier(keyPaths []string, issuer string, leeway time.Duration) (*Verifier, error) {
+	var keys []ed25519.PublicKey
+	for _, keyPath := range keyPaths {
+		keyPEM, err := os.ReadFile(keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read token public key: %w", err)
+		}
+		block, _ := pem.Decode(keyPEM)
+		if block == nil || block.Type != "PUBLIC KEY" {
+			return nil, fmt.Errorf("no PEM public key found in %s", keyPath)
+		}
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse token public key: %w", err)
+		}
+		key, ok := parsed.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("token public key in %s is not an Ed25519 key", keyPath)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no token public keys configured")
+	}
+	return NewVerifier(keys, issuer, leeway), nil
+}
+
+// Verify checks the token's signature, issuer and expiry and returns its claims
+func (v *Verifier) Verify(token string) (*Claims, error) {
+	claims, err := v.parse(token)
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(time.Unix(claims.ExpiresAt, 0).Add(v.Leeway)) {
+		return claims, ErrExpired
+	}
+	return claims, nil
+}
+
+// VerifyDevice checks the token and that it was issued to the given device
+func (v *Verifier) VerifyDevice(token, deviceID string) error {
+	claims, err := v.Verify(token)
+	if err != nil {
+		return err
+	}
+	if claims.Subject != deviceID {
+		return ErrWrongSubject
+	}
+	return nil
+}
+
+// parse checks everything except the expiry
+func (v *Verifier) parse(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, err
+	}
+	if h.Algorithm != Algorithm {
+		return nil, fmt.Errorf("%w: unsupported algorithm %q", ErrMalformed, h.Algorithm)
+	}
+	key, ok := v.Keys[h.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key %q", ErrBadSignature, h.KeyID)
+	}
+
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	if !ed25519.Verify(key, []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrBadSignature
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if v.Issuer != "" && claims.Issuer != v.Issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrBadSignature, claims.Issuer)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: missing subject", ErrMalformed)
+	}
+	return &claims, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := encoding.DecodeString(segment)
+	if err != nil {
+		return ErrMalformed
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return ErrMalformed
+	}
+	return nil
+}